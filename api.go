@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/storage"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+// Read-only API of the stored cards:
+//
+//	GET /cards?limit=N          IDs of the stored cards, the latest first
+//	GET /cards/<id>             card.json of the card
+//	GET /cards/<id>/<file name> the file stored along with the card, e.g. the image
+type cardsAPI struct {
+	storage *storage.DirectoryCardStorage
+}
+
+func newCardsAPI(cardStorage *storage.DirectoryCardStorage) http.Handler {
+	return &cardsAPI{storage: cardStorage}
+}
+
+func (a *cardsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/cards"), "/")
+	if rest == "" {
+		a.serveList(w, r)
+		return
+	}
+	idStr, fileName, _ := strings.Cut(rest, "/")
+	parsedID, err := strconv.ParseInt(idStr, 10, 32)
+	if err != nil || parsedID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	card := types.CardID(parsedID)
+	if fileName == "" {
+		fileName = "card.json"
+	}
+	a.serveFile(w, r, card, fileName)
+}
+
+func (a *cardsAPI) serveList(w http.ResponseWriter, r *http.Request) {
+	cards, err := a.storage.StoredCards()
+	if err != nil {
+		logging.Component(r.Context(), "api").Error("Failed to list stored cards", logging.ErrorKey, err)
+		http.Error(w, "failed to list stored cards", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(cards, func(i, j int) bool { return cards[i] > cards[j] })
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		if limit < len(cards) {
+			cards = cards[:limit]
+		}
+	}
+	w.Header().Set("Content-Type", types.JsonMimeType)
+	if err := json.NewEncoder(w).Encode(cards); err != nil {
+		logging.Component(r.Context(), "api").Warn("Failed to write card list", logging.ErrorKey, err)
+	}
+}
+
+func (a *cardsAPI) serveFile(w http.ResponseWriter, r *http.Request, card types.CardID, fileName string) {
+	f, err := a.storage.OpenCardFile(card, fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logging.Component(r.Context(), "api").Error("Failed to open card file", logging.CardIDKey, card, "file", fileName, logging.ErrorKey, err)
+		http.Error(w, "failed to open card file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, fileName, info.ModTime(), f)
+}
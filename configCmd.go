@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Prints the effective configuration, e.g. to check what a deployment runs with or to start a config file
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "Usage: poiskzooCrawler config print [-config file] [-set key=value]...")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("config print", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	flags.Parse(args[1:])
+
+	cfg := configFlags.loadUnvalidated()
+	if configFlags.path != "" {
+		fmt.Printf("# file: %s\n", configFlags.path)
+	}
+	if err := cfg.Print(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print the configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+}
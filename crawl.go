@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/crawler"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/health"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/metrics"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// main loop
+// 1. take latest set of "known card ids"
+// 2. crawl latest cards until we intersect with "latest known"
+// 3. push jobs for downloading corresponding images
+// 4. update "latest known card ids"
+// 5. notify pipeline
+
+// A card failing this many cycles in a row (e.g. its page can't be parsed) is given up,
+// not to download it over and over again
+const maxCardAttempts = 3
+
+// Crawls the new cards every poll interval, or once with --once
+func runCrawl(args []string) {
+	flags := flag.NewFlagSet("crawl", flag.ExitOnError)
+	once := flags.Bool("once", false, "run a single crawl cycle, deliver the notifications and exit")
+	configFlags := addConfigFlags(flags)
+	flags.Parse(args)
+	cfg := configFlags.load()
+
+	s, err := setupCrawler(cfg)
+	exitOnSetupError(err)
+	defer s.close()
+
+	pollInterval := cfg.PollInterval
+	knownIDsHeap := newKnownIDsHeap(s.storedCards)
+	// the number of the cycles each card has failed in so far
+	failedAttempts := make(map[types.CardID]int)
+
+	if s.sender != nil && !*once {
+		go s.sender.Run(context.Background())
+	}
+
+	// endpoints served by the crawler
+	httpMux := http.NewServeMux()
+	httpMux.Handle("/metrics", metrics.Handler())
+	metrics.PollInterval.Set(pollInterval.Seconds())
+
+	monitor := health.NewMonitor(pollInterval)
+	monitor.StalenessFactor = float64(cfg.LivenessStalenessFactor)
+	monitor.AddReadinessCheck("card storage", health.DirWritable(s.cardsDir))
+	if s.outbox != nil {
+		monitor.AddReadinessCheck("outbox", health.DirWritable(s.outboxDir))
+	}
+	for _, card := range *knownIDsHeap {
+		monitor.SetWatermark(card)
+	}
+	httpMux.HandleFunc("/healthz", monitor.ServeLiveness)
+	httpMux.HandleFunc("/readyz", monitor.ServeReadiness)
+	httpMux.HandleFunc("/status", monitor.ServeStatus)
+	mountCardsAPI(httpMux, s.storage, s.blobStore)
+
+	if listenAddr := cfg.HTTP.ListenAddr; listenAddr != "" {
+		slog.Info("Serving HTTP endpoints", "addr", listenAddr)
+		go func() {
+			log.Panic(http.ListenAndServe(listenAddr, httpMux))
+		}()
+	} else {
+		slog.Info("Listen address is not set, HTTP endpoints are not served")
+	}
+
+	for cycleID := 1; ; cycleID++ {
+		startTime := time.Now().UTC()
+		runCycle(cycleID, s.crawler, knownIDsHeap, failedAttempts, cfg.MaxKnownCards, cfg.Workers, monitor)
+
+		endTime := time.Now().UTC()
+		elapsed := endTime.Sub(startTime)
+		metrics.CycleDuration.Observe(elapsed.Seconds())
+		if *once {
+			s.deliverPending(context.Background())
+			return
+		}
+		if elapsed > pollInterval {
+			metrics.CyclesOverrun.Inc()
+		}
+		toWait := pollInterval - elapsed
+		if toWait > 0 {
+			slog.Info("Sleeping...", "duration", toWait, logging.CycleIDKey, cycleID)
+			time.Sleep(toWait)
+		}
+	}
+}
+
+// Scans the catalog until the already known card and downloads the new ones
+func runCycle(cycleID int, crawlerInstance *crawler.Crawler, knownIDsHeap *utils.CardIDHeap, failedAttempts map[types.CardID]int, maxKnownCardsCount int, workerCount int, monitor *health.Monitor) {
+	var err error
+	monitor.CycleStarted()
+	cycleCtx, cycleSpan := tracing.Start(context.Background(), "cycle", attribute.Int(logging.CycleIDKey, cycleID))
+	cycleCtx = logging.With(cycleCtx, logging.CycleIDKey, cycleID)
+	logger := logging.Component(cycleCtx, "main")
+
+	foundKnownIdsCount := len(*knownIDsHeap)
+	logger.Info("Considering already downloaded cards", "count", foundKnownIdsCount)
+
+	if foundKnownIdsCount > maxKnownCardsCount {
+		logger.Info("Will use only latest of known cards", "count", maxKnownCardsCount, "known", foundKnownIdsCount)
+		*knownIDsHeap = (*knownIDsHeap)[:maxKnownCardsCount]
+	}
+
+	// log.Printf("Cards: %v\n", *knownIDsHeap)
+
+	var knownCardsIdSet map[types.CardID]void = make(map[types.CardID]void)
+	for _, v := range *knownIDsHeap {
+		knownCardsIdSet[v] = voidVal
+	}
+
+	// fetching catalog
+	var newDetectedCards []crawler.Card = nil
+	if len(knownCardsIdSet) == 0 {
+		// fetching only the first page
+		logger.Info("The card storage is empty. Fetching the first catalog page page...")
+		newDetectedCards, err = crawler.GetCardCatalogPage(cycleCtx, 1)
+		if err != nil {
+			logging.Panic(logger, "Failed to get catalog page", logging.PageKey, 1, logging.ErrorKey, err)
+		}
+		monitor.CatalogPageFetched()
+	} else {
+		// looking for
+		logger.Info("Fetching the catalog pages util we find the known card")
+		var pageNum int = 1
+	pagesLoop:
+		for {
+			logger.Info("Fetching catalog page...", logging.PageKey, pageNum)
+			pageNewDetectedCards, err := crawler.GetCardCatalogPage(cycleCtx, pageNum)
+			if err != nil {
+				logging.Panic(logger, "Failed to get catalog page", logging.PageKey, pageNum, logging.ErrorKey, err)
+			}
+			monitor.CatalogPageFetched()
+			logger.Info("Got cards from the catalog page", logging.PageKey, pageNum, "count", len(pageNewDetectedCards))
+
+			if newDetectedCards == nil {
+				newDetectedCards = pageNewDetectedCards
+			} else {
+				newDetectedCards = append(newDetectedCards, pageNewDetectedCards...)
+			}
+
+			// analyzing pageNewDetectedCardIDs for intersection with known IDS
+			for _, newCard := range pageNewDetectedCards {
+				if newCard.HasPaidPromotion {
+					// ignoring promoted card in look for already downloaded
+					continue
+				}
+				if _, exists := knownCardsIdSet[newCard.Id]; exists {
+					logger.Info("Found already known card", logging.PageKey, pageNum, logging.CardIDKey, newCard.Id)
+					break pagesLoop
+				}
+			}
+
+			pageNum += 1
+		}
+	}
+
+	// finding what exactly cards are new (not previously downloaded)
+	var newCardsIDs []types.CardID = make([]types.CardID, 0, len(newDetectedCards))
+	for _, newCardIdCandidate := range newDetectedCards {
+		if _, alreadyDownloaded := knownCardsIdSet[newCardIdCandidate.Id]; !alreadyDownloaded {
+			newCardsIDs = append(newCardsIDs, newCardIdCandidate.Id)
+			heap.Push(knownIDsHeap, newCardIdCandidate.Id)
+		}
+	}
+	logger.Info("New cards to download", "count", len(newCardsIDs))
+	metrics.NewCardsFound.Add(float64(len(newCardsIDs)))
+	monitor.NewCardsFound(newCardsIDs)
+
+	var cardsJobQueue chan types.CardID = make(chan types.CardID)
+	var workersWG sync.WaitGroup
+	workersWG.Add(workerCount)
+
+	// the failures are already logged and counted by the jobs
+	var failedCards []types.CardID
+	// robots.txt is unreachable for them, which is not the failure of the card itself
+	var postponedCards []types.CardID
+	var failedCardsMutex sync.Mutex
+	runWorker := func() {
+		for card := range cardsJobQueue {
+			err := crawlerInstance.DoCardJob(cycleCtx, card)
+			if err != nil {
+				var robotsUnavailableErr *utils.RobotsUnavailableError
+				failedCardsMutex.Lock()
+				if errors.As(err, &robotsUnavailableErr) {
+					postponedCards = append(postponedCards, card)
+				} else {
+					failedCards = append(failedCards, card)
+				}
+				failedCardsMutex.Unlock()
+			}
+			monitor.CardDone()
+		}
+		workersWG.Done()
+	}
+
+	for i := 0; i < workerCount; i++ {
+		go runWorker()
+	}
+
+	for _, newCardID := range newCardsIDs {
+		cardsJobQueue <- newCardID
+	}
+	close(cardsJobQueue)
+
+	workersWG.Wait()
+	failedCardsSet := make(map[types.CardID]bool, len(failedCards))
+	for _, failedCard := range failedCards {
+		failedCardsSet[failedCard] = true
+	}
+	for _, card := range newCardsIDs {
+		if !failedCardsSet[card] {
+			delete(failedAttempts, card)
+		}
+	}
+	var toRetry []types.CardID = postponedCards
+	for _, failedCard := range failedCards {
+		failedAttempts[failedCard]++
+		if failedAttempts[failedCard] >= maxCardAttempts {
+			logger.Warn("Giving up on the card, it failed too many times", logging.CardIDKey, failedCard, "attempts", failedAttempts[failedCard])
+			delete(failedAttempts, failedCard)
+			continue
+		}
+		toRetry = append(toRetry, failedCard)
+	}
+	// forgetting the cards, so they are detected as new and retried by the next cycle
+	for _, card := range toRetry {
+		for i, knownCard := range *knownIDsHeap {
+			if knownCard == card {
+				heap.Remove(knownIDsHeap, i)
+				break
+			}
+		}
+	}
+	logger.Info("All new cards are fetched", "count", len(newCardsIDs), "failed", len(failedCards), "postponed", len(postponedCards))
+	monitor.CycleFinished()
+	cycleSpan.SetAttributes(attribute.Int("new_cards", len(newCardsIDs)))
+	cycleSpan.End()
+}
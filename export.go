@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/crawler"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+)
+
+var exportCsvHeader []string = []string{
+	"uid", "card_type", "animal", "animal_sex", "event_time", "address",
+	"lat", "lon", "region", "municipality", "provenance_url", "comment",
+}
+
+// Writes the stored cards as the dataset, ordered by the card ID.
+// jsonl contains the card.json of each card on its own line, csv contains the card fields without the images
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "jsonl", "dataset format, jsonl or csv")
+	outPath := flags.String("out", "-", "output file, - for stdout")
+	configFlags := addConfigFlags(flags)
+	flags.Parse(args)
+	cfg := configFlags.load()
+
+	if *format != "jsonl" && *format != "csv" {
+		log.Fatalf("Unsupported -format %q. Expected \"jsonl\" or \"csv\"", *format)
+	}
+
+	_, cardStorage, storedCards, err := openCardStorage(cfg)
+	exitOnSetupError(err)
+	sort.Slice(storedCards, func(i, j int) bool { return storedCards[i] < storedCards[j] })
+
+	var out io.Writer = os.Stdout
+	if *outPath != "-" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *outPath, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	bufOut := bufio.NewWriter(out)
+	var csvOut *csv.Writer
+	if *format == "csv" {
+		csvOut = csv.NewWriter(bufOut)
+		csvOut.Write(exportCsvHeader)
+	}
+
+	var exported, failed int
+	for _, card := range storedCards {
+		jsonCard, err := cardStorage.LoadCardJSON(card)
+		if err != nil {
+			slog.Error("Failed to load stored card, skipping it", logging.CardIDKey, card, logging.ErrorKey, err)
+			failed++
+			continue
+		}
+		if csvOut != nil {
+			err = csvOut.Write(csvRecord(jsonCard))
+		} else {
+			var line []byte
+			line, err = json.Marshal(jsonCard)
+			if err == nil {
+				_, err = fmt.Fprintf(bufOut, "%s\n", line)
+			}
+		}
+		if err != nil {
+			log.Fatalf("Failed to write the dataset: %v", err)
+		}
+		exported++
+	}
+	if csvOut != nil {
+		csvOut.Flush()
+		if err := csvOut.Error(); err != nil {
+			log.Fatalf("Failed to write the dataset: %v", err)
+		}
+	}
+	if err := bufOut.Flush(); err != nil {
+		log.Fatalf("Failed to write the dataset: %v", err)
+	}
+	slog.Info("Exported cards", "count", exported, "failed", failed, "format", *format, "out", *outPath)
+}
+
+func csvRecord(card *crawler.CardJSON) []string {
+	formatCoord := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	var sex, address, lat, lon, region, municipality, comment string
+	if card.AnimalSexSpec != nil {
+		sex = *card.AnimalSexSpec
+	}
+	if card.Location != nil {
+		address = card.Location.Address
+		lat = formatCoord(card.Location.Lat)
+		lon = formatCoord(card.Location.Lon)
+		region = card.Location.Region
+		municipality = card.Location.Municipality
+	}
+	if card.ContactInfo != nil {
+		comment = card.ContactInfo.Comment
+	}
+	return []string{
+		card.Uid, card.EventType, card.Species, sex, card.EventTime.Format(time.RFC3339), address,
+		lat, lon, region, municipality, card.ProvenanceURL, comment,
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+// Parses the card IDs given as the command args
+func parseCardIDArgs(args []string) ([]types.CardID, error) {
+	cards := make([]types.CardID, 0, len(args))
+	for _, arg := range args {
+		parsed, err := strconv.ParseInt(arg, 10, 32)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid card ID %q", arg)
+		}
+		cards = append(cards, types.CardID(parsed))
+	}
+	return cards, nil
+}
+
+// Fetches the specified cards (the already stored ones are skipped) and delivers their notifications
+func runFetch(args []string) {
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: poiskzooCrawler fetch <card ID>...")
+		flags.PrintDefaults()
+	}
+	configFlags := addConfigFlags(flags)
+	flags.Parse(args)
+	cards, err := parseCardIDArgs(flags.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(cards) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	s, err := setupCrawler(configFlags.load())
+	exitOnSetupError(err)
+	defer s.close()
+
+	ctx := context.Background()
+	var failed int = 0
+	for _, card := range cards {
+		if err := s.crawler.DoCardJob(ctx, card); err != nil {
+			slog.Error("Failed to fetch card", logging.CardIDKey, card, logging.ErrorKey, err)
+			failed++
+		}
+	}
+	s.deliverPending(ctx)
+	slog.Info("Fetched cards", "count", len(cards)-failed, "failed", failed)
+	if failed > 0 {
+		s.close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/blobstore"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/crawler"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/storage"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+// Reads the stored image of the card, either from the card dir or from the blob store (nil if there is none)
+func readStoredImage(cardStorage *storage.DirectoryCardStorage, blobStore *blobstore.BlobStore, card types.CardID, image *crawler.EncodedImageJSON) ([]byte, error) {
+	var f io.ReadCloser
+	var err error
+	switch {
+	case image.Type == "file":
+		f, err = cardStorage.OpenCardFile(card, image.Data)
+	case image.Type == "ref" && blobStore != nil:
+		f, err = blobStore.Open(image.Sha256)
+	default:
+		return nil, fmt.Errorf("no stored %q image", image.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Hashes the images of the cards stored before the duplicate detection was enabled, so the new cards are checked against them too
+func backfillImageHashIndex(index *storage.FileImageHashIndex, cardStorage *storage.DirectoryCardStorage, blobStore *blobstore.BlobStore, storedCards []types.CardID) {
+	if index.Size() > 0 || len(storedCards) == 0 {
+		return
+	}
+	cards := append([]types.CardID{}, storedCards...)
+	sort.Slice(cards, func(i, j int) bool { return cards[i] < cards[j] })
+
+	logger := logging.Component(context.Background(), "dedup")
+	logger.Info("Image hash index is empty, hashing the images of stored cards...", "count", len(cards))
+	added := 0
+	for _, card := range cards {
+		jsonCard, err := cardStorage.LoadCardJSON(card)
+		if err != nil {
+			logger.Warn("Skipping the card in the image hash index", logging.CardIDKey, card, logging.ErrorKey, err)
+			continue
+		}
+		for i := range jsonCard.Images {
+			data, err := readStoredImage(cardStorage, blobStore, card, &jsonCard.Images[i])
+			if err != nil {
+				logger.Warn("Skipping the image in the image hash index", logging.CardIDKey, card, logging.ErrorKey, err)
+				continue
+			}
+			hash, err := imaging.HashImage(data)
+			if err != nil {
+				logger.Warn("Skipping the image in the image hash index", logging.CardIDKey, card, logging.ErrorKey, err)
+				continue
+			}
+			if hash.IsUninformative() {
+				continue
+			}
+			err = index.Add(card, hash)
+			if err != nil {
+				logging.Panic(logger, "Failed to add the card to the image hash index", logging.CardIDKey, card, logging.ErrorKey, err)
+			}
+			added++
+		}
+	}
+	logger.Info("Added stored card images to the image hash index", "count", added)
+}
@@ -1,221 +1,125 @@
 package main
 
 import (
-	"container/heap"
-	"errors"
-	"io/fs"
+	"flag"
+	"fmt"
+	"io"
 	"log"
-	"net/url"
+	"log/slog"
 	"os"
-	"strconv"
-	"sync"
-	"time"
-
-	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/crawler"
-	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/storage"
-	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
-	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+	"strings"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/config"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/version"
 )
 
-// main loop
-// 1. take latest set of "known card ids"
-// 2. crawl latest cards until we intersect with "latest known"
-// 3. push jobs for downloading corresponding images
-// 4. update "latest known card ids"
-// 5. notify pipeline
-
-const CARDS_DIR_ENVVAR = "CARDS_DIR"
-const PIPELINE_NOTIFICATION_URL = "PIPELINE_URL"
-const NUM_CONCURRENT_WORKERS = "NUM_CONCURRENT_WORKERS"
-const MAX_KNOWN_CARDS_TO_TRACK_COUNT = "MAX_KNOWN_CARDS_TO_TRACK_COUNT"
-
 type void struct{}
 
 var voidVal void
 
-const defaultPollInterval time.Duration = 5 * 60 * 1e9
+const usage = `Usage: poiskzooCrawler [command] [flags] [args]
+
+Commands:
+  crawl [-once]                 crawl the new cards every poll interval (default), or once
+  fetch <card ID>...            fetch the specified cards
+  reparse [-dry-run] [card ID]  rebuild card.json of the stored cards from their stored pages
+  export [-format jsonl|csv] [-out file]
+                                write the stored cards as the dataset
+  serve [-addr addr]            serve the stored cards over HTTP
+  replay [-from] [-to] [-all]   reschedule the delivery of the pipeline notifications
+  config print                  print the effective configuration along with the source of each value
+
+Each command accepts -config <YAML file> (default $CONFIG_FILE) and -set key=value flags.
+The settings of the file are overridden by the env vars, which are overridden by -set.
+Run "<command> -h" for the command flags
+`
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, usage)
+}
 
-// Returns the value of specified env var, if it is not set, returns default
-func ExtractEnvOrDefaultString(envVar string, defaultVal string) string {
-	v, ok := os.LookupEnv(envVar)
-	if !ok {
-		log.Printf("%s env var is not set, using default value \"%v\"\n", envVar, defaultVal)
-		return defaultVal
-	}
-	log.Printf("%s env var is set to %s\n", envVar, v)
-	return v
+// repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// The config flags shared by the commands
+type configFlags struct {
+	path      string
+	overrides stringList
+}
+
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	f := &configFlags{}
+	flags.StringVar(&f.path, "config", "", "YAML config file (default $"+config.CONFIG_FILE_ENVVAR+")")
+	flags.Var(&f.overrides, "set", "override of the config setting as key=value, e.g. http.timeout_sec=60. Repeatable")
+	return f
 }
 
-// Returns the value of specified env var, if it is not set, returns default
-func ExtractEnvOrDefaultInt(envVar string, defaultVal int) int {
-	v, ok := os.LookupEnv(envVar)
-	if !ok {
-		log.Printf("%s env var is not set, using default value \"%v\"\n", envVar, defaultVal)
-		return defaultVal
+// Loads the config without validating it. Exits on the parse errors
+func (f *configFlags) loadUnvalidated() *config.Config {
+	if f.path == "" {
+		f.path = os.Getenv(config.CONFIG_FILE_ENVVAR)
 	}
-	log.Printf("%s env var is set to %s\n", envVar, v)
-	parsed, err := strconv.ParseInt(v, 0, 64)
+	cfg, err := config.Load(f.path, os.LookupEnv, f.overrides)
 	if err != nil {
-		log.Panicf("Can't parse %s (env var %s) as int", v, envVar)
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
 	}
-	return int(parsed)
+	return cfg
 }
 
-func main() {
-	log.SetFlags(log.LUTC | log.Ltime)
-
-	log.Printf("Starting up...\tVersion: %s\tGit commit: %.6s\n", version.AppVersion, version.GitCommit)
-
-	cardsDir := ExtractEnvOrDefaultString(CARDS_DIR_ENVVAR, "./db")
-	workerCount := ExtractEnvOrDefaultInt(NUM_CONCURRENT_WORKERS, 5)
-	maxKnownCardsCount := ExtractEnvOrDefaultInt(MAX_KNOWN_CARDS_TO_TRACK_COUNT, 256)
-
-	pipelineNotificationUrlStr, ok := os.LookupEnv(PIPELINE_NOTIFICATION_URL)
-	var pipelineNotificationUrl *url.URL = nil
-	var err error
-	if !ok {
-		log.Printf("%s env var is not set, will not do pipeline notification\n", PIPELINE_NOTIFICATION_URL)
-	} else {
-		log.Printf("%s env var is set to %s, using it to notify pipeline\n", PIPELINE_NOTIFICATION_URL, pipelineNotificationUrlStr)
-		pipelineNotificationUrl, err = url.Parse(pipelineNotificationUrlStr)
-		if err != nil {
-			log.Panicf("Failed to parse pipeline notification URL: %v", err)
-		}
+// Loads and validates the config, then sets up the logging. Exits if the config is invalid
+func (f *configFlags) load() *config.Config {
+	cfg := f.loadUnvalidated()
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
 	}
-
-	// reading card dirs
-
-	cardDirContent, err := os.ReadDir(cardsDir)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			log.Printf("Creating non existing dir %s", cardsDir)
-			err = os.Mkdir(cardsDir, os.FileMode(0644))
-			if err != nil {
-				log.Panic(err)
-			}
-			cardDirContent = make([]fs.DirEntry, 0)
-		} else {
-			log.Panic(err)
-		}
+	if err := logging.Setup(cfg.Log.Format, cfg.Log.Level); err != nil {
+		log.Panic(err)
 	}
+	slog.Info("Configuration is loaded", "version", version.AppVersion, "git_commit", version.GitCommit, "file", f.path)
+	return cfg
+}
 
-	var knownIDsHeap *utils.CardIDHeap = &utils.CardIDHeap{}
-	for _, cardDirEntry := range cardDirContent {
-		parsedID, parsedOk := strconv.ParseInt(cardDirEntry.Name(), 10, 32)
-		if !cardDirEntry.IsDir() || parsedOk != nil {
-			continue
-		}
-		heap.Push(knownIDsHeap, types.CardID(parsedID))
+func main() {
+	// no command runs the crawler, as the container does
+	command := "crawl"
+	args := os.Args[1:]
+	if len(args) > 0 && (len(args[0]) == 0 || args[0][0] != '-') {
+		command = args[0]
+		args = args[1:]
 	}
 
-	foundKnownIdsCount := len(*knownIDsHeap)
-	log.Printf("Found %d stored cards\n", foundKnownIdsCount)
-
-	var localCardStorage crawler.LocalCardStorage = storage.NewDirectoryCardStorage(cardsDir)
-	var crawlerInstance *crawler.Crawler = crawler.NewCrawler(&localCardStorage, pipelineNotificationUrl)
-
-	for {
-		startTime := time.Now().UTC()
-
-		foundKnownIdsCount := len(*knownIDsHeap)
-		log.Printf("Considering %d already downloaded cards\n", foundKnownIdsCount)
-
-		if foundKnownIdsCount > maxKnownCardsCount {
-			log.Printf("Will use only latest %d of known cards out of %d", maxKnownCardsCount, foundKnownIdsCount)
-			*knownIDsHeap = (*knownIDsHeap)[:maxKnownCardsCount]
-		}
-
-		// log.Printf("Cards: %v\n", *knownIDsHeap)
-
-		var knownCardsIdSet map[types.CardID]void = make(map[types.CardID]void)
-		for _, v := range *knownIDsHeap {
-			knownCardsIdSet[v] = voidVal
-		}
-
-		// fetching catalog
-		var newDetectedCards []crawler.Card = nil
-		if len(knownCardsIdSet) == 0 {
-			// fetching only the first page
-			log.Println("The card storage is empty. Fetching the first catalog page page...")
-			newDetectedCards, err = crawler.GetCardCatalogPage(1)
-			if err != nil {
-				log.Panicf("Failed to get catalog page: %v\n", err)
-			}
-		} else {
-			// looking for
-			log.Println("Fetching the catalog pages util we find the known card")
-			var pageNum int = 1
-		pagesLoop:
-			for {
-				log.Printf("Fetching catalog page %d...\n", pageNum)
-				pageNewDetectedCards, err := crawler.GetCardCatalogPage(pageNum)
-				if err != nil {
-					log.Panicf("Failed to get catalog page: %v\n", err)
-				}
-				log.Printf("Got %d cards for page %d of the catalog\n", len(pageNewDetectedCards), pageNum)
-
-				if newDetectedCards == nil {
-					newDetectedCards = pageNewDetectedCards
-				} else {
-					newDetectedCards = append(newDetectedCards, pageNewDetectedCards...)
-				}
-
-				// analyzing pageNewDetectedCardIDs for intersection with known IDS
-				for _, newCard := range pageNewDetectedCards {
-					if newCard.HasPaidPromotion {
-						// ignoring promoted card in look for already downloaded
-						continue
-					}
-					if _, exists := knownCardsIdSet[newCard.Id]; exists {
-						log.Printf("Found already known card %d at page %d\n", newCard.Id, pageNum)
-						break pagesLoop
-					}
-				}
-
-				pageNum += 1
-			}
-		}
-
-		// finding what exactly cards are new (not previously downloaded)
-		var newCardsIDs []types.CardID = make([]types.CardID, 0, len(newDetectedCards))
-		for _, newCardIdCandidate := range newDetectedCards {
-			if _, alreadyDownloaded := knownCardsIdSet[newCardIdCandidate.Id]; !alreadyDownloaded {
-				newCardsIDs = append(newCardsIDs, newCardIdCandidate.Id)
-				heap.Push(knownIDsHeap, newCardIdCandidate.Id)
-			}
-		}
-		log.Printf("%d new cards to download\n", len(newCardsIDs))
-
-		var cardsJobQueue chan types.CardID = make(chan types.CardID)
-		var workersWG sync.WaitGroup
-		workersWG.Add(workerCount)
-
-		runWorker := func() {
-			for card := range cardsJobQueue {
-				crawlerInstance.DoCardJob(card)
-			}
-			workersWG.Done()
-		}
-
-		for i := 0; i < workerCount; i++ {
-			go runWorker()
-		}
-
-		for _, newCardID := range newCardsIDs {
-			cardsJobQueue <- newCardID
-		}
-		close(cardsJobQueue)
-
-		workersWG.Wait()
-		log.Printf("All %d new cards are fetched\n", len(newCardsIDs))
-
-		endTime := time.Now().UTC()
-		elapsed := endTime.Sub(startTime)
-		toWait := defaultPollInterval - elapsed
-		if toWait > 0 {
-			log.Printf("Sleeping for %v...", toWait)
-			time.Sleep(toWait)
-		}
+	switch command {
+	case "crawl":
+		runCrawl(args)
+	case "fetch":
+		runFetch(args)
+	case "reparse":
+		runReparse(args)
+	case "export":
+		runExport(args)
+	case "serve":
+		runServe(args)
+	case "replay":
+		runReplay(args)
+	case "config":
+		runConfig(args)
+	case "help":
+		printUsage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		printUsage(os.Stderr)
+		os.Exit(2)
 	}
 }
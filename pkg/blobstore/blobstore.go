@@ -0,0 +1,140 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+)
+
+// Content-addressed store of binary blobs (e.g. card images).
+// Each blob is stored once under its SHA-256 hex digest:
+//
+//	<dir>/<first 2 hex chars>/<full hex digest>
+//
+// <dir>/tmp holds the files being downloaded, so they are put into the store without copying
+type BlobStore struct {
+	dir string
+}
+
+var digestRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Opens (creating if needed) the blob store in the specified directory
+func NewDirectoryBlobStore(dir string) (*BlobStore, error) {
+	err := os.MkdirAll(path.Join(dir, tempDirName), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobStore{dir: dir}, nil
+}
+
+const tempDirName = "tmp"
+
+// The dir to download the files to be put into the store with PutFile. It is on the same file system as the blobs
+func (b *BlobStore) TempDir() string {
+	return path.Join(b.dir, tempDirName)
+}
+
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *BlobStore) blobPath(digest string) string {
+	return path.Join(b.dir, digest[:2], digest)
+}
+
+// Stores the blob, returns its SHA-256 hex digest. Storing the same content again is a no-op
+func (b *BlobStore) Put(data []byte) (string, error) {
+	digest := Digest(data)
+	blobPath := b.blobPath(digest)
+	if _, err := os.Stat(blobPath); err == nil {
+		return digest, nil
+	}
+	err := os.MkdirAll(path.Dir(blobPath), 0755)
+	if err != nil {
+		return "", err
+	}
+	// writing via temp file, so the partially written blob is never visible under its digest
+	tmp, err := os.CreateTemp(path.Dir(blobPath), digest+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	err = os.Rename(tmp.Name(), blobPath)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return digest, nil
+}
+
+// Stores the content of the file under the digest, which is not verified: it must be the SHA-256 hex digest
+// computed while the file was written. The file is hard linked into the store if possible, it is left in place.
+// Storing the same content again is a no-op
+func (b *BlobStore) PutFile(filePath string, digest string) error {
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("invalid blob digest %q", digest)
+	}
+	blobPath := b.blobPath(digest)
+	if _, err := os.Stat(blobPath); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(path.Dir(blobPath), 0755)
+	if err != nil {
+		return err
+	}
+	return utils.LinkOrCopyFile(filePath, blobPath)
+}
+
+// Opens the blob for reading. Returns fs.ErrNotExist if there is no such blob
+func (b *BlobStore) Open(digest string) (*os.File, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, fmt.Errorf("invalid blob digest %q: %w", digest, fs.ErrNotExist)
+	}
+	return os.Open(b.blobPath(digest))
+}
+
+// Serves GET /<sha256 hex digest>. To be mounted with http.StripPrefix
+func (b *BlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	digest := r.URL.Path
+	f, err := b.Open(digest)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "failed to open blob", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to open blob", http.StatusInternalServerError)
+		return
+	}
+
+	// the content never changes for the digest
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", digest))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
@@ -0,0 +1,107 @@
+package blobstore
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPutIsContentAddressed(t *testing.T) {
+	store, err := NewDirectoryBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := store.Put([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("unexpected digest %s", digest)
+	}
+	again, err := store.Put([]byte("hello"))
+	if err != nil || again != digest {
+		t.Errorf("storing the same content must return the same digest, got %s (%v)", again, err)
+	}
+
+	f, err := store.Open(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, _ := io.ReadAll(f)
+	if string(content) != "hello" {
+		t.Errorf("unexpected content %q", content)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	store, err := NewDirectoryBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := store.Put([]byte("\x89PNG\r\n\x1a\nrest"))
+
+	server := httptest.NewServer(http.StripPrefix("/blobs/", store))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/blobs/" + digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "\x89PNG\r\n\x1a\nrest" {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("expected sniffed content type image/png, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	for _, p := range []string{"/blobs/" + digest[:63] + "0", "/blobs/../../etc/passwd", "/blobs/"} {
+		resp, err = http.Get(server.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", p, resp.StatusCode)
+		}
+	}
+}
+
+func TestPutFileLinksDownloadedFile(t *testing.T) {
+	store, err := NewDirectoryBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := path.Join(store.TempDir(), "download")
+	if err := os.WriteFile(filePath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest := Digest([]byte("hello"))
+	if err := store.PutFile(filePath, digest); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutFile(filePath, digest); err != nil {
+		t.Errorf("storing the same content again must be a no-op, got %v", err)
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("the file must be left in place: %v", err)
+	}
+	f, err := store.Open(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, _ := io.ReadAll(f)
+	if string(content) != "hello" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if err := store.PutFile(filePath, "../../etc/passwd"); err == nil {
+		t.Error("invalid digest must be rejected")
+	}
+}
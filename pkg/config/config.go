@@ -0,0 +1,354 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The settings of the crawler. Each setting can be set in the YAML config file (by its yaml key),
+// overridden by its env var and then by the -set key=value flag
+type Config struct {
+	// the directory the cards are stored in
+	CardsDir string `yaml:"cards_dir" env:"CARDS_DIR"`
+	// how often the catalog is scanned for the new cards
+	PollInterval time.Duration `yaml:"poll_interval" env:"POLL_INTERVAL"`
+	// number of the cards downloaded concurrently
+	Workers int `yaml:"workers" env:"NUM_CONCURRENT_WORKERS"`
+	// number of the latest stored cards the catalog scan looks for
+	MaxKnownCards int `yaml:"max_known_cards" env:"MAX_KNOWN_CARDS_TO_TRACK_COUNT"`
+	// the crawler is not live if no cycle finished within that many poll intervals
+	LivenessStalenessFactor int `yaml:"liveness_staleness_factor" env:"LIVENESS_STALENESS_FACTOR"`
+	// empty means image-hashes.txt in the cards dir
+	ImageHashIndex string `yaml:"image_hash_index" env:"IMAGE_HASH_INDEX"`
+	// empty means text-fingerprints.jsonl in the cards dir
+	RepostIndex          string `yaml:"repost_index" env:"REPOST_INDEX"`
+	SuppressExactReposts bool   `yaml:"suppress_exact_reposts" env:"SUPPRESS_EXACT_REPOSTS"`
+
+	Log       LogConfig       `yaml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	HTTP      HTTPConfig      `yaml:"http"`
+	Notifier  NotifierConfig  `yaml:"notifier"`
+	Images    ImagesConfig    `yaml:"images"`
+	Geocoding GeocodingConfig `yaml:"geocoding"`
+
+	// where each setting comes from, by its key
+	sources map[string]Source
+	// the env the config is loaded from, e.g. for the secrets the webhooks config refers to
+	lookupEnv func(string) (string, bool)
+}
+
+type LogConfig struct {
+	// "json" or "text"
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	// "debug", "info", "warn" or "error"
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+}
+
+type TracingConfig struct {
+	// "none", "otlp" or "stdout"
+	Exporter string `yaml:"exporter" env:"TRACING_EXPORTER"`
+}
+
+type HTTPConfig struct {
+	// the address the metrics, health and cards endpoints are served at. Empty means they are not served by "crawl"
+	ListenAddr     string `yaml:"listen_addr" env:"HTTP_LISTEN_ADDR"`
+	TimeoutSec     int    `yaml:"timeout_sec" env:"HTTP_TIMEOUT_SEC"`
+	MaxAttempts    int    `yaml:"max_attempts" env:"HTTP_MAX_ATTEMPTS"`
+	HostLimits     string `yaml:"host_limits" env:"HTTP_HOST_LIMITS"`
+	BodyLimitsMB   string `yaml:"body_limits_mb" env:"HTTP_BODY_LIMITS_MB"`
+	RobotsTxtHosts string `yaml:"robots_txt_hosts" env:"ROBOTS_TXT_HOSTS"`
+	IgnoreRobots   bool   `yaml:"ignore_robots_txt" env:"IGNORE_ROBOTS_TXT"`
+	// empty means the responses are not cached
+	CacheDir   string `yaml:"cache_dir" env:"HTTP_CACHE_DIR"`
+	CacheMaxMB int    `yaml:"cache_max_mb" env:"HTTP_CACHE_MAX_MB"`
+	CacheOnly  bool   `yaml:"cache_only" env:"HTTP_CACHE_ONLY"`
+	// comma separated proxy URLs. Empty means the requests go directly
+	Proxies               string `yaml:"proxies" env:"HTTP_PROXIES" secret:"true"`
+	ProxyRoutes           string `yaml:"proxy_routes" env:"HTTP_PROXY_ROUTES"`
+	ProxyCheckURL         string `yaml:"proxy_check_url" env:"HTTP_PROXY_CHECK_URL"`
+	ProxyCheckIntervalSec int    `yaml:"proxy_check_interval_sec" env:"HTTP_PROXY_CHECK_INTERVAL_SEC"`
+	// empty means the exchanges do not go through the fixtures
+	FixturesDir  string `yaml:"fixtures_dir" env:"HTTP_FIXTURES_DIR"`
+	FixturesMode string `yaml:"fixtures_mode" env:"HTTP_FIXTURES_MODE"`
+}
+
+type NotifierConfig struct {
+	// "http", "webhooks" or "kafka"
+	Kind string `yaml:"kind" env:"NOTIFIER"`
+	// empty means the pipeline is not notified by the "http" notifier
+	PipelineURL      string `yaml:"pipeline_url" env:"PIPELINE_URL"`
+	CloudEventsMode  string `yaml:"cloudevents_mode" env:"CLOUDEVENTS_MODE"`
+	WebhookSecret    string `yaml:"webhook_secret" env:"WEBHOOK_SECRET" secret:"true"`
+	WebhooksConfig   string `yaml:"webhooks_config" env:"WEBHOOKS_CONFIG"`
+	KafkaBrokers     string `yaml:"kafka_brokers" env:"KAFKA_BROKERS"`
+	KafkaTopic       string `yaml:"kafka_topic" env:"KAFKA_TOPIC"`
+	KafkaCompression string `yaml:"kafka_compression" env:"KAFKA_COMPRESSION"`
+	OutboxDir        string `yaml:"outbox_dir" env:"OUTBOX_DIR"`
+	// how long the delivered notifications are kept for replays, 0 means forever
+	OutboxRetention time.Duration `yaml:"outbox_retention" env:"OUTBOX_RETENTION"`
+}
+
+type ImagesConfig struct {
+	// "inline" or "reference"
+	Mode         string `yaml:"mode" env:"IMAGE_MODE"`
+	BlobsDir     string `yaml:"blobs_dir" env:"BLOBS_DIR"`
+	BlobsBaseURL string `yaml:"blobs_base_url" env:"BLOBS_BASE_URL"`
+}
+
+type GeocodingConfig struct {
+	// min interval between the requests to Nominatim
+	NominatimInterval time.Duration `yaml:"nominatim_interval" env:"NOMINATIM_INTERVAL"`
+	// capacity of each of the forward and reverse lookup caches
+	CacheSize int `yaml:"cache_size" env:"GEOCODER_CACHE_SIZE"`
+}
+
+// Where the value of the setting comes from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// The env var pointing to the config file, if the -config flag is not given
+const CONFIG_FILE_ENVVAR = "CONFIG_FILE"
+
+func Default() *Config {
+	return &Config{
+		CardsDir:                "./db",
+		PollInterval:            5 * time.Minute,
+		Workers:                 5,
+		MaxKnownCards:           256,
+		LivenessStalenessFactor: 3,
+		Log: LogConfig{
+			Format: "json",
+			Level:  "info",
+		},
+		Tracing: TracingConfig{
+			Exporter: "none",
+		},
+		HTTP: HTTPConfig{
+			TimeoutSec:            30,
+			MaxAttempts:           3,
+			HostLimits:            "poiskzoo.ru=1:2,*=2:2",
+			RobotsTxtHosts:        "poiskzoo.ru",
+			CacheMaxMB:            1024,
+			ProxyRoutes:           "poiskzoo.ru=proxy,*=direct",
+			ProxyCheckURL:         "https://poiskzoo.ru/robots.txt",
+			ProxyCheckIntervalSec: 300,
+			FixturesMode:          "record",
+		},
+		Notifier: NotifierConfig{
+			Kind:             "http",
+			CloudEventsMode:  "none",
+			WebhooksConfig:   "./webhooks.json",
+			KafkaBrokers:     "localhost:9092",
+			KafkaTopic:       "poiskzoo-cards",
+			KafkaCompression: "zstd",
+			OutboxDir:        "./outbox",
+			OutboxRetention:  30 * 24 * time.Hour,
+		},
+		Images: ImagesConfig{
+			Mode:         "inline",
+			BlobsDir:     "./blobs",
+			BlobsBaseURL: "http://localhost:8080/blobs/",
+		},
+		Geocoding: GeocodingConfig{
+			NominatimInterval: time.Second,
+			CacheSize:         128,
+		},
+		sources:   make(map[string]Source),
+		lookupEnv: os.LookupEnv,
+	}
+}
+
+// Loads the config: the defaults, overridden by the file at path (if not empty), by the env vars
+// and by the "key=value" overrides (e.g. "http.timeout_sec=60"). The result is not validated
+func Load(path string, lookupEnv func(string) (string, bool), overrides []string) (*Config, error) {
+	c := Default()
+	c.lookupEnv = lookupEnv
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		str, ok := lookupEnv(s.env)
+		if !ok {
+			continue
+		}
+		if err := parseInto(c.field(s), str); err != nil {
+			errs = append(errs, fmt.Errorf("env var %s: %w", s.env, err))
+			continue
+		}
+		c.sources[s.key] = SourceEnv
+	}
+	for _, override := range overrides {
+		key, str, found := strings.Cut(override, "=")
+		s, known := settingsByKey[strings.TrimSpace(key)]
+		if !found || !known {
+			errs = append(errs, fmt.Errorf("flag -set %q: expected key=value with one of the config keys", override))
+			continue
+		}
+		if err := parseInto(c.field(s), str); err != nil {
+			errs = append(errs, fmt.Errorf("flag -set %s: %w", s.key, err))
+			continue
+		}
+		c.sources[s.key] = SourceFlag
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	// an empty file (e.g. everything commented out) leaves the defaults
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	// the keys present in the file
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if len(doc.Content) > 0 {
+		markFileKeys(doc.Content[0], "", c.sources)
+	}
+	return nil
+}
+
+func markFileKeys(node *yaml.Node, prefix string, sources map[string]Source) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := prefix + node.Content[i].Value
+		if _, ok := settingsByKey[key]; ok {
+			sources[key] = SourceFile
+		} else {
+			markFileKeys(node.Content[i+1], key+".", sources)
+		}
+	}
+}
+
+// Where the value of the setting comes from
+func (c *Config) Source(key string) Source {
+	if source, ok := c.sources[key]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// e.g. "default" or "env HTTP_TIMEOUT_SEC"
+func (c *Config) describeSource(s setting) string {
+	source := c.Source(s.key)
+	if source == SourceEnv {
+		return fmt.Sprintf("%s %s", source, s.env)
+	}
+	return string(source)
+}
+
+// A leaf setting of Config
+type setting struct {
+	// dot separated yaml path, e.g. "http.timeout_sec"
+	key    string
+	env    string
+	secret bool
+	index  []int
+}
+
+var settings []setting = collectSettings(reflect.TypeOf(Config{}), "", nil)
+var settingsByKey map[string]setting = indexSettings(settings)
+
+func collectSettings(t reflect.Type, prefix string, index []int) []setting {
+	var res []setting
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		yamlKey := f.Tag.Get("yaml")
+		if yamlKey == "" {
+			continue
+		}
+		fieldIndex := append(append([]int(nil), index...), i)
+		if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Duration(0)) {
+			res = append(res, collectSettings(f.Type, prefix+yamlKey+".", fieldIndex)...)
+			continue
+		}
+		res = append(res, setting{
+			key:    prefix + yamlKey,
+			env:    f.Tag.Get("env"),
+			secret: f.Tag.Get("secret") == "true",
+			index:  fieldIndex,
+		})
+	}
+	return res
+}
+
+func indexSettings(settings []setting) map[string]setting {
+	res := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		res[s.key] = s
+	}
+	return res
+}
+
+func (c *Config) field(s setting) reflect.Value {
+	return reflect.ValueOf(c).Elem().FieldByIndex(s.index)
+}
+
+// Parses the value the way the env vars are parsed: ints in any base, bools as strconv.ParseBool, durations as "90s" or "5m"
+func parseInto(v reflect.Value, str string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(str)
+	case time.Duration:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("can't parse %q as duration, e.g. \"90s\" or \"5m\"", str)
+		}
+		v.SetInt(int64(d))
+	case int:
+		parsed, err := strconv.ParseInt(str, 0, 64)
+		if err != nil {
+			return fmt.Errorf("can't parse %q as integer", str)
+		}
+		v.SetInt(parsed)
+	case bool:
+		parsed, err := strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("can't parse %q as bool", str)
+		}
+		v.SetBool(parsed)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+func formatValue(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "<redacted>"
+
+// Writes the effective config as YAML, each value commented with its source and env var.
+// The secrets are redacted, otherwise the output is a valid config file
+func (c *Config) Print(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range settings {
+		parent := root
+		path := strings.Split(s.key, ".")
+		for _, section := range path[:len(path)-1] {
+			parent = childMapping(parent, section)
+		}
+		value := formatValue(c.field(s))
+		if s.secret && value != "" {
+			value = redacted
+		}
+		source := c.describeSource(s)
+		if c.Source(s.key) != SourceEnv && s.env != "" {
+			source = fmt.Sprintf("%s; env var %s", source, s.env)
+		}
+		parent.Content = append(parent.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: path[len(path)-1]},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value, Style: scalarStyle(c.field(s)), LineComment: source},
+		)
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func childMapping(parent *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			return parent.Content[i+1]
+		}
+	}
+	child := &yaml.Node{Kind: yaml.MappingNode}
+	parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+	return child
+}
+
+// strings are quoted, so that e.g. "" or "none" are read back as strings
+func scalarStyle(v reflect.Value) yaml.Style {
+	if v.Kind() == reflect.String {
+		return yaml.DoubleQuotedStyle
+	}
+	return 0
+}
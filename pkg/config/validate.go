@@ -0,0 +1,141 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/httpfixture"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/notification"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+)
+
+// Checks all of the settings, returning the problems joined, one per line
+func (c *Config) Validate() error {
+	v := &validator{c: c}
+
+	v.check(c.CardsDir != "", "cards_dir", "must not be empty")
+	v.check(c.PollInterval > 0, "poll_interval", "must be positive")
+	v.check(c.Workers >= 1, "workers", "must be at least 1")
+	v.check(c.MaxKnownCards >= 1, "max_known_cards", "must be at least 1")
+	v.check(c.LivenessStalenessFactor >= 1, "liveness_staleness_factor", "must be at least 1")
+
+	level, err := logging.ParseLevel(c.Log.Level)
+	v.checkErr(err, "log.level")
+	_, err = logging.NewHandler(io.Discard, c.Log.Format, level)
+	v.checkErr(err, "log.format")
+	switch strings.ToLower(c.Tracing.Exporter) {
+	case "", "none", "otlp", "stdout":
+	default:
+		v.fail("tracing.exporter", `expected "none", "otlp" or "stdout"`)
+	}
+
+	v.check(c.HTTP.TimeoutSec > 0, "http.timeout_sec", "must be positive")
+	v.check(c.HTTP.MaxAttempts >= 1, "http.max_attempts", "must be at least 1")
+	_, err = utils.ParseHostLimits(c.HTTP.HostLimits)
+	v.checkErr(err, "http.host_limits")
+	_, err = utils.ParseBodyLimits(c.HTTP.BodyLimitsMB)
+	v.checkErr(err, "http.body_limits_mb")
+	v.check(c.HTTP.CacheMaxMB >= 0, "http.cache_max_mb", "must not be negative")
+	v.check(c.HTTP.CacheDir != "" || !c.HTTP.CacheOnly, "http.cache_only", "requires http.cache_dir")
+	if c.HTTP.Proxies != "" {
+		_, err = utils.NewProxyRouter(strings.Split(c.HTTP.Proxies, ","))
+		v.checkErr(err, "http.proxies")
+		_, err = utils.ParseProxyRoutes(c.HTTP.ProxyRoutes)
+		v.checkErr(err, "http.proxy_routes")
+		v.checkURL("http.proxy_check_url", c.HTTP.ProxyCheckURL)
+		v.check(c.HTTP.ProxyCheckIntervalSec > 0, "http.proxy_check_interval_sec", "must be positive")
+	}
+	switch c.HTTP.FixturesMode {
+	case httpfixture.ModeReplay, httpfixture.ModeRecord, httpfixture.ModeLive:
+	default:
+		v.fail("http.fixtures_mode", fmt.Sprintf("expected %q, %q or %q", httpfixture.ModeReplay, httpfixture.ModeRecord, httpfixture.ModeLive))
+	}
+
+	switch c.Notifier.Kind {
+	case "http":
+		if c.Notifier.PipelineURL != "" {
+			v.checkURL("notifier.pipeline_url", c.Notifier.PipelineURL)
+		}
+		_, err = notification.ParseCloudEventsMode(c.Notifier.CloudEventsMode)
+		v.checkErr(err, "notifier.cloudevents_mode")
+	case "webhooks":
+		if c.Notifier.WebhooksConfig == "" {
+			v.fail("notifier.webhooks_config", "must not be empty for the webhooks notifier")
+		} else if configJSON, err := os.ReadFile(c.Notifier.WebhooksConfig); err != nil {
+			v.fail("notifier.webhooks_config", err.Error())
+		} else {
+			// the schema version is not validated, so it does not matter here
+			_, err = notification.ParseWebhookTargets(configJSON, "", c.lookupEnv)
+			v.checkErr(err, "notifier.webhooks_config")
+		}
+	case "kafka":
+		v.check(strings.Trim(c.Notifier.KafkaBrokers, ", ") != "", "notifier.kafka_brokers", "must not be empty for the kafka notifier")
+		v.check(c.Notifier.KafkaTopic != "", "notifier.kafka_topic", "must not be empty for the kafka notifier")
+		_, err = notification.ParseKafkaCompression(c.Notifier.KafkaCompression)
+		v.checkErr(err, "notifier.kafka_compression")
+	default:
+		v.fail("notifier.kind", `expected "http", "webhooks" or "kafka"`)
+	}
+	v.check(c.Notifier.OutboxDir != "", "notifier.outbox_dir", "must not be empty")
+	v.check(c.Notifier.OutboxRetention >= 0, "notifier.outbox_retention", "must not be negative")
+
+	switch c.Images.Mode {
+	case "inline":
+	case "reference":
+		v.check(c.Images.BlobsDir != "", "images.blobs_dir", "must not be empty for the reference mode")
+		v.checkURL("images.blobs_base_url", c.Images.BlobsBaseURL)
+	default:
+		v.fail("images.mode", `expected "inline" or "reference"`)
+	}
+
+	// usage policy of the public OpenStreetMap instance: an absolute maximum of 1 request per second
+	v.check(c.Geocoding.NominatimInterval >= time.Second, "geocoding.nominatim_interval", "must be at least 1s, as required by the Nominatim usage policy")
+	v.check(c.Geocoding.CacheSize >= 1, "geocoding.cache_size", "must be at least 1")
+
+	return errors.Join(v.errs...)
+}
+
+type validator struct {
+	c    *Config
+	errs []error
+}
+
+// Records the problem with the setting, telling its value and where it comes from
+func (v *validator) fail(key string, problem string) {
+	s := settingsByKey[key]
+	value := formatValue(v.c.field(s))
+	if s.secret {
+		value = redacted
+	}
+	if v.c.field(s).Kind() == reflect.String {
+		value = strconv.Quote(value)
+	}
+	v.errs = append(v.errs, fmt.Errorf("%s = %s (%s): %s", key, value, v.c.describeSource(s), problem))
+}
+
+func (v *validator) check(ok bool, key string, problem string) {
+	if !ok {
+		v.fail(key, problem)
+	}
+}
+
+func (v *validator) checkErr(err error, key string) {
+	if err != nil {
+		v.fail(key, err.Error())
+	}
+}
+
+func (v *validator) checkURL(key string, rawUrl string) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		v.fail(key, "must be an absolute URL")
+	}
+}
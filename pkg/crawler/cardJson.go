@@ -4,19 +4,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/blobstore"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/geocoding"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
 )
 
+// Version of the CardJSON format. Is to be changed on any change of the serialized form,
+// along with adding the corresponding schema to the schema dir
+const CardJSONSchemaVersion = "1.5"
+
 type LocationJSON struct {
 	Address    string   `json:"Address"`
 	Lat        *float64 `json:"Lat,omitempty"`
 	Lon        *float64 `json:"Lon,omitempty"`
 	Provenance string   `json:"CoordsProvenance"`
+	// the fields below are filled by reverse geocoding of Lat/Lon
+	Region       string `json:"Region,omitempty"`
+	Municipality string `json:"Municipality,omitempty"`
+	District     string `json:"District,omitempty"`
+	Postcode     string `json:"Postcode,omitempty"`
 }
 
 type ContactInfoJSON struct {
@@ -28,12 +40,37 @@ type ContactInfoJSON struct {
 }
 
 type EncodedImageJSON struct {
+	// "jpg", "png" - the image is embedded in Data.
+	// "file" - Data is the file name in the local storage.
+	// "ref" - the image is stored in the blob store, see the reference fields below
 	Type string `json:"type"`
 	// base64 encoded byte[]
-	Data string `json:"data"`
+	Data string `json:"data,omitempty"`
+
+	// the fields below are set only for "ref" type
+
+	// "jpg" or "png"
+	Format string `json:"format,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// hex encoded SHA-256 of the image content
+	Sha256 string `json:"sha256,omitempty"`
+	Size   int    `json:"size,omitempty"`
+
+	// dimensions of the image in pixels
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// fixed-size JPEG thumbnail of the image, of the same kind (embedded, file, ref) as the image itself
+	Thumbnail *EncodedImageJSON `json:"thumbnail,omitempty"`
+}
+
+// The image that was found on the card page but could not be used
+type ImageRejectionJSON struct {
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
 }
 
 type CardJSON struct {
+	SchemaVersion       string             `json:"schema_version"`
 	Uid                 string             `json:"uid"`
 	Species             string             `json:"animal"`
 	Location            *LocationJSON      `json:"location"`
@@ -44,6 +81,12 @@ type CardJSON struct {
 	ProvenanceURL       string             `json:"provenance_url"`
 	AnimalSexSpec       *string            `json:"animal_sex,omitempty"`
 	Images              []EncodedImageJSON `json:"images"`
+	// why the images found on the card page are not in Images
+	ImageRejections []ImageRejectionJSON `json:"image_rejections,omitempty"`
+	// uids of the earlier cards with the visually similar image, probably the same pet posted again
+	PossibleDuplicateOf []string `json:"possible_duplicate_of,omitempty"`
+	// uid of the earlier card with the same (or almost the same) comment, phone and city
+	RepostOf string `json:"repost_of,omitempty"`
 }
 
 func (c *CardJSON) JsonSerialize() string {
@@ -54,12 +97,16 @@ func (c *CardJSON) JsonSerialize() string {
 	return string(encoded)
 }
 
+func CardUid(card types.CardID) string {
+	return fmt.Sprintf("poiskzooru_%d", card)
+}
+
 func NewCardJSON(
 	card *PetCard,
 	geoCoords *geocoding.GeoCoords,
+	adminAddress *geocoding.AdminAddress,
 	geoCoordsProvenance string,
-	imageData []byte,
-	imageMime string) *CardJSON {
+	processedImage *imaging.Image) *CardJSON {
 
 	var emptyStrSlice []string = make([]string, 0)
 
@@ -71,6 +118,12 @@ func NewCardJSON(
 		location.Lat = &geoCoords.Lat
 		location.Lon = &geoCoords.Lon
 	}
+	if adminAddress != nil {
+		location.Region = adminAddress.Region
+		location.Municipality = adminAddress.Municipality
+		location.District = adminAddress.District
+		location.Postcode = adminAddress.Postcode
+	}
 
 	var animalSexSpec *string
 	if card.SexSpec == types.UndefinedSex {
@@ -81,14 +134,15 @@ func NewCardJSON(
 	}
 
 	var images []EncodedImageJSON
-	if imageData != nil {
-		images = []EncodedImageJSON{*EncodeImage(imageData, imageMime)}
+	if processedImage != nil {
+		images = []EncodedImageJSON{*EncodeProcessedImage(processedImage)}
 	} else {
 		images = make([]EncodedImageJSON, 0)
 	}
 
 	return &CardJSON{
-		Uid:                 fmt.Sprintf("poiskzooru_%d", card.ID),
+		SchemaVersion:       CardJSONSchemaVersion,
+		Uid:                 CardUid(card.ID),
 		Species:             card.Species.String(),
 		AnimalSexSpec:       animalSexSpec,
 		Location:            location,
@@ -108,19 +162,89 @@ func NewCardJSON(
 
 }
 
-func EncodeImage(data []byte, mimeType string) *EncodedImageJSON {
-	var typeString string
+// Rebuilds the stored card from its stored page, e.g. after the parser is fixed or the schema is changed.
+// The page is not fetched again, so the fields that do not come from it (the coordinates, the images, the duplicates)
+// are kept as stored. fetchedAt is when the page was fetched, the relative dates on it are resolved against it
+func ReparseCardJSON(card types.CardID, stored *CardJSON, page []byte, fetchedAt time.Time) *CardJSON {
+	petCard := ParsePetCard(card, ParseHtmlContent(string(page)), midnightUTC(fetchedAt))
+	rebuilt := NewCardJSON(petCard, nil, nil, "", nil)
+
+	if stored.Location != nil {
+		address := rebuilt.Location.Address
+		location := *stored.Location
+		location.Address = address
+		rebuilt.Location = &location
+	}
+	rebuilt.Images = stored.Images
+	rebuilt.ImageRejections = stored.ImageRejections
+	rebuilt.PossibleDuplicateOf = stored.PossibleDuplicateOf
+	rebuilt.RepostOf = stored.RepostOf
+	return rebuilt
+}
+
+func imageTypeString(mimeType string) string {
 	switch strings.ToLower(mimeType) {
 	case "image/jpeg":
-		typeString = "jpg"
+		return "jpg"
 	case "image/png":
-		typeString = "png"
+		return "png"
 	default:
 		log.Panicf("Unsupported image mime type: %s", mimeType)
+		return ""
 	}
+}
 
+func EncodeImage(data []byte, mimeType string) *EncodedImageJSON {
 	return &EncodedImageJSON{
 		Data: utils.Base64Encode(data),
-		Type: typeString,
+		Type: imageTypeString(mimeType),
+	}
+}
+
+// Embeds the image along with its dimensions and thumbnail
+func EncodeProcessedImage(img *imaging.Image) *EncodedImageJSON {
+	encoded := EncodeImage(img.Data, img.MimeType())
+	encoded.Width = img.Width
+	encoded.Height = img.Height
+	encoded.Thumbnail = EncodeImage(img.Thumbnail, imaging.JPEG.MimeType())
+	encoded.Thumbnail.Width = imaging.ThumbnailSize
+	encoded.Thumbnail.Height = imaging.ThumbnailSize
+	return encoded
+}
+
+func blobReference(blobsBaseUrl *url.URL, digest string, size int, format imaging.Format, width, height int) *EncodedImageJSON {
+	return &EncodedImageJSON{
+		Type:   "ref",
+		Format: string(format),
+		URL:    blobsBaseUrl.JoinPath(digest).String(),
+		Sha256: digest,
+		Size:   size,
+		Width:  width,
+		Height: height,
+	}
+}
+
+// Stores the image and its thumbnail in the blob store and returns the reference to them.
+// The image kept in the downloaded file is linked into the store under the digest computed while downloading.
+// blobsBaseUrl is the public URL the blob store is served at, the digest is appended to it
+func ReferenceImage(store *blobstore.BlobStore, blobsBaseUrl *url.URL, img *imaging.Image) (*EncodedImageJSON, error) {
+	var err error
+	var digest string = img.Sha256
+	var size int = int(img.Size)
+	if img.Path != "" {
+		err = store.PutFile(img.Path, digest)
+	} else {
+		digest, err = store.Put(img.Data)
+		size = len(img.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ref := blobReference(blobsBaseUrl, digest, size, img.Format, img.Width, img.Height)
+	thumbnailDigest, err := store.Put(img.Thumbnail)
+	if err != nil {
+		return nil, err
 	}
+	ref.Thumbnail = blobReference(blobsBaseUrl, thumbnailDigest, len(img.Thumbnail), imaging.JPEG, imaging.ThumbnailSize, imaging.ThumbnailSize)
+	return ref, nil
 }
@@ -0,0 +1,209 @@
+package crawler
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/blobstore"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/geocoding"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+// go test ./pkg/crawler -run TestCardJSONGolden -update
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata/golden with the actual output")
+
+// 1x1 transparent PNG
+var goldenImage []byte = []byte("\x89\x50\x4e\x47\x0d\x0a\x1a\x0a\x00\x00\x00\x0d\x49\x48\x44\x52\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\x12\x49\x44\x41\x54\x78\x9c\x00\x05\x00\xfa\xff\x02\x00\x00\x00\x00\x03\x00\x00\x0f\x00\x03\x42\xa7\xf5\x0e\x00\x00\x00\x00\x49\x45\x4e\x44\xae\x42\x60\x82")
+
+// Guards the serialized form of CardJSON against unintended changes.
+// If the change is intended, bump CardJSONSchemaVersion, publish the new schema and regenerate the golden files with -update
+func TestCardJSONGolden(t *testing.T) {
+	today := time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		card         types.CardID
+		coords       *geocoding.GeoCoords
+		adminAddress *geocoding.AdminAddress
+	}{
+		{164921, &geocoding.GeoCoords{Lat: 51.7727, Lon: 55.0988}, &geocoding.AdminAddress{Region: "Оренбургская область", Municipality: "Оренбург", District: "Центральный район", Postcode: "460000"}},
+		{164923, &geocoding.GeoCoords{Lat: 55.8064, Lon: 38.9618}, nil},
+		{164929, nil, nil},
+		{164931, &geocoding.GeoCoords{Lat: 61.2541, Lon: 73.3962}, &geocoding.AdminAddress{Region: "Ханты-Мансийский автономный округ — Югра", Municipality: "Сургут"}},
+	}
+
+	image, err := imaging.Process(goldenImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", testCase.card), func(t *testing.T) {
+			fileContent, err := os.ReadFile(fmt.Sprintf("./testdata/%d.html.dump", testCase.card))
+			if err != nil {
+				t.Fatal(err)
+			}
+			petCard := ParsePetCard(testCase.card, ParseHtmlContent(string(fileContent)), today)
+
+			jsonCard := NewCardJSON(petCard, testCase.coords, testCase.adminAddress, "hardcoded", image)
+			serialized := jsonCard.JsonSerialize()
+
+			err = ValidateSerializedCardJSON([]byte(serialized))
+			if err != nil {
+				t.Errorf("card does not conform to the schema: %v", err)
+			}
+
+			goldenPath := path.Join("testdata", "golden", fmt.Sprintf("%d.json", testCase.card))
+			if *updateGolden {
+				err = os.WriteFile(goldenPath, []byte(serialized), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(expected) != serialized {
+				t.Errorf("Serialized card differs from %s.\nExpected:\n%s\nActual:\n%s", goldenPath, expected, serialized)
+			}
+		})
+	}
+}
+
+func TestSchemaVersionIsConsistent(t *testing.T) {
+	expected := fmt.Sprintf(`"schema_version": { "const": "%s" }`, CardJSONSchemaVersion)
+	if !strings.Contains(CardJSONSchema(), expected) {
+		t.Errorf("embedded schema does not declare version %s", CardJSONSchemaVersion)
+	}
+}
+
+func TestSchemaRejectsInvalidCards(t *testing.T) {
+	testCases := []struct {
+		name, doc string
+	}{
+		{"missing schema version", `{"uid":"poiskzooru_1","animal":"dog","location":{"Address":"x","CoordsProvenance":"y"},"event_time":"2022-10-18T00:00:00Z","event_time_provenance":"","card_type":"lost","contact_info":{"Comment":"","Tel":[],"Website":[],"Email":[],"Name":""},"provenance_url":"https://poiskzoo.ru/1","images":[]}`},
+		{"unknown species", `{"schema_version":"{{version}}","uid":"poiskzooru_1","animal":"fish","location":{"Address":"x","CoordsProvenance":"y"},"event_time":"2022-10-18T00:00:00Z","event_time_provenance":"","card_type":"lost","contact_info":{"Comment":"","Tel":[],"Website":[],"Email":[],"Name":""},"provenance_url":"https://poiskzoo.ru/1","images":[]}`},
+		{"unexpected field", `{"schema_version":"{{version}}","uid":"poiskzooru_1","animal":"dog","location":{"Address":"x","CoordsProvenance":"y"},"event_time":"2022-10-18T00:00:00Z","event_time_provenance":"","card_type":"lost","contact_info":{"Comment":"","Tel":[],"Website":[],"Email":[],"Name":""},"provenance_url":"https://poiskzoo.ru/1","images":[],"extra":1}`},
+		{"lat without lon", `{"schema_version":"{{version}}","uid":"poiskzooru_1","animal":"dog","location":{"Address":"x","CoordsProvenance":"y","Lat":1},"event_time":"2022-10-18T00:00:00Z","event_time_provenance":"","card_type":"lost","contact_info":{"Comment":"","Tel":[],"Website":[],"Email":[],"Name":""},"provenance_url":"https://poiskzoo.ru/1","images":[]}`},
+	}
+	for _, testCase := range testCases {
+		doc := strings.ReplaceAll(testCase.doc, "{{version}}", CardJSONSchemaVersion)
+		if ValidateSerializedCardJSON([]byte(doc)) == nil {
+			t.Errorf("%s: expected validation to fail", testCase.name)
+		}
+	}
+}
+
+func TestReferenceImage(t *testing.T) {
+	store, err := blobstore.NewDirectoryBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseUrl, _ := url.Parse("http://crawler:8080/blobs/")
+
+	image, err := imaging.Process(goldenImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := ReferenceImage(store, baseUrl, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDigest := blobstore.Digest(image.Data)
+	if ref.Type != "ref" || ref.Format != "png" || ref.Data != "" {
+		t.Errorf("unexpected reference %+v", ref)
+	}
+	if ref.Sha256 != expectedDigest || ref.URL != "http://crawler:8080/blobs/"+expectedDigest {
+		t.Errorf("unexpected digest or url %+v", ref)
+	}
+	if ref.Size != len(image.Data) || ref.Width != 1 || ref.Height != 1 {
+		t.Errorf("unexpected size or dimensions %+v", ref)
+	}
+	thumbnail := ref.Thumbnail
+	if thumbnail == nil || thumbnail.Type != "ref" || thumbnail.Format != "jpg" || thumbnail.Sha256 != blobstore.Digest(image.Thumbnail) {
+		t.Errorf("unexpected thumbnail reference %+v", thumbnail)
+	}
+	if _, err := store.Open(thumbnail.Sha256); err != nil {
+		t.Errorf("thumbnail is not stored: %v", err)
+	}
+
+	fileContent, err := os.ReadFile("./testdata/164978.html.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	petCard := ParsePetCard(164978, ParseHtmlContent(string(fileContent)), time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC))
+	jsonCard := NewCardJSON(petCard, nil, nil, "hardcoded", nil)
+	jsonCard.Images = []EncodedImageJSON{*ref}
+	err = jsonCard.Validate()
+	if err != nil {
+		t.Errorf("card with image reference does not conform to the schema: %v", err)
+	}
+}
+
+func TestImageRejectionsConformToSchema(t *testing.T) {
+	fileContent, err := os.ReadFile("./testdata/165457.html.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	petCard := ParsePetCard(165457, ParseHtmlContent(string(fileContent)), time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC))
+	jsonCard := NewCardJSON(petCard, nil, nil, "hardcoded", nil)
+	jsonCard.ImageRejections = []ImageRejectionJSON{{URL: "https://poiskzoo.ru/images/board/small/x.jpg", Reason: "not a supported image (content looks like text/html)"}}
+	err = jsonCard.Validate()
+	if err != nil {
+		t.Errorf("card with image rejections does not conform to the schema: %v", err)
+	}
+}
+
+func TestDuplicateLinksConformToSchema(t *testing.T) {
+	fileContent, err := os.ReadFile("./testdata/164978.html.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	petCard := ParsePetCard(164978, ParseHtmlContent(string(fileContent)), time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC))
+	jsonCard := NewCardJSON(petCard, nil, nil, "hardcoded", nil)
+	jsonCard.PossibleDuplicateOf = []string{CardUid(164921), CardUid(164923)}
+	jsonCard.RepostOf = CardUid(164921)
+	err = jsonCard.Validate()
+	if err != nil {
+		t.Errorf("card with duplicate links does not conform to the schema: %v", err)
+	}
+
+	jsonCard.PossibleDuplicateOf = []string{"164921"}
+	jsonCard.RepostOf = ""
+	if jsonCard.Validate() == nil {
+		t.Error("expected validation to fail for a non-uid duplicate reference")
+	}
+}
+
+func TestReparseKeepsFieldsNotFromThePage(t *testing.T) {
+	fileContent, err := os.ReadFile("./testdata/165457.html.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchedAt := time.Date(2022, 10, 17, 15, 30, 0, 0, time.UTC)
+	petCard := ParsePetCard(165457, ParseHtmlContent(string(fileContent)), midnightUTC(fetchedAt))
+	stored := NewCardJSON(petCard, &geocoding.GeoCoords{Lat: 55.75, Lon: 37.61}, &geocoding.AdminAddress{Region: "Москва"}, "geocoded", nil)
+	stored.Images = []EncodedImageJSON{{Type: "file", Data: "1.jpg"}}
+	stored.RepostOf = CardUid(164921)
+	expected := stored.JsonSerialize()
+
+	// as if stored by the older parser
+	stored.Species = "unknown"
+	stored.Location.Address = "garbage"
+	stored.ContactInfo.Comment = ""
+
+	rebuilt := ReparseCardJSON(165457, stored, fileContent, fetchedAt)
+	if actual := rebuilt.JsonSerialize(); actual != expected {
+		t.Errorf("reparsed card differs from the expected one.\nexpected: %s\nactual: %s", expected, actual)
+	}
+	if err := rebuilt.Validate(); err != nil {
+		t.Errorf("reparsed card does not conform to the schema: %v", err)
+	}
+}
@@ -1,61 +1,189 @@
 package crawler
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"net/url"
-	"strings"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/blobstore"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/dedup"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/geocoding"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/metrics"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/notification"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/outbox"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // TODO: inject implementation?
-var nominatim geocoding.Geocoder = geocoding.NewOpenStreetMapsNominatim()
-var cachedNominatim geocoding.Geocoder = geocoding.NewLRUCacheDecorator(&nominatim, 128)
+var osmNominatim *geocoding.Nominatim = geocoding.NewOpenStreetMapsNominatim()
+var nominatim geocoding.Geocoder = osmNominatim
+var geocodingCache *geocoding.LRUCacheDecorator = geocoding.NewLRUCacheDecorator(&nominatim, 128)
+var cachedNominatim geocoding.Geocoder = geocodingCache
+var reverseNominatim geocoding.ReverseGeocoder = osmNominatim
+var reverseGeocodingCache *geocoding.LRUReverseCacheDecorator = geocoding.NewLRUReverseCacheDecorator(&reverseNominatim, 128)
+var cachedReverseNominatim geocoding.ReverseGeocoder = reverseGeocodingCache
+
+// reported in the metrics
+const geocodingProvider = "nominatim"
+
+func init() {
+	// the caches are replaced by ConfigureGeocoding
+	metrics.RegisterCache("geocoding", func() utils.CacheStats { return geocodingCache.Stats() })
+	metrics.RegisterCache("reverse_geocoding", func() utils.CacheStats { return reverseGeocodingCache.Stats() })
+}
+
+// Replaces the geocoders used by the crawlers with the ones making at most one Nominatim request per minInterval
+// and caching cacheCapacity lookups of each kind. Must be called before any crawling
+func ConfigureGeocoding(minInterval time.Duration, cacheCapacity int) {
+	osmNominatim = geocoding.NewOpenStreetMapsNominatimWithInterval(minInterval)
+	nominatim = osmNominatim
+	geocodingCache = geocoding.NewLRUCacheDecorator(&nominatim, cacheCapacity)
+	cachedNominatim = geocodingCache
+	reverseNominatim = osmNominatim
+	reverseGeocodingCache = geocoding.NewLRUReverseCacheDecorator(&reverseNominatim, cacheCapacity)
+	cachedReverseNominatim = reverseGeocodingCache
+}
 
 type LocalCardStorage interface {
 	IsCardExist(card types.CardID) bool
-	SaveCard(petCard *PetCard, jsonCard *CardJSON, fetchedImage *utils.HttpFetchResult)
+	SaveCard(ctx context.Context, petCard *PetCard, jsonCard *CardJSON, image *imaging.Image)
+}
+
+// Perceptual hashes of the images of the already crawled cards
+type ImageHashIndex interface {
+	Add(card types.CardID, hash imaging.PerceptualHash) error
+	FindSimilar(hash imaging.PerceptualHash, maxDistance int) []types.CardID
 }
 
 type Crawler struct {
-	cardStorage     *LocalCardStorage
-	notificationUrl *url.URL
+	cardStorage *LocalCardStorage
+	// nil means that the pipeline is not notified
+	notificationOutbox *outbox.Outbox
+	// if not nil, images are sent by reference to this blob store instead of being embedded
+	imageBlobStore *blobstore.BlobStore
+	blobsBaseUrl   *url.URL
+	// if not nil, the cards with visually similar images are marked as possible duplicates
+	imageHashIndex ImageHashIndex
+	// if not nil, the reposts of the already crawled cards are linked to the original ones
+	repostIndex                      *dedup.Index
+	suppressExactRepostNotifications bool
+	// the images are downloaded here, the OS temp dir if empty
+	imageDownloadDir string
+}
+
+// Switches the crawler to store images in the blob store and to put only the references to them into the cards.
+// blobsBaseUrl is the public URL the blob store is served at
+func (c *Crawler) UseImageReferences(store *blobstore.BlobStore, blobsBaseUrl *url.URL) {
+	c.imageBlobStore = store
+	c.blobsBaseUrl = blobsBaseUrl
+}
+
+// Downloads the images into dir, which is to be on the same file system as the card storage and the blob store,
+// so the images are linked into them instead of being copied
+func (c *Crawler) UseImageDownloadDir(dir string) {
+	c.imageDownloadDir = dir
+}
+
+// Enables marking of the cards with the same photo as the already crawled ones
+func (c *Crawler) UseImageHashIndex(index ImageHashIndex) {
+	c.imageHashIndex = index
+}
+
+// Enables linking of the reposted cards to the original ones by the comment text, phone and city.
+// If suppressExactRepostNotifications is set, the pipeline is not notified about the exact reposts
+func (c *Crawler) UseRepostDetection(index *dedup.Index, suppressExactRepostNotifications bool) {
+	c.repostIndex = index
+	c.suppressExactRepostNotifications = suppressExactRepostNotifications
 }
 
-func NewCrawler(localStorage *LocalCardStorage, notificationUrl *url.URL) *Crawler {
+func NewCrawler(localStorage *LocalCardStorage, notificationOutbox *outbox.Outbox) *Crawler {
 	return &Crawler{
-		cardStorage:     localStorage,
-		notificationUrl: notificationUrl,
+		cardStorage:        localStorage,
+		notificationOutbox: notificationOutbox,
 	}
 }
 
-// Download card, save it to disk, post it to HTTP (kafka REST API) if notification url is not nil
-func (c *Crawler) DoCardJob(card types.CardID) {
+// Download card, enqueue the pipeline notification if the outbox is not nil, save the card to disk.
+// The notification itself is delivered asynchronously by the outbox sender.
+// Each job is traced separately, linked to the span in ctx (the crawl cycle).
+// The failure of the job is logged, counted and returned, so the other jobs go on
+func (c *Crawler) DoCardJob(ctx context.Context, card types.CardID) (err error) {
+	ctx, span := tracing.StartLinkedRoot(ctx, "card_job", attribute.Int(logging.CardIDKey, int(card)))
+	ctx = logging.With(ctx, logging.CardIDKey, card, "trace_id", span.SpanContext().TraceID().String())
+	logger := logging.Component(ctx, "crawler")
+
+	// the stage the job is at, reported as the failure reason
+	var stage string = "card_download"
 	cardJobFailurePrinter := func() {
 		if a := recover(); a != nil {
-			log.Printf("%d:\tPanic during fetching of card %v", card, a)
-			panic(a)
+			logger.Error("Panic during fetching of card", "panic", a, "stage", stage)
+			metrics.CardsFailed.WithLabelValues(stage).Inc()
+			span.SetAttributes(attribute.String("failed_stage", stage))
+			if panicErr, isErr := a.(error); isErr {
+				err = fmt.Errorf("card %d failed at %s stage: %w", card, stage, panicErr)
+			} else {
+				err = fmt.Errorf("card %d failed at %s stage: %v", card, stage, a)
+			}
+			tracing.End(span, err)
+			return
 		}
+		span.End()
 	}
 	defer cardJobFailurePrinter()
 
 	// workaround for paid promotion
 	// TODO: do something smarter
 	if (*c.cardStorage).IsCardExist(card) {
-		log.Printf("%d:\t Card dir already exists. Consider it as processed. skipping it\n", card)
-		return
+		logger.Info("Card dir already exists. Consider it as processed. skipping it")
+		return nil
 	}
 
-	log.Printf("%d:\tFetching card...\n", card)
-	fetchedCard, err := GetPetCard(card)
+	logger.Info("Fetching card...")
+	fetchedCard, err := GetPetCard(ctx, card)
+	var robotsErr *utils.RobotsDisallowedError
+	if errors.As(err, &robotsErr) {
+		logger.Warn("Card page is disallowed by robots.txt, skipping it")
+		metrics.CardsFailed.WithLabelValues("robots").Inc()
+		return nil
+	}
+	var robotsUnavailableErr *utils.RobotsUnavailableError
+	if errors.As(err, &robotsUnavailableErr) {
+		logger.Warn("Card page is not fetched, as robots.txt is unreachable. The card is to be retried", logging.ErrorKey, err)
+		metrics.CardsFailed.WithLabelValues("robots_unavailable").Inc()
+		return err
+	}
+	if statusCode, ok := utils.StatusCodeOf(err); ok && (statusCode == http.StatusNotFound || statusCode == http.StatusGone) {
+		// the card is removed between the catalog scan and the download
+		logger.Warn("Card is not found, skipping it", "status", statusCode)
+		metrics.CardsFailed.WithLabelValues("card_not_found").Inc()
+		return nil
+	}
 	if err != nil {
-		log.Panicf("%d:\tFailed to download card: %v\n", card, err)
+		logging.Panic(logger, "Failed to download card", logging.ErrorKey, err)
+	}
+	logger.Info("Downloaded card")
+	stage = "image_download"
+	var imageRejections []ImageRejectionJSON
+	fetchedImage, tooLargeErr := DownloadImage(ctx, fetchedCard.ImagesURL, c.imageDownloadDir)
+	if fetchedImage != nil {
+		defer fetchedImage.Remove()
+	}
+	if tooLargeErr != nil {
+		imageRejections = append(imageRejections, ImageRejectionJSON{
+			URL:    fetchedCard.ImagesURL.String(),
+			Reason: fmt.Sprintf("too large (over %d bytes)", tooLargeErr.Limit),
+		})
 	}
-	log.Printf("%d:\tDownloaded card\n", card)
-	var fetchedImage *utils.HttpFetchResult = DownloadImage(fetchedCard.ImagesURL, fmt.Sprintf("%d:\t", card))
 
 	var locationSpecFormats []string = []string{
 		fmt.Sprintf("Россия, г. %s, %s", fetchedCard.City, fetchedCard.Address),
@@ -67,59 +195,197 @@ func (c *Crawler) DoCardJob(card types.CardID) {
 		fmt.Sprintf("г. %s", fetchedCard.City),
 		fetchedCard.City,
 	}
+	stage = "geocoding"
 	var geoCoords *geocoding.GeoCoords
-	for _, locationSpec := range locationSpecFormats {
-		log.Printf("%d:\tTrying to geocode \"%s\"...\n", card, locationSpec)
-		coords, err := cachedNominatim.Geocode(locationSpec)
+	for formatIdx, locationSpec := range locationSpecFormats {
+		logger.Debug("Trying to geocode", "toponym", locationSpec)
+		coords, err := cachedNominatim.Geocode(ctx, locationSpec)
+		var result string = "ok"
+		if err != nil {
+			result = "error"
+		}
+		metrics.GeocodingAttempts.WithLabelValues(strconv.Itoa(formatIdx), geocodingProvider, result).Inc()
 		if err == nil {
-			log.Printf("%d:\tSuccessfully geocoded \"%s\" as lat:%f lon:%f\n", card, locationSpec, coords.Lat, coords.Lon)
+			logger.Info("Successfully geocoded", "toponym", locationSpec, "format_index", formatIdx, "lat", coords.Lat, "lon", coords.Lon)
 			geoCoords = coords
 			break
 		}
 	}
 
-	var imageBytes []byte
-	var imageMime string
-	if fetchedImage != nil && strings.Contains(fetchedImage.ContentType, "image") {
-		imageBytes = fetchedImage.Body
-		imageMime = fetchedImage.ContentType
-	} else {
-		fetchedImage = nil // fetch data from image URL is not an image
+	var adminAddress *geocoding.AdminAddress
+	if geoCoords != nil {
+		logger.Debug("Reverse geocoding", "lat", geoCoords.Lat, "lon", geoCoords.Lon)
+		adminAddress, err = cachedReverseNominatim.ReverseGeocode(ctx, *geoCoords)
+		if err != nil {
+			// the card is still useful without the administrative division
+			logger.Warn("Failed to reverse geocode", logging.ErrorKey, err)
+			adminAddress = nil
+		} else {
+			logger.Info("Reverse geocoded", "region", adminAddress.Region, "municipality", adminAddress.Municipality, "district", adminAddress.District)
+		}
 	}
 
+	stage = "image_processing"
+	var processedImage *imaging.Image
+	if fetchedImage != nil {
+		// not trusting the declared content type, looking at the actual bytes.
+		// Metadata (e.g. EXIF GPS coordinates) is stripped here, JPEG without it is kept as is
+		processedImage, err = imaging.ProcessFile(fetchedImage.Path, fetchedImage.Sha256)
+		var rejected *imaging.RejectedImageError
+		switch {
+		case errors.As(err, &rejected):
+			logger.Warn("Image is rejected", "reason", rejected.Reason)
+			imageRejections = append(imageRejections, ImageRejectionJSON{
+				URL:    fetchedCard.ImagesURL.String(),
+				Reason: rejected.Reason,
+			})
+			processedImage = nil
+		case err != nil:
+			logging.Panic(logger, "Failed to process image", logging.ErrorKey, err)
+		default:
+			logger.Info("Processed image", "original_format", processedImage.OriginalFormat, "width", processedImage.Width, "height", processedImage.Height, "format", processedImage.Format, "kept_as_is", processedImage.Path != "")
+		}
+	}
+
+	stage = "blob_store"
+	var imageRef *EncodedImageJSON
+	if c.imageBlobStore != nil && processedImage != nil {
+		imageRef, err = ReferenceImage(c.imageBlobStore, c.blobsBaseUrl, processedImage)
+		if err != nil {
+			logging.Panic(logger, "Failed to store image in the blob store", logging.ErrorKey, err)
+		}
+		logger.Info("Stored image as blob", "sha256", imageRef.Sha256)
+	}
+
+	var embeddedImage *imaging.Image = processedImage
+	if imageRef != nil {
+		// not embedding the image, it is referenced instead
+		embeddedImage = nil
+	} else if embeddedImage != nil {
+		err = embeddedImage.Load()
+		if err != nil {
+			logging.Panic(logger, "Failed to read downloaded image", logging.ErrorKey, err)
+		}
+	}
 	jsonCard := NewCardJSON(fetchedCard,
 		geoCoords,
+		adminAddress,
 		"Геокодер OSM Moninatim",
-		imageBytes,
-		imageMime)
+		embeddedImage)
+	if imageRef != nil {
+		jsonCard.Images = []EncodedImageJSON{*imageRef}
+	}
+	jsonCard.ImageRejections = imageRejections
+	// flat or placeholder images would all be near-duplicates of each other
+	hashable := processedImage != nil && !processedImage.Hash.IsUninformative()
+	if c.imageHashIndex != nil && hashable {
+		for _, similarCard := range c.imageHashIndex.FindSimilar(processedImage.Hash, imaging.NearDuplicateDistance) {
+			if similarCard == card {
+				continue
+			}
+			jsonCard.PossibleDuplicateOf = append(jsonCard.PossibleDuplicateOf, CardUid(similarCard))
+		}
+		if len(jsonCard.PossibleDuplicateOf) > 0 {
+			logger.Info("Image is similar to the images of other cards", "hash", processedImage.Hash.String(), "possible_duplicate_of", jsonCard.PossibleDuplicateOf)
+		}
+	}
+	var fingerprint *dedup.Fingerprint
+	var repost *dedup.Match
+	if c.repostIndex != nil {
+		fingerprint = dedup.NewFingerprint(fetchedCard.Comment, fetchedCard.City)
+		repost = c.repostIndex.FindRepost(card, fingerprint)
+		if repost != nil {
+			jsonCard.RepostOf = CardUid(repost.Card)
+			logger.Info("The card is a repost", "repost_of", repost.Card, "exact", repost.Exact, "similarity", repost.Similarity)
+		}
+	}
+	stage = "schema"
+	// serializing before saving, as the storage replaces embedded images with file references
 	serialized := jsonCard.JsonSerialize()
+	err = ValidateSerializedCardJSON([]byte(serialized))
+	if err != nil {
+		logging.Panic(logger, "The card does not conform to CardJSON schema", "schema_version", CardJSONSchemaVersion, logging.ErrorKey, err)
+	}
 
-	if c.notificationUrl != nil {
-		// doing notification
-		log.Printf("%d:\tSending snapshot to pipeline...\n\n", card)
-		_, err = utils.HttpPost(c.notificationUrl, types.JsonMimeType, []byte(serialized))
+	// enqueueing before saving: once the card is saved, it is skipped by the next cycles,
+	// so a crash after the save must not leave it without the notification
+	stage = "outbox"
+	if repost != nil && repost.Exact && c.suppressExactRepostNotifications {
+		logger.Info("Skipped pipeline notification, as the card is an exact repost", "repost_of", repost.Card)
+	} else if c.notificationOutbox != nil {
+		err = c.notificationOutbox.Enqueue(ctx, jsonCard.Uid, card, notification.EventNew, []byte(serialized))
 		if err != nil {
-			log.Panicf("%d:Failed to notify pipeline %v\t\n", card, err)
-		} else {
-			log.Printf("%d:\tSuccessfully notified the pipeline\n", card)
+			logging.Panic(logger, "Failed to enqueue pipeline notification", logging.ErrorKey, err)
 		}
+		logger.Info("Enqueued pipeline notification")
 	} else {
-		log.Printf("%d:\tSkipped pipeline notification, as no notification URL is set\n", card)
+		logger.Info("Skipped pipeline notification, as no notification URL is set")
 	}
 
-	(*c.cardStorage).SaveCard(fetchedCard, jsonCard, fetchedImage)
-}
-
-func DownloadImage(imageURL *url.URL, logPrefix string) *utils.HttpFetchResult {
-	var fetchedImage *utils.HttpFetchResult
-	var err error
-	if imageURL != nil {
-		log.Printf("%sDownloading image %v\n", logPrefix, *imageURL)
-		fetchedImage, err = utils.HttpGet(imageURL, "*/*")
+	stage = "storage"
+	(*c.cardStorage).SaveCard(ctx, fetchedCard, jsonCard, processedImage)
+	stage = "indexing"
+	if c.imageHashIndex != nil && hashable {
+		err = c.imageHashIndex.Add(card, processedImage.Hash)
+		if err != nil {
+			logging.Panic(logger, "Failed to add image hash to the index", logging.ErrorKey, err)
+		}
+	}
+	if fingerprint != nil {
+		err = c.repostIndex.Add(card, fingerprint)
 		if err != nil {
-			log.Panicf("%sFailed to download image for card: %v\n", logPrefix, err)
+			logging.Panic(logger, "Failed to add text fingerprint to the index", logging.ErrorKey, err)
 		}
-		log.Printf("%sDownloaded image (%d bytes; mime %s)\n", logPrefix, len(fetchedImage.Body), fetchedImage.ContentType)
 	}
-	return fetchedImage
+	metrics.CardsSucceeded.Inc()
+	return nil
+}
+
+// Streams the image to a temp file in dir (the OS temp dir if empty), which the caller removes.
+// Returns nil if there is no image or it may not be fetched.
+// The image over the size limit is not an error of the job, BodyTooLargeError is returned to record the rejection
+func DownloadImage(ctx context.Context, imageURL *url.URL, dir string) (*utils.DownloadedFile, *utils.BodyTooLargeError) {
+	logger := logging.Component(ctx, "crawler")
+	if imageURL == nil {
+		return nil, nil
+	}
+	ctx, span := tracing.Start(ctx, "image_download", attribute.String("http.url", imageURL.String()))
+	logger.Info("Downloading image", "url", imageURL.String())
+	fetchedImage, err := utils.HttpDownload(ctx, imageURL, "*/*", utils.ContentClassImage, dir)
+	var robotsErr *utils.RobotsDisallowedError
+	if errors.As(err, &robotsErr) {
+		// the card is still useful without the image
+		span.End()
+		logger.Warn("Image is disallowed by robots.txt, skipping it", "url", imageURL.String())
+		return nil, nil
+	}
+	var robotsUnavailableErr *utils.RobotsUnavailableError
+	if errors.As(err, &robotsUnavailableErr) {
+		tracing.End(span, err)
+		logger.Warn("Image is not fetched, as robots.txt is unreachable. The card is to be retried", "url", imageURL.String(), logging.ErrorKey, err)
+		// failing the job, not to save the card without the image for good
+		panic(err)
+	}
+	var tooLargeErr *utils.BodyTooLargeError
+	if errors.As(err, &tooLargeErr) {
+		tracing.End(span, err)
+		logger.Warn("Image is too large, skipping it", "url", imageURL.String(), "limit_bytes", tooLargeErr.Limit)
+		return nil, tooLargeErr
+	}
+	if err != nil {
+		tracing.End(span, err)
+		logging.Panic(logger, "Failed to download image for card", "url", imageURL.String(), logging.ErrorKey, err)
+	}
+	// the file may be linked into the card storage as is, where the files are world readable
+	err = os.Chmod(fetchedImage.Path, 0644)
+	if err != nil {
+		fetchedImage.Remove()
+		tracing.End(span, err)
+		logging.Panic(logger, "Failed to set downloaded image permissions", logging.ErrorKey, err)
+	}
+	span.SetAttributes(attribute.Int64("bytes", fetchedImage.Size), attribute.String("sha256", fetchedImage.Sha256))
+	span.End()
+	logger.Info("Downloaded image", "bytes", fetchedImage.Size, "sha256", fetchedImage.Sha256, "content_type", fetchedImage.ContentType)
+	metrics.ImageBytesDownloaded.Add(float64(fetchedImage.Size))
+	return fetchedImage, nil
 }
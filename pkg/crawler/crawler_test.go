@@ -1,10 +1,14 @@
 package crawler
 
 import (
+	"context"
 	"testing"
 
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/metrics"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/outbox"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
-	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type issue13StorageStub struct {
@@ -14,9 +18,9 @@ func (s *issue13StorageStub) IsCardExist(card types.CardID) bool {
 	return false
 }
 
-func (s *issue13StorageStub) SaveCard(petCard *PetCard, jsonCard *CardJSON, fetchedImage *utils.HttpFetchResult) {
+func (s *issue13StorageStub) SaveCard(ctx context.Context, petCard *PetCard, jsonCard *CardJSON, image *imaging.Image) {
 	// there must be no image here
-	if fetchedImage != nil {
+	if image != nil {
 		panic("Image must be nil")
 	}
 }
@@ -27,5 +31,68 @@ func TestIssue13(t *testing.T) {
 	var storage LocalCardStorage = &issue13StorageStub{}
 	crawler := NewCrawler(&storage, nil)
 
-	crawler.DoCardJob(types.CardID(165457))
+	if err := crawler.DoCardJob(context.Background(), types.CardID(165457)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type outboxCheckingStorageStub struct {
+	outbox *outbox.Outbox
+	// pending outbox entries at the moment of saving
+	pendingOnSave []*outbox.Entry
+}
+
+func (s *outboxCheckingStorageStub) IsCardExist(card types.CardID) bool {
+	return false
+}
+
+func (s *outboxCheckingStorageStub) SaveCard(ctx context.Context, petCard *PetCard, jsonCard *CardJSON, image *imaging.Image) {
+	pending, err := s.outbox.Pending()
+	if err != nil {
+		panic(err)
+	}
+	s.pendingOnSave = pending
+}
+
+func TestNotificationIsEnqueuedBeforeCardIsSaved(t *testing.T) {
+	// once saved, the card is skipped by the next cycles. Its notification must already be durable by then
+	notificationOutbox, err := outbox.NewDirectoryOutbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &outboxCheckingStorageStub{outbox: notificationOutbox}
+	var storage LocalCardStorage = stub
+	crawler := NewCrawler(&storage, notificationOutbox)
+
+	if err := crawler.DoCardJob(context.Background(), types.CardID(165457)); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.pendingOnSave) != 1 || stub.pendingOnSave[0].CardID != types.CardID(165457) {
+		t.Errorf("expected the notification of the card to be pending when the card is saved, got %+v", stub.pendingOnSave)
+	}
+}
+
+type failingStorageStub struct {
+}
+
+func (s *failingStorageStub) IsCardExist(card types.CardID) bool {
+	panic("card dir is not readable")
+}
+
+func (s *failingStorageStub) SaveCard(ctx context.Context, petCard *PetCard, jsonCard *CardJSON, image *imaging.Image) {
+}
+
+func TestFailedCardJobIsCounted(t *testing.T) {
+	var storage LocalCardStorage = &failingStorageStub{}
+	crawler := NewCrawler(&storage, nil)
+	failedBefore := testutil.ToFloat64(metrics.CardsFailed.WithLabelValues("card_download"))
+
+	// the job must not panic, so the other jobs of the cycle go on
+	err := crawler.DoCardJob(context.Background(), types.CardID(1))
+	if err == nil {
+		t.Fatal("expected the job to fail")
+	}
+	if failed := testutil.ToFloat64(metrics.CardsFailed.WithLabelValues("card_download")); failed != failedBefore+1 {
+		t.Errorf("expected the failure to be counted, got %v failures (%v before)", failed, failedBefore)
+	}
 }
@@ -1,28 +1,44 @@
 package crawler
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/url"
 	"time"
 
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/metrics"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/html"
 )
 
 const poiskZooBaseURL string = "https://poiskzoo.ru"
 
-func GetCardCatalogPage(pageNum int) ([]Card, error) {
+func GetCardCatalogPage(ctx context.Context, pageNum int) ([]Card, error) {
+	ctx, span := tracing.Start(ctx, "catalog_page", attribute.Int(logging.PageKey, pageNum))
+	cards, err := getCardCatalogPage(ctx, pageNum)
+	if err == nil {
+		span.SetAttributes(attribute.Int("cards", len(cards)))
+	}
+	tracing.End(span, err)
+	return cards, err
+}
+
+func getCardCatalogPage(ctx context.Context, pageNum int) ([]Card, error) {
 	effectiveUrlStr := fmt.Sprintf("%s/poteryashka/page-%d", poiskZooBaseURL, pageNum)
 	effectiveUrl, err := url.Parse(effectiveUrlStr)
 	if err != nil {
-		log.Fatalf("Unable to parse URL: %s (%v)", effectiveUrlStr, effectiveUrl)
+		return nil, fmt.Errorf("unable to parse URL %s: %w", effectiveUrlStr, err)
 	}
 
-	resp, err := utils.HttpGetHtml(effectiveUrl)
+	resp, err := utils.HttpGetHtml(logging.With(ctx, logging.PageKey, pageNum), effectiveUrl)
 	if err != nil {
 		return nil, err
 	}
+	metrics.CatalogPagesFetched.Inc()
 	body := resp.Body
 
 	parsedNode := ParseHtmlContent(string(body))
@@ -41,24 +57,43 @@ type PetCard struct {
 	EventType types.EventType
 	Comment   string
 	ImagesURL *url.URL
+	// UTF-8 HTML of the card page, stored to reparse the card later. Not set by ParsePetCard
+	PageHTML []byte
 }
 
-func GetPetCard(card types.CardID) (*PetCard, error) {
+func GetPetCard(ctx context.Context, card types.CardID) (*PetCard, error) {
+	ctx, span := tracing.Start(ctx, "card_download", attribute.Int(logging.CardIDKey, int(card)))
+	petCard, err := getPetCard(ctx, card)
+	tracing.End(span, err)
+	return petCard, err
+}
+
+func getPetCard(ctx context.Context, card types.CardID) (*PetCard, error) {
 	cardUrl, err := url.Parse(fmt.Sprintf("%s/%d", poiskZooBaseURL, card))
 	if err != nil {
 		return nil, err
 	}
-	resp, err := utils.HttpGetHtml(cardUrl)
+	resp, err := utils.HttpGetHtml(ctx, cardUrl)
 	if err != nil {
 		return nil, err
 	}
 
 	parsed := ParseHtmlContent(string(resp.Body))
 
-	cityWithAddress := ExtractAddressFromCardPage(parsed)
+	petCard := ParsePetCard(card, parsed, midnightUTC(time.Now()))
+	petCard.PageHTML = resp.Body
+	return petCard, nil
+}
+
+func midnightUTC(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
 
-	nowUtc := time.Now().UTC()
-	today := time.Date(nowUtc.Year(), nowUtc.Month(), nowUtc.Day(), 0, 0, 0, 0, time.UTC)
+// Extracts the card from the parsed card page.
+// today - is midnight of the date (UTC) the page was fetched, relative dates on the page are resolved against it
+func ParsePetCard(card types.CardID, parsed *html.Node, today time.Time) *PetCard {
+	cityWithAddress := ExtractAddressFromCardPage(parsed)
 
 	return &PetCard{
 		ID:        card,
@@ -70,6 +105,5 @@ func GetPetCard(card types.CardID) (*PetCard, error) {
 		EventType: ExtractCardTypeFromCardPage(parsed),
 		Comment:   ExtractCommentFromCardPage(parsed),
 		ImagesURL: ExtractSmallPhotoUrlFromCardPage(parsed),
-	}, nil
-
+	}
 }
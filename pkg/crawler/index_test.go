@@ -1,16 +1,19 @@
 package crawler
 
 import (
+	"context"
 	"os"
 	"testing"
 
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/geocoding"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/httpfixture"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
 )
 
 func TestGetCardCatalogPage(t *testing.T) {
-	cards, err := GetCardCatalogPage(0)
+	cards, err := GetCardCatalogPage(context.Background(), 0)
 	if err != nil {
 		t.Errorf("Got error while getting card catalog: %v", err)
 		t.FailNow()
@@ -23,13 +26,21 @@ func TestGetCardCatalogPage(t *testing.T) {
 }
 
 func TestFullCardDownload(t *testing.T) {
-	card, err := GetPetCard(types.CardID(164971))
+	card, err := GetPetCard(context.Background(), types.CardID(164971))
+	if httpfixture.IsMissingFixture(err) {
+		t.Fatalf("%v. Record it with %s=record go test ./pkg/crawler", err, httpfixture.HTTP_FIXTURES_ENVVAR)
+	}
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
 
-	image, err := utils.HttpGet(card.ImagesURL, types.AnyMimeType)
+	fetchedImage, err := utils.HttpGet(context.Background(), card.ImagesURL, types.AnyMimeType)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	image, err := imaging.Process(fetchedImage.Body)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -37,9 +48,9 @@ func TestFullCardDownload(t *testing.T) {
 
 	jsonCard := NewCardJSON(card,
 		&geocoding.GeoCoords{Lat: 10.0, Lon: 20.0},
+		nil,
 		"hardcoded",
-		image.Body,
-		image.ContentType)
+		image)
 	serialized := jsonCard.JsonSerialize()
 
 	expectedBytes, err := os.ReadFile("./testdata/164971.json")
@@ -57,6 +68,7 @@ func TestFullCardDownload(t *testing.T) {
 				t.FailNow()
 			}
 		}
+		t.Fatalf("Expected != actual. Expected %d bytes, got %d\n", len(expected), len(serialized))
 	}
 
 }
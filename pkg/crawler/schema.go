@@ -0,0 +1,50 @@
+package crawler
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// The schema of the current CardJSONSchemaVersion. Previous versions are kept in the schema dir for the consumers
+//
+//go:embed schema/cardjson-1.5.schema.json
+var cardJSONSchemaText string
+
+const cardJSONSchemaResource = "cardjson-1.5.schema.json"
+
+var cardJSONSchema *jsonschema.Schema = compileCardJSONSchema()
+
+func compileCardJSONSchema() *jsonschema.Schema {
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+	compiler.AssertFormat = true
+	err := compiler.AddResource(cardJSONSchemaResource, strings.NewReader(cardJSONSchemaText))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to load CardJSON schema: %v", err))
+	}
+	return compiler.MustCompile(cardJSONSchemaResource)
+}
+
+// Returns the JSON Schema of the current CardJSON format
+func CardJSONSchema() string {
+	return cardJSONSchemaText
+}
+
+// Checks the serialized card against the JSON Schema of the current CardJSONSchemaVersion
+func ValidateSerializedCardJSON(serialized []byte) error {
+	var doc interface{}
+	err := json.Unmarshal(serialized, &doc)
+	if err != nil {
+		return err
+	}
+	return cardJSONSchema.Validate(doc)
+}
+
+// Checks the card against the JSON Schema of the current CardJSONSchemaVersion
+func (c *CardJSON) Validate() error {
+	return ValidateSerializedCardJSON([]byte(c.JsonSerialize()))
+}
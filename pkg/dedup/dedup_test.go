@@ -0,0 +1,99 @@
+package dedup
+
+import (
+	"path"
+	"testing"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+const originalComment = "Потерялась маленькая собачка - той-пудель рыжего окраса. В холке очень маленькая - 22 см. Собака взрослая, хоть и выглядит, как щенок. Зовут Нэсси. Тел. +7 (912) 345-67-89"
+
+func TestExtractPhones(t *testing.T) {
+	testCases := []struct {
+		text     string
+		expected []string
+	}{
+		{"звоните +7 (912) 345-67-89", []string{"+79123456789"}},
+		{"8-912-345-67-89 или 89123456789", []string{"+79123456789"}},
+		{"912 345 67 89, 7 495 123 45 67", []string{"+74951234567", "+79123456789"}},
+		{"17. 10. 22 г. в 6. 10-6. 20, клеймо SLN 853", []string{}},
+		{"номер чипа 643123456789, объявление 1641234567890", []string{}},
+	}
+	for _, testCase := range testCases {
+		actual := ExtractPhones(testCase.text)
+		if len(actual) != len(testCase.expected) {
+			t.Errorf("%q: expected %v, got %v", testCase.text, testCase.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != testCase.expected[i] {
+				t.Errorf("%q: expected %v, got %v", testCase.text, testCase.expected, actual)
+			}
+		}
+	}
+}
+
+func TestRepostDetection(t *testing.T) {
+	original := NewFingerprint(originalComment, "Ростов-на-Дону")
+
+	testCases := []struct {
+		name          string
+		comment, city string
+		repost, exact bool
+	}{
+		{"reformatted", "ПОТЕРЯЛАСЬ маленькая собачка, той-пудель рыжего окраса!!! В холке очень маленькая, 22 см. Собака взрослая, хоть и выглядит как щенок. Зовут Нэсси. Тел. 8 912 345 67 89", "ростов-на-дону", true, true},
+		{"edited", "Потерялась маленькая собачка - той-пудель рыжего окраса. В холке очень маленькая - 22 см. Собака взрослая, хоть и выглядит, как щенок. Зовут Нэсси. Помогите найти! Тел. +7 (912) 345-67-89", "Ростов-на-Дону", true, false},
+		{"other city", originalComment, "Москва", false, false},
+		{"other pet", "Найдена британская кошечка, серая, в ошейнике. Кто потерял? Звоните 8 903 111 22 33", "Ростов-на-Дону", false, false},
+	}
+	for _, testCase := range testCases {
+		repost, exact := NewFingerprint(testCase.comment, testCase.city).IsRepostOf(original)
+		if repost != testCase.repost || exact != testCase.exact {
+			t.Errorf("%s: expected repost=%v exact=%v, got repost=%v exact=%v", testCase.name, testCase.repost, testCase.exact, repost, exact)
+		}
+	}
+}
+
+func TestShortCommentsAreNotReposts(t *testing.T) {
+	a := NewFingerprint("Найдена кошка", "Оренбург")
+	b := NewFingerprint("Найдена кошка!", "Оренбург")
+	if repost, _ := a.IsRepostOf(b); repost {
+		t.Error("short generic comments without phones must not be considered reposts")
+	}
+	empty := NewFingerprint("", "Оренбург")
+	if repost, _ := empty.IsRepostOf(NewFingerprint("", "Оренбург")); repost {
+		t.Error("empty comments must not be considered reposts")
+	}
+}
+
+func TestIndexFindsRepostAfterReload(t *testing.T) {
+	indexPath := path.Join(t.TempDir(), "fingerprints.jsonl")
+	index, err := NewFileIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for card, comment := range map[types.CardID]string{
+		1: "Найдена британская кошечка, серая, в ошейнике. Кто потерял? Звоните 8 903 111 22 33",
+		2: originalComment,
+	} {
+		if err := index.Add(card, NewFingerprint(comment, "Ростов-на-Дону")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err := NewFileIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Size() != 2 {
+		t.Fatalf("expected 2 entries, got %d", reloaded.Size())
+	}
+	match := reloaded.FindRepost(3, NewFingerprint(originalComment, "Ростов-на-Дону"))
+	if match == nil || match.Card != 2 || !match.Exact {
+		t.Errorf("expected exact repost of card 2, got %+v", match)
+	}
+	if match := reloaded.FindRepost(2, NewFingerprint(originalComment, "Ростов-на-Дону")); match != nil {
+		t.Errorf("the card must not be a repost of itself, got %+v", match)
+	}
+}
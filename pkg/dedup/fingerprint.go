@@ -0,0 +1,182 @@
+package dedup
+
+import (
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Number of hash functions in MinHash signature
+const signatureSize = 64
+
+// Length of the character shingles, in runes
+const shingleSize = 5
+
+// Estimated Jaccard similarity of the comments above which the card is considered a repost
+const RepostSimilarity = 0.8
+
+// Lower similarity threshold for the cards sharing a phone number
+const RepostSimilarityWithSamePhone = 0.5
+
+// Comments shorter than this (in runes, after normalization), like "найдена кошка", are too generic
+// to tell a repost by the text alone, the phone number must match too
+const minDistinctiveTextLength = 40
+
+// Normalized summary of the card text that survives reformatting of the repost
+type Fingerprint struct {
+	City string `json:"city"`
+	// in +7XXXXXXXXXX form, sorted
+	Phones []string `json:"phones,omitempty"`
+	// FNV-1a hash of the normalized comment. Equal for the exact reposts
+	TextHash uint64 `json:"text_hash"`
+	// of the normalized comment, in runes
+	TextLength int `json:"text_length"`
+	// MinHash signature of the comment shingles. Empty for the empty comment
+	MinHash []uint64 `json:"minhash,omitempty"`
+}
+
+var nonWordRunes *regexp.Regexp = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// Lowercases, unifies "ё" and collapses punctuation and whitespace
+func normalizeText(text string) string {
+	text = strings.ToLower(text)
+	text = strings.ReplaceAll(text, "ё", "е")
+	return strings.TrimSpace(nonWordRunes.ReplaceAllString(text, " "))
+}
+
+// russian phone numbers: +7 (912) 345-67-89, 8-912-345-67-89, 89123456789, 912 345 67 89.
+// Without the prefix the number must start at the word boundary, not to match the tail of a longer digit run (IDs, prices, etc.)
+var phoneRegexp *regexp.Regexp = regexp.MustCompile(`(?:(?:\+7|\b[78])[\s\-(]*|\b)(\d{3})[\s\-)]*(\d{3})[\s\-]*(\d{2})[\s\-]*(\d{2})\b`)
+
+// Extracts the phone numbers from the text, normalized to +7XXXXXXXXXX
+func ExtractPhones(text string) []string {
+	found := make(map[string]bool)
+	for _, match := range phoneRegexp.FindAllStringSubmatch(text, -1) {
+		found["+7"+match[1]+match[2]+match[3]+match[4]] = true
+	}
+	phones := make([]string, 0, len(found))
+	for phone := range found {
+		phones = append(phones, phone)
+	}
+	sort.Strings(phones)
+	return phones
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// splitmix64 finalizer, turns the shingle hash into signatureSize independent hash functions
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func minHash(normalized string) []uint64 {
+	if normalized == "" {
+		return nil
+	}
+	signature := make([]uint64, signatureSize)
+	for i := range signature {
+		signature[i] = ^uint64(0)
+	}
+
+	runes := []rune(normalized)
+	var shingles []string
+	if len(runes) <= shingleSize {
+		shingles = []string{normalized}
+	} else {
+		shingles = make([]string, 0, len(runes)-shingleSize+1)
+		for i := 0; i+shingleSize <= len(runes); i++ {
+			shingles = append(shingles, string(runes[i:i+shingleSize]))
+		}
+	}
+
+	for _, shingle := range shingles {
+		h := hashString(shingle)
+		for i := range signature {
+			v := mix(h + uint64(i)*0x9e3779b97f4a7c15)
+			if v < signature[i] {
+				signature[i] = v
+			}
+		}
+	}
+	return signature
+}
+
+func NewFingerprint(comment string, city string) *Fingerprint {
+	// the phones are compared separately, so it does not matter how they are written in the reposts
+	normalized := normalizeText(phoneRegexp.ReplaceAllString(comment, " "))
+	return &Fingerprint{
+		City:       normalizeText(city),
+		Phones:     ExtractPhones(comment),
+		TextHash:   hashString(normalized),
+		TextLength: len([]rune(normalized)),
+		MinHash:    minHash(normalized),
+	}
+}
+
+// Estimated Jaccard similarity of the comment shingle sets, 0..1
+func (f *Fingerprint) Similarity(other *Fingerprint) float64 {
+	if len(f.MinHash) != len(other.MinHash) || len(f.MinHash) == 0 {
+		return 0
+	}
+	equal := 0
+	for i := range f.MinHash {
+		if f.MinHash[i] == other.MinHash[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(f.MinHash))
+}
+
+func (f *Fingerprint) sharesPhoneWith(other *Fingerprint) bool {
+	for _, phone := range f.Phones {
+		for _, otherPhone := range other.Phones {
+			if phone == otherPhone {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *Fingerprint) samePhones(other *Fingerprint) bool {
+	if len(f.Phones) != len(other.Phones) {
+		return false
+	}
+	for i := range f.Phones {
+		if f.Phones[i] != other.Phones[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the card with this fingerprint is a repost of the card with the other one.
+// The reposts are always in the same city. Exact reposts have the same normalized comment and phones
+func (f *Fingerprint) IsRepostOf(other *Fingerprint) (repost bool, exact bool) {
+	if f.City != other.City || len(f.MinHash) == 0 || len(other.MinHash) == 0 {
+		return false, false
+	}
+	sharesPhone := f.sharesPhoneWith(other)
+	distinctive := f.TextLength >= minDistinctiveTextLength || sharesPhone
+	if !distinctive {
+		return false, false
+	}
+	if f.TextHash == other.TextHash && f.samePhones(other) {
+		return true, true
+	}
+	similarity := f.Similarity(other)
+	if similarity >= RepostSimilarity || (similarity >= RepostSimilarityWithSamePhone && sharesPhone) {
+		return true, false
+	}
+	return false, false
+}
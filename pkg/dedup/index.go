@@ -0,0 +1,130 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+type indexEntryJSON struct {
+	Card        types.CardID `json:"card"`
+	Fingerprint *Fingerprint `json:"fingerprint"`
+}
+
+// The card the new one is a repost of
+type Match struct {
+	Card       types.CardID
+	Exact      bool
+	Similarity float64
+}
+
+// Fingerprints of the stored cards, persisted as an append-only JSON lines file.
+// The whole index is kept in memory
+type Index struct {
+	mu      sync.Mutex
+	path    string
+	entries []indexEntryJSON
+}
+
+// Loads (creating if needed) the index from the file
+func NewFileIndex(path string) (*Index, error) {
+	index := &Index{path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry indexEntryJSON
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		index.entries = append(index.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Number of the indexed cards
+func (i *Index) Size() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.entries)
+}
+
+func (i *Index) Add(card types.CardID, fingerprint *Fingerprint) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entry := indexEntryJSON{Card: card, Fingerprint: fingerprint}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(i.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	i.entries = append(i.entries, entry)
+	return nil
+}
+
+// Finds the indexed card (other than the specified one) the card with the fingerprint is a repost of.
+// Exact reposts are preferred, then the most similar card, then the earliest one. Returns nil if there is none
+func (i *Index) FindRepost(card types.CardID, fingerprint *Fingerprint) *Match {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var best *Match
+	for _, entry := range i.entries {
+		if entry.Card == card {
+			continue
+		}
+		repost, exact := fingerprint.IsRepostOf(entry.Fingerprint)
+		if !repost {
+			continue
+		}
+		candidate := &Match{Card: entry.Card, Exact: exact, Similarity: fingerprint.Similarity(entry.Fingerprint)}
+		if best == nil || isBetterMatch(candidate, best) {
+			best = candidate
+		}
+	}
+	return best
+}
+
+func isBetterMatch(a, b *Match) bool {
+	if a.Exact != b.Exact {
+		return a.Exact
+	}
+	if a.Similarity != b.Similarity {
+		return a.Similarity > b.Similarity
+	}
+	return a.Card < b.Card
+}
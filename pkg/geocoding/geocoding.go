@@ -1,10 +1,29 @@
 package geocoding
 
+import "context"
+
 type GeoCoords struct {
 	Lat, Lon float64
 }
 
 type Geocoder interface {
 	// if error is nil, GeoCoords must be not nil
-	Geocode(toponym string) (*GeoCoords, error)
+	Geocode(ctx context.Context, toponym string) (*GeoCoords, error)
+}
+
+// Administrative division the coordinates belong to.
+// Any of the fields may be empty if the provider does not know it
+type AdminAddress struct {
+	// federal subject (oblast, krai, republic, federal city)
+	Region string
+	// city, town or village
+	Municipality string
+	// city district or suburb
+	District string
+	Postcode string
+}
+
+type ReverseGeocoder interface {
+	// if error is nil, AdminAddress must be not nil
+	ReverseGeocode(ctx context.Context, coords GeoCoords) (*AdminAddress, error)
 }
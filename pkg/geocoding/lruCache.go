@@ -1,38 +1,91 @@
 package geocoding
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"time"
 
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
 )
 
+// Failed lookups are cached for a limited time only, as the failure may be caused by transient network issues
+const failedLookupCacheTTL time.Duration = 10 * time.Minute
+
 type cacheRes struct {
 	fst *GeoCoords
 	snd error
 }
 
+// Caches the results of the target geocoder. Safe for concurrent use
 type LRUCacheDecorator struct {
 	target *Geocoder
-	cache  *utils.LRUCache[string, cacheRes]
+	cache  *utils.ConcurrentLRUCache[string, cacheRes]
 }
 
 func NewLRUCacheDecorator(target *Geocoder, cacheCapacity int) *LRUCacheDecorator {
 	return &LRUCacheDecorator{
 		target: target,
-		cache:  utils.NewLRUCache[string, cacheRes](cacheCapacity),
+		cache:  utils.NewConcurrentLRUCache[string, cacheRes](cacheCapacity),
 	}
 }
 
-func (c *LRUCacheDecorator) Geocode(toponym string) (*GeoCoords, error) {
-	cached, exists := c.cache.Get(toponym)
-	if exists {
-		log.Printf("Cache hit geocoding \"%s\"\n", toponym)
-		return cached.fst, cached.snd
+func (c *LRUCacheDecorator) Geocode(ctx context.Context, toponym string) (*GeoCoords, error) {
+	loaded := false
+	res := c.cache.GetOrLoad(toponym, func() (cacheRes, time.Duration) {
+		loaded = true
+		lookupRes, err := (*c.target).Geocode(ctx, toponym)
+		if err != nil {
+			return cacheRes{nil, err}, failedLookupCacheTTL
+		}
+		return cacheRes{lookupRes, nil}, 0
+	})
+	if !loaded {
+		logging.Component(ctx, "geocoding").Debug("Cache hit geocoding", "toponym", toponym)
 	}
+	return res.fst, res.snd
+}
+
+func (c *LRUCacheDecorator) Stats() utils.CacheStats {
+	return c.cache.Stats()
+}
+
+type reverseCacheRes struct {
+	fst *AdminAddress
+	snd error
+}
 
-	lookupRes, err := (*c.target).Geocode(toponym)
+// Caches the results of the target reverse geocoder. Safe for concurrent use
+type LRUReverseCacheDecorator struct {
+	target *ReverseGeocoder
+	cache  *utils.ConcurrentLRUCache[string, reverseCacheRes]
+}
 
-	c.cache.Set(toponym, cacheRes{lookupRes, err})
+func NewLRUReverseCacheDecorator(target *ReverseGeocoder, cacheCapacity int) *LRUReverseCacheDecorator {
+	return &LRUReverseCacheDecorator{
+		target: target,
+		cache:  utils.NewConcurrentLRUCache[string, reverseCacheRes](cacheCapacity),
+	}
+}
+
+func (c *LRUReverseCacheDecorator) ReverseGeocode(ctx context.Context, coords GeoCoords) (*AdminAddress, error) {
+	// ~1 meter precision is more than enough to hit the same administrative unit
+	key := fmt.Sprintf("%.5f,%.5f", coords.Lat, coords.Lon)
+	loaded := false
+	res := c.cache.GetOrLoad(key, func() (reverseCacheRes, time.Duration) {
+		loaded = true
+		lookupRes, err := (*c.target).ReverseGeocode(ctx, coords)
+		if err != nil {
+			return reverseCacheRes{nil, err}, failedLookupCacheTTL
+		}
+		return reverseCacheRes{lookupRes, nil}, 0
+	})
+	if !loaded {
+		logging.Component(ctx, "geocoding").Debug("Cache hit reverse geocoding", "coords", key)
+	}
+	return res.fst, res.snd
+}
 
-	return lookupRes, err
+func (c *LRUReverseCacheDecorator) Stats() utils.CacheStats {
+	return c.cache.Stats()
 }
@@ -0,0 +1,19 @@
+package geocoding
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/httpfixture"
+)
+
+// The network tests are served from the recorded fixtures.
+// HTTP_FIXTURES=record re-records them, HTTP_FIXTURES=live runs them against the real services
+func TestMain(m *testing.M) {
+	if _, err := httpfixture.InstallForTests("./testdata/fixtures"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to install HTTP fixtures: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
@@ -1,6 +1,7 @@
 package geocoding
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,8 +10,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // OSM Nominatim Usage Policy (aka Geocoding Policy)
@@ -30,16 +34,16 @@ import (
 
 type Nominatim struct {
 	baseUrl       *url.URL
+	reverseUrl    *url.URL
 	mutex         *sync.Mutex
 	latestRequest *time.Time
 	// setting this to 0 disables throttling
 	minIntervalBetweenRequest time.Duration
 }
 
-func (n *Nominatim) Geocode(toponym string) (*GeoCoords, error) {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-
+// Sleeps until the next request is allowed by the throttling policy.
+// Must be called with the mutex held
+func (n *Nominatim) waitForTurn() {
 	elapsed := time.Now().UTC().Sub(*n.latestRequest)
 	toWait := n.minIntervalBetweenRequest - elapsed
 	// log.Printf("Time to wait %v\n", toWait)
@@ -48,6 +52,27 @@ func (n *Nominatim) Geocode(toponym string) (*GeoCoords, error) {
 	}
 	now := time.Now().UTC()
 	n.latestRequest = &now
+}
+
+// Records how long the request waited for the other requests and the throttling
+func recordThrottleWait(ctx context.Context, start time.Time) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("nominatim.throttle_wait_ms", time.Since(start).Milliseconds()))
+}
+
+func (n *Nominatim) Geocode(ctx context.Context, toponym string) (*GeoCoords, error) {
+	ctx, span := tracing.Start(ctx, "nominatim.geocode", attribute.String("nominatim.toponym", toponym))
+	coords, err := n.geocode(ctx, toponym)
+	tracing.End(span, err)
+	return coords, err
+}
+
+func (n *Nominatim) geocode(ctx context.Context, toponym string) (*GeoCoords, error) {
+	start := time.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.waitForTurn()
+	recordThrottleWait(ctx, start)
 
 	requestFullURLstr := fmt.Sprintf("%s?q=%s&format=jsonv2", n.baseUrl, url.QueryEscape(toponym))
 	requestFullURL, err := url.Parse(requestFullURLstr)
@@ -55,7 +80,7 @@ func (n *Nominatim) Geocode(toponym string) (*GeoCoords, error) {
 		return nil, err
 	}
 
-	resp, err := utils.HttpGet(requestFullURL, types.JsonMimeType)
+	resp, err := utils.HttpGet(ctx, requestFullURL, types.JsonMimeType)
 	if err != nil {
 		return nil, err
 	}
@@ -85,10 +110,57 @@ func (n *Nominatim) Geocode(toponym string) (*GeoCoords, error) {
 	return nil, errors.New("Geocoder failed to find any coordinates")
 }
 
+func (n *Nominatim) ReverseGeocode(ctx context.Context, coords GeoCoords) (*AdminAddress, error) {
+	ctx, span := tracing.Start(ctx, "nominatim.reverse_geocode",
+		attribute.Float64("nominatim.lat", coords.Lat),
+		attribute.Float64("nominatim.lon", coords.Lon))
+	address, err := n.reverseGeocode(ctx, coords)
+	tracing.End(span, err)
+	return address, err
+}
+
+func (n *Nominatim) reverseGeocode(ctx context.Context, coords GeoCoords) (*AdminAddress, error) {
+	start := time.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.waitForTurn()
+	recordThrottleWait(ctx, start)
+
+	requestFullURLstr := fmt.Sprintf("%s?lat=%s&lon=%s&format=jsonv2&addressdetails=1",
+		n.reverseUrl,
+		strconv.FormatFloat(coords.Lat, 'f', -1, 64),
+		strconv.FormatFloat(coords.Lon, 'f', -1, 64))
+	requestFullURL, err := url.Parse(requestFullURLstr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := utils.HttpGet(ctx, requestFullURL, types.JsonMimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	var reversed ReversedToponymJSON
+	err = json.Unmarshal(resp.Body, &reversed)
+	if err != nil {
+		return nil, err
+	}
+	if reversed.Error != "" {
+		return nil, fmt.Errorf("reverse geocoder failed: %s", reversed.Error)
+	}
+
+	return reversed.Address.toAdminAddress(), nil
+}
+
+// serviceUrl is the URL of the search endpoint (e.g. https://nominatim.openstreetmap.org/search.php).
+// The reverse endpoint is expected to be the sibling "reverse.php"
 func NewNominatim(serviceUrl *url.URL, minIntervalBetweenRequest time.Duration) *Nominatim {
 	zero := time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
+	reverseUrl := serviceUrl.ResolveReference(&url.URL{Path: "reverse.php"})
 	return &Nominatim{
 		baseUrl:                   serviceUrl,
+		reverseUrl:                reverseUrl,
 		mutex:                     &sync.Mutex{},
 		latestRequest:             &zero,
 		minIntervalBetweenRequest: minIntervalBetweenRequest,
@@ -99,14 +171,57 @@ const openStreetMapsNominatimURL string = "https://nominatim.openstreetmap.org/s
 
 // Constructs a Nominatim API client that uses OpenStreetMap(OSM) free public instance
 func NewOpenStreetMapsNominatim() *Nominatim {
+	return NewOpenStreetMapsNominatimWithInterval(time.Duration(1e9))
+}
+
+// Same as NewOpenStreetMapsNominatim, with the specified min interval between the requests.
+// The usage policy of the instance does not allow more than 1 request per second
+func NewOpenStreetMapsNominatimWithInterval(minIntervalBetweenRequest time.Duration) *Nominatim {
 	url, err := url.Parse(openStreetMapsNominatimURL)
 	if err != nil {
 		panic("Failed to parse openStreetMapsNominatimURL")
 	}
-	return NewNominatim(url, time.Duration(1e9))
+	return NewNominatim(url, minIntervalBetweenRequest)
 }
 
 type FoundToponymJSON struct {
 	Lat string `json:"lat"`
 	Lon string `json:"lon"`
 }
+
+type ReversedToponymJSON struct {
+	Error   string               `json:"error"`
+	Address NominatimAddressJSON `json:"address"`
+}
+
+// see https://nominatim.org/release-docs/latest/api/Output/#addressdetails
+type NominatimAddressJSON struct {
+	State        string `json:"state"`
+	City         string `json:"city"`
+	Town         string `json:"town"`
+	Village      string `json:"village"`
+	Municipality string `json:"municipality"`
+	CityDistrict string `json:"city_district"`
+	District     string `json:"district"`
+	Suburb       string `json:"suburb"`
+	Postcode     string `json:"postcode"`
+}
+
+// returns the first non empty string
+func firstNonEmpty(candidates ...string) string {
+	for _, c := range candidates {
+		if c != "" {
+			return c
+		}
+	}
+	return ""
+}
+
+func (a *NominatimAddressJSON) toAdminAddress() *AdminAddress {
+	return &AdminAddress{
+		Region:       a.State,
+		Municipality: firstNonEmpty(a.City, a.Town, a.Village, a.Municipality),
+		District:     firstNonEmpty(a.CityDistrict, a.District, a.Suburb),
+		Postcode:     a.Postcode,
+	}
+}
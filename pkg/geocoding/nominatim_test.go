@@ -1,6 +1,7 @@
 package geocoding
 
 import (
+	"context"
 	"math"
 	"testing"
 )
@@ -8,7 +9,7 @@ import (
 func TestOSMGeocoder(t *testing.T) {
 	var coder Geocoder = NewOpenStreetMapsNominatim()
 
-	result, err := coder.Geocode("Таруса, пл. Ленина")
+	result, err := coder.Geocode(context.Background(), "Таруса, пл. Ленина")
 
 	var expected GeoCoords = GeoCoords{
 		Lat: 54.7291584,
@@ -32,3 +33,55 @@ func TestOSMGeocoder(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestOSMReverseGeocoder(t *testing.T) {
+	var coder ReverseGeocoder = NewOpenStreetMapsNominatim()
+
+	result, err := coder.ReverseGeocode(context.Background(), GeoCoords{
+		Lat: 54.7291584,
+		Lon: 37.1807652,
+	})
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if result.Region != "Калужская область" {
+		t.Logf("Expected region to be \"Калужская область\" but got \"%s\"", result.Region)
+		t.Fail()
+	}
+
+	if result.Municipality != "Таруса" {
+		t.Logf("Expected municipality to be \"Таруса\" but got \"%s\"", result.Municipality)
+		t.Fail()
+	}
+}
+
+func TestNominatimAddressConversion(t *testing.T) {
+	testCases := []struct {
+		address  NominatimAddressJSON
+		expected AdminAddress
+	}{
+		{
+			NominatimAddressJSON{State: "Москва", City: "Москва", CityDistrict: "Тверской район", Suburb: "Тверской", Postcode: "125009"},
+			AdminAddress{Region: "Москва", Municipality: "Москва", District: "Тверской район", Postcode: "125009"},
+		},
+		{
+			NominatimAddressJSON{State: "Калужская область", Town: "Таруса", Postcode: "249100"},
+			AdminAddress{Region: "Калужская область", Municipality: "Таруса", District: "", Postcode: "249100"},
+		},
+		{
+			NominatimAddressJSON{State: "Московская область", Village: "Демихово", Suburb: "Центр"},
+			AdminAddress{Region: "Московская область", Municipality: "Демихово", District: "Центр"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual := testCase.address.toAdminAddress()
+		if *actual != testCase.expected {
+			t.Logf("Expected %v but got %v", testCase.expected, *actual)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/version"
+)
+
+// Outcome of the crawl cycle
+type CycleJSON struct {
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// the number of the catalog pages scanned
+	CatalogPages int `json:"catalog_pages"`
+	NewCards     int `json:"new_cards"`
+	// the number of the new cards processed so far
+	CardsDone int `json:"cards_done"`
+}
+
+type StatusJSON struct {
+	Version   string    `json:"version"`
+	GitCommit string    `json:"git_commit"`
+	StartedAt time.Time `json:"started_at"`
+	Live      bool      `json:"live"`
+	Ready     bool      `json:"ready"`
+	// failed readiness checks with the errors
+	NotReadyReasons map[string]string `json:"not_ready_reasons,omitempty"`
+	CurrentCycle    *CycleJSON        `json:"current_cycle,omitempty"`
+	LastCycle       *CycleJSON        `json:"last_cycle,omitempty"`
+	// the latest card known to the crawler
+	Watermark types.CardID `json:"watermark"`
+	// the new cards of the current cycle that are not processed yet
+	QueueDepth int `json:"queue_depth"`
+}
+
+// Tracks the crawl cycles to tell the hung crawler from the one sleeping between the cycles
+type Monitor struct {
+	mu              sync.Mutex
+	pollInterval    time.Duration
+	startedAt       time.Time
+	currentCycle    *CycleJSON
+	lastCycle       *CycleJSON
+	watermark       types.CardID
+	readinessChecks map[string]func() error
+
+	// the crawler is considered hung if no cycle completes within StalenessFactor poll intervals
+	StalenessFactor float64
+
+	// to be replaced in tests
+	now func() time.Time
+}
+
+func NewMonitor(pollInterval time.Duration) *Monitor {
+	m := &Monitor{
+		pollInterval:    pollInterval,
+		readinessChecks: make(map[string]func() error),
+		StalenessFactor: 3,
+		now:             time.Now,
+	}
+	m.startedAt = m.now().UTC()
+	return m
+}
+
+// The crawler is not ready while the check returns an error
+func (m *Monitor) AddReadinessCheck(name string, check func() error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readinessChecks[name] = check
+}
+
+func (m *Monitor) CycleStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.currentCycle = &CycleJSON{StartedAt: m.now().UTC()}
+}
+
+func (m *Monitor) CatalogPageFetched() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.currentCycle != nil {
+		m.currentCycle.CatalogPages++
+	}
+}
+
+// The cards to be processed in the current cycle are found
+func (m *Monitor) NewCardsFound(cards []types.CardID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.currentCycle != nil {
+		m.currentCycle.NewCards += len(cards)
+	}
+	for _, card := range cards {
+		if card > m.watermark {
+			m.watermark = card
+		}
+	}
+}
+
+// Sets the watermark from the already stored cards
+func (m *Monitor) SetWatermark(card types.CardID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if card > m.watermark {
+		m.watermark = card
+	}
+}
+
+func (m *Monitor) CardDone() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.currentCycle != nil {
+		m.currentCycle.CardsDone++
+	}
+}
+
+func (m *Monitor) CycleFinished() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.currentCycle == nil {
+		return
+	}
+	finishedAt := m.now().UTC()
+	m.currentCycle.FinishedAt = &finishedAt
+	m.lastCycle = m.currentCycle
+	m.currentCycle = nil
+}
+
+// Returns an error if no cycle has completed for too long
+func (m *Monitor) Live() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lastProgress := m.startedAt
+	if m.lastCycle != nil {
+		lastProgress = *m.lastCycle.FinishedAt
+	}
+	staleAfter := time.Duration(m.StalenessFactor * float64(m.pollInterval))
+	if sinceProgress := m.now().UTC().Sub(lastProgress); sinceProgress > staleAfter {
+		return fmt.Errorf("no crawl cycle completed for %v (allowed %v)", sinceProgress.Round(time.Second), staleAfter)
+	}
+	return nil
+}
+
+// Runs the readiness checks, returns the errors of the failed ones by check name
+func (m *Monitor) Ready() map[string]error {
+	m.mu.Lock()
+	checks := make(map[string]func() error, len(m.readinessChecks))
+	for name, check := range m.readinessChecks {
+		checks[name] = check
+	}
+	m.mu.Unlock()
+
+	failed := make(map[string]error)
+	for name, check := range checks {
+		if err := check(); err != nil {
+			failed[name] = err
+		}
+	}
+	return failed
+}
+
+func (m *Monitor) Status() *StatusJSON {
+	liveErr := m.Live()
+	notReady := m.Ready()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := &StatusJSON{
+		Version:   version.AppVersion,
+		GitCommit: version.GitCommit,
+		StartedAt: m.startedAt,
+		Live:      liveErr == nil,
+		Ready:     len(notReady) == 0,
+		Watermark: m.watermark,
+	}
+	if len(notReady) > 0 {
+		status.NotReadyReasons = make(map[string]string, len(notReady))
+		for name, err := range notReady {
+			status.NotReadyReasons[name] = err.Error()
+		}
+	}
+	if m.currentCycle != nil {
+		current := *m.currentCycle
+		status.CurrentCycle = &current
+		status.QueueDepth = current.NewCards - current.CardsDone
+	}
+	if m.lastCycle != nil {
+		last := *m.lastCycle
+		status.LastCycle = &last
+	}
+	return status
+}
+
+// Liveness probe: 200 unless the crawler looks hung
+func (m *Monitor) ServeLiveness(w http.ResponseWriter, r *http.Request) {
+	if err := m.Live(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Readiness probe: 200 if all of the readiness checks pass
+func (m *Monitor) ServeReadiness(w http.ResponseWriter, r *http.Request) {
+	failed := m.Ready()
+	if len(failed) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %v\n", name, failed[name])
+	}
+}
+
+func (m *Monitor) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", types.JsonMimeType)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(m.Status()); err != nil {
+		logging.Component(r.Context(), "health").Warn("Failed to write status", logging.ErrorKey, err)
+	}
+}
+
+// Readiness check that the directory exists and a file can be created in it
+func DirWritable(dir string) func() error {
+	return func() error {
+		f, err := os.CreateTemp(dir, ".writable-check-*")
+		if err != nil {
+			return err
+		}
+		name := f.Name()
+		f.Close()
+		return os.Remove(name)
+	}
+}
@@ -0,0 +1,104 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+func newTestMonitor() (*Monitor, *time.Time) {
+	now := time.Date(2022, 10, 18, 10, 0, 0, 0, time.UTC)
+	m := NewMonitor(5 * time.Minute)
+	m.now = func() time.Time { return now }
+	m.startedAt = now
+	return m, &now
+}
+
+func serve(handler http.HandlerFunc) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+	return recorder
+}
+
+func TestLivenessFailsWhenNoCycleCompletes(t *testing.T) {
+	m, now := newTestMonitor()
+
+	m.CycleStarted()
+	*now = now.Add(10 * time.Minute)
+	m.CycleFinished()
+	if code := serve(m.ServeLiveness).Code; code != http.StatusOK {
+		t.Errorf("expected live after the completed cycle, got %d", code)
+	}
+
+	// sleeping between the cycles is fine
+	*now = now.Add(5 * time.Minute)
+	m.CycleStarted()
+	*now = now.Add(9 * time.Minute)
+	if code := serve(m.ServeLiveness).Code; code != http.StatusOK {
+		t.Errorf("expected live within 3 poll intervals, got %d", code)
+	}
+
+	// the cycle hangs
+	*now = now.Add(2 * time.Minute)
+	if code := serve(m.ServeLiveness).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("expected not live after 3 poll intervals without completed cycles, got %d", code)
+	}
+}
+
+func TestReadinessReportsFailedChecks(t *testing.T) {
+	m, _ := newTestMonitor()
+	dir := t.TempDir()
+	m.AddReadinessCheck("storage", DirWritable(dir))
+	if code := serve(m.ServeReadiness).Code; code != http.StatusOK {
+		t.Errorf("expected ready with writable storage, got %d", code)
+	}
+
+	m.AddReadinessCheck("storage", DirWritable(path.Join(dir, "missing")))
+	m.AddReadinessCheck("other", func() error { return errors.New("broken") })
+	response := serve(m.ServeReadiness)
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready, got %d", response.Code)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("the writability check must not leave files behind, got %v", entries)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m, now := newTestMonitor()
+	m.SetWatermark(165000)
+
+	m.CycleStarted()
+	m.CatalogPageFetched()
+	m.CatalogPageFetched()
+	m.NewCardsFound([]types.CardID{165002, 165001, 165003})
+	m.CardDone()
+	*now = now.Add(time.Minute)
+
+	var status StatusJSON
+	if err := json.Unmarshal(serve(m.ServeStatus).Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Watermark != 165003 || status.QueueDepth != 2 || !status.Live || !status.Ready {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.CurrentCycle == nil || status.CurrentCycle.CatalogPages != 2 || status.LastCycle != nil {
+		t.Errorf("unexpected cycles %+v %+v", status.CurrentCycle, status.LastCycle)
+	}
+
+	m.CardDone()
+	m.CardDone()
+	m.CycleFinished()
+	status = *m.Status()
+	if status.CurrentCycle != nil || status.LastCycle == nil || status.LastCycle.CardsDone != 3 || status.QueueDepth != 0 {
+		t.Errorf("unexpected status after the cycle %+v", status)
+	}
+}
@@ -0,0 +1,220 @@
+package httpfixture
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Record/replay of the HTTP exchanges, so a crawl session can be captured once and served without network.
+//
+// Each exchange is stored in the fixture directory as a separate JSON file named
+// <method>_<host and path>_<hash>.json, e.g. GET_poiskzoo.ru-165457_1a2b3c4d.json.
+// The files are looked up by their content (method, URL and request body), not by the names
+
+type ExchangeJSON struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// sha256 of the request body, empty for the requests without body
+	RequestBodySha256 string      `json:"request_body_sha256,omitempty"`
+	Status            int         `json:"status"`
+	Header            http.Header `json:"header,omitempty"`
+	// UTF-8 bodies are stored as is to keep the fixtures readable and editable, binary ones in base64
+	Body       string `json:"body,omitempty"`
+	BodyBase64 string `json:"body_base64,omitempty"`
+	// not set for the hand-made fixtures
+	RecordedAt *time.Time `json:"recorded_at,omitempty"`
+}
+
+// Returned by the Replayer for the requests that were not recorded
+type MissingFixtureError struct {
+	Method string
+	URL    string
+}
+
+func (e *MissingFixtureError) Error() string {
+	return fmt.Sprintf("no recorded response for %s %s", e.Method, e.URL)
+}
+
+// Whether err is (or wraps) MissingFixtureError
+func IsMissingFixture(err error) bool {
+	var missing *MissingFixtureError
+	return errors.As(err, &missing)
+}
+
+func bodySha256(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+func exchangeKey(method string, url string, requestBodySha256 string) string {
+	return method + " " + url + " " + requestBodySha256
+}
+
+var nonSlugChars *regexp.Regexp = regexp.MustCompile(`[^a-zA-Z0-9.]+`)
+
+func exchangeFileName(method string, host string, urlPath string, key string) string {
+	slug := strings.Trim(nonSlugChars.ReplaceAllString(host+urlPath, "-"), "-")
+	if len(slug) > 80 {
+		slug = slug[:80]
+	}
+	hash := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s_%s_%s.json", method, slug, hex.EncodeToString(hash[:4]))
+}
+
+// reads and restores the request body, so it can still be sent
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Passes the requests to the next transport, saving the exchanges to the fixture directory
+type Recorder struct {
+	dir  string
+	next http.RoundTripper
+	mu   sync.Mutex
+}
+
+func NewRecorder(dir string, next http.RoundTripper) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir, next: next}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	requestBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	exchange := &ExchangeJSON{
+		Method:            req.Method,
+		URL:               req.URL.String(),
+		RequestBodySha256: bodySha256(requestBody),
+		Status:            resp.StatusCode,
+		Header:            resp.Header.Clone(),
+	}
+	recordedAt := time.Now().UTC()
+	exchange.RecordedAt = &recordedAt
+	exchange.Header.Del("Set-Cookie")
+	if utf8.Valid(body) {
+		exchange.Body = string(body)
+	} else {
+		exchange.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+	serialized, err := json.MarshalIndent(exchange, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	key := exchangeKey(exchange.Method, exchange.URL, exchange.RequestBodySha256)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err = os.WriteFile(path.Join(r.dir, exchangeFileName(req.Method, req.URL.Host, req.URL.Path, key)), serialized, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Serves the exchanges recorded in the fixture directory, never going to the network
+type Replayer struct {
+	exchanges map[string]*ExchangeJSON
+}
+
+func NewReplayer(dir string) (*Replayer, error) {
+	r := &Replayer{exchanges: make(map[string]*ExchangeJSON)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		serialized, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var exchange ExchangeJSON
+		err = json.Unmarshal(serialized, &exchange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fixture %s: %w", entry.Name(), err)
+		}
+		r.exchanges[exchangeKey(exchange.Method, exchange.URL, exchange.RequestBodySha256)] = &exchange
+	}
+	return r, nil
+}
+
+// The number of the recorded exchanges
+func (r *Replayer) Len() int {
+	return len(r.exchanges)
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	requestBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	exchange, ok := r.exchanges[exchangeKey(req.Method, req.URL.String(), bodySha256(requestBody))]
+	if !ok {
+		return nil, &MissingFixtureError{Method: req.Method, URL: req.URL.String()}
+	}
+	body := []byte(exchange.Body)
+	if exchange.BodyBase64 != "" {
+		body, err = base64.StdEncoding.DecodeString(exchange.BodyBase64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	header := exchange.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", exchange.Status, http.StatusText(exchange.Status)),
+		StatusCode:    exchange.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,117 @@
+package httpfixture
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func roundTrip(t *testing.T, transport http.RoundTripper, method string, url string, body string) (*http.Response, []byte, error) {
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, respBody, nil
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	image := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		switch r.URL.Path {
+		case "/164971":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html>Пропала собака</html>"))
+		case "/image.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(image)
+		case "/notify":
+			reqBody, _ := io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(append([]byte("got "), reqBody...))
+		}
+	}))
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+
+	recorder, err := NewRecorder(dir, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"/164971", "/image.jpg"} {
+		if _, _, err := roundTrip(t, recorder, "GET", server.URL+url, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := roundTrip(t, recorder, "POST", server.URL+"/notify", "card 1"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 fixtures, got %d", len(entries))
+	}
+	server.Close()
+
+	replayer, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayer.Len() != 3 {
+		t.Errorf("expected 3 exchanges, got %d", replayer.Len())
+	}
+
+	resp, body, err := roundTrip(t, replayer, "GET", server.URL+"/164971", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "<html>Пропала собака</html>" || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("unexpected replayed response %q %v", body, resp.Header)
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		t.Error("cookies must not be recorded")
+	}
+
+	_, body, err = roundTrip(t, replayer, "GET", server.URL+"/image.jpg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, image) {
+		t.Errorf("binary body is not preserved: %v", body)
+	}
+
+	resp, body, err = roundTrip(t, replayer, "POST", server.URL+"/notify", "card 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted || string(body) != "got card 1" {
+		t.Errorf("unexpected replayed response %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestReplayOfMissingFixture(t *testing.T) {
+	replayer, err := NewReplayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = roundTrip(t, replayer, "GET", "https://poiskzoo.ru/164971", "")
+	if !IsMissingFixture(err) {
+		t.Errorf("expected MissingFixtureError, got %v", err)
+	}
+}
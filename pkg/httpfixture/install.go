@@ -0,0 +1,56 @@
+package httpfixture
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+)
+
+const (
+	// the responses are served from the fixtures
+	ModeReplay = "replay"
+	// the requests go to the network, the exchanges are saved to the fixtures
+	ModeRecord = "record"
+	// the requests go to the network, nothing is saved
+	ModeLive = "live"
+)
+
+// Selects the mode of the tests using the fixtures. Replay if not set.
+// The binary takes the mode from its config instead (HTTP_FIXTURES_MODE env var)
+const HTTP_FIXTURES_ENVVAR = "HTTP_FIXTURES"
+
+// Routes the requests of the client through the fixtures stored in dir.
+// In replay mode the politeness limits and the retries are disabled, as nothing goes to the network
+func Install(client *utils.Client, dir string, mode string) error {
+	switch mode {
+	case ModeReplay:
+		replayer, err := NewReplayer(dir)
+		if err != nil {
+			return err
+		}
+		client.SetTransport(replayer)
+		client.Limiter = nil
+		client.MaxAttempts = 1
+	case ModeRecord:
+		// e.g. keeping the proxies of the client
+		recorder, err := NewRecorder(dir, client.Transport())
+		if err != nil {
+			return err
+		}
+		client.SetTransport(recorder)
+	case ModeLive:
+	default:
+		return fmt.Errorf("unsupported HTTP fixtures mode %q. Expected %q, %q or %q", mode, ModeReplay, ModeRecord, ModeLive)
+	}
+	return nil
+}
+
+// Installs the fixtures into utils.DefaultClient in the mode set by HTTP_FIXTURES env var. Returns the mode
+func InstallForTests(dir string) (string, error) {
+	mode, ok := os.LookupEnv(HTTP_FIXTURES_ENVVAR)
+	if !ok {
+		mode = ModeReplay
+	}
+	return mode, Install(utils.DefaultClient, dir, mode)
+}
@@ -0,0 +1,149 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+const exifOrientationTag = 0x0112
+
+// Extracts EXIF orientation (1-8) from JPEG data. Returns 1 (normal) if it is absent or malformed
+func jpegExifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// start of scan or end of image: no more metadata segments
+			return 1
+		}
+		segmentLen := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		segmentEnd := pos + 2 + segmentLen
+		if segmentLen < 2 || segmentEnd > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : segmentEnd]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		pos = segmentEnd
+	}
+	return 1
+}
+
+// Reports whether the JPEG data (at least its part before the scan) has application (APP1-APP15) or comment segments,
+// which may carry EXIF, XMP, ICC profiles, etc. Also true if the segments can not be walked up to the scan,
+// e.g. the data is cut in the middle of them. JFIF (APP0) is not metadata
+func jpegHasMetadata(data []byte) bool {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return true
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return true
+		}
+		marker := data[pos+1]
+		if marker == 0xDA {
+			return false
+		}
+		if (marker >= 0xE1 && marker <= 0xEF) || marker == 0xFE {
+			return true
+		}
+		segmentLen := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if segmentLen < 2 {
+			return true
+		}
+		pos += 2 + segmentLen
+	}
+	return true
+}
+
+// Extracts orientation from TIFF structure (the payload of EXIF APP1 segment)
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifdOffset := int(order.Uint32(tiff[4:8]))
+	if ifdOffset+2 > len(tiff) {
+		return 1
+	}
+	entriesCount := int(order.Uint16(tiff[ifdOffset : ifdOffset+2]))
+	for i := 0; i < entriesCount; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// Transforms the image so it looks as intended when displayed without EXIF metadata.
+// see https://magnushoff.com/articles/jpeg-orientation/
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		// 90 degree rotations swap the dimensions
+		dstW, dstH = h, w
+	}
+
+	// maps the destination pixel to the source one
+	var srcOf func(x, y int) (int, int)
+	switch orientation {
+	case 2: // mirrored horizontally
+		srcOf = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3: // rotated 180
+		srcOf = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4: // mirrored vertically
+		srcOf = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5: // transposed
+		srcOf = func(x, y int) (int, int) { return y, x }
+	case 6: // needs 90 clockwise rotation
+		srcOf = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 7: // transversed
+		srcOf = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+	case 8: // needs 90 counter clockwise rotation
+		srcOf = func(x, y int) (int, int) { return w - 1 - y, x }
+	}
+
+	normalized := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(normalized, normalized.Bounds(), src, bounds.Min, draw.Src)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			sx, sy := srcOf(x, y)
+			srcOffset := normalized.PixOffset(sx, sy)
+			dstOffset := dst.PixOffset(x, y)
+			copy(dst.Pix[dstOffset:dstOffset+4], normalized.Pix[srcOffset:srcOffset+4])
+		}
+	}
+	return dst
+}
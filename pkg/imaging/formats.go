@@ -0,0 +1,141 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/webp"
+)
+
+// Image format. The value is used as file extension and as CardJSON image type
+type Format string
+
+const (
+	JPEG Format = "jpg"
+	PNG  Format = "png"
+	GIF  Format = "gif"
+	WebP Format = "webp"
+	BMP  Format = "bmp"
+	HEIC Format = "heic"
+	AVIF Format = "avif"
+)
+
+func (f Format) MimeType() string {
+	switch f {
+	case JPEG:
+		return "image/jpeg"
+	default:
+		return fmt.Sprintf("image/%s", string(f))
+	}
+}
+
+// The image can't be used. Reason is human readable and is recorded on the card
+type RejectedImageError struct {
+	Reason string
+}
+
+func (e *RejectedImageError) Error() string {
+	return fmt.Sprintf("image rejected: %s", e.Reason)
+}
+
+func reject(format string, args ...any) *RejectedImageError {
+	return &RejectedImageError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Determines the image format by its content, disregarding any declared content type
+func Sniff(data []byte) (Format, error) {
+	if len(data) == 0 {
+		return "", reject("empty content")
+	}
+	// ISO base media file format: size(4 bytes) "ftyp" major_brand(4 bytes)
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		switch string(data[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			return HEIC, nil
+		case "avif", "avis":
+			return AVIF, nil
+		}
+	}
+	detected := http.DetectContentType(data)
+	switch {
+	case detected == "image/jpeg":
+		return JPEG, nil
+	case detected == "image/png":
+		return PNG, nil
+	case detected == "image/gif":
+		return GIF, nil
+	case detected == "image/webp":
+		return WebP, nil
+	case detected == "image/bmp":
+		return BMP, nil
+	default:
+		// e.g. the image link redirects to an HTML page
+		return "", reject("not a supported image (content looks like %s)", strings.SplitN(detected, ";", 2)[0])
+	}
+}
+
+func decode(reader io.Reader, format Format) (image.Image, error) {
+	switch format {
+	case JPEG:
+		return jpeg.Decode(reader)
+	case PNG:
+		return png.Decode(reader)
+	case GIF:
+		// the first frame of animation
+		return gif.Decode(reader)
+	case WebP:
+		return webp.Decode(reader)
+	case BMP:
+		return bmp.Decode(reader)
+	case HEIC:
+		return decodeHEIC(reader)
+	default:
+		return nil, reject("%s images are not supported", format)
+	}
+}
+
+// Reads only the header of the image to get its dimensions
+func decodeConfig(reader io.Reader, format Format) (image.Config, error) {
+	switch format {
+	case JPEG:
+		return jpeg.DecodeConfig(reader)
+	case PNG:
+		return png.DecodeConfig(reader)
+	case GIF:
+		return gif.DecodeConfig(reader)
+	case WebP:
+		return webp.DecodeConfig(reader)
+	case BMP:
+		return bmp.DecodeConfig(reader)
+	case HEIC:
+		return decodeHEICConfig(reader)
+	default:
+		return image.Config{}, reject("%s images are not supported", format)
+	}
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// Encodes the image as PNG if it has transparency, otherwise as JPEG
+func encode(img image.Image) ([]byte, Format, error) {
+	var buf bytes.Buffer
+	if isOpaque(img) {
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+		return buf.Bytes(), JPEG, err
+	}
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), PNG, err
+}
@@ -0,0 +1,100 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+func testImage(width, height int, alpha uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 10), uint8(y * 10), 128, alpha})
+		}
+	}
+	return img
+}
+
+func encodeWith(t *testing.T, encode func(*bytes.Buffer) error) []byte {
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcess(t *testing.T) {
+	webpData, err := os.ReadFile("testdata/blue-purple-pink.lossy.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opaque := testImage(12, 7, 255)
+	translucent := testImage(12, 7, 100)
+
+	testCases := []struct {
+		name           string
+		data           []byte
+		originalFormat Format
+		format         Format
+		width, height  int
+	}{
+		{"jpeg", encodeWith(t, func(b *bytes.Buffer) error { return jpeg.Encode(b, opaque, nil) }), JPEG, JPEG, 12, 7},
+		{"png", encodeWith(t, func(b *bytes.Buffer) error { return png.Encode(b, translucent) }), PNG, PNG, 12, 7},
+		{"gif", encodeWith(t, func(b *bytes.Buffer) error { return gif.Encode(b, opaque, nil) }), GIF, JPEG, 12, 7},
+		{"bmp", encodeWith(t, func(b *bytes.Buffer) error { return bmp.Encode(b, opaque) }), BMP, JPEG, 12, 7},
+		{"webp", webpData, WebP, JPEG, 150, 100},
+	}
+
+	for _, testCase := range testCases {
+		normalized, err := Process(testCase.data)
+		if err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+			continue
+		}
+		if normalized.OriginalFormat != testCase.originalFormat || normalized.Format != testCase.format {
+			t.Errorf("%s: expected %s transcoded to %s, got %s to %s", testCase.name, testCase.originalFormat, testCase.format, normalized.OriginalFormat, normalized.Format)
+		}
+		if normalized.Width != testCase.width || normalized.Height != testCase.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d", testCase.name, testCase.width, testCase.height, normalized.Width, normalized.Height)
+		}
+		if sniffed, _ := Sniff(normalized.Data); sniffed != normalized.Format {
+			t.Errorf("%s: normalized data is %s while %s is declared", testCase.name, sniffed, normalized.Format)
+		}
+	}
+}
+
+func TestProcessRejects(t *testing.T) {
+	jpegData := encodeWith(t, func(b *bytes.Buffer) error { return jpeg.Encode(b, testImage(64, 64, 255), nil) })
+	heic := append([]byte("\x00\x00\x00\x18ftypheic"), make([]byte, 32)...)
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"html", []byte("<!DOCTYPE html><html><body>poiskzoo.ru</body></html>")},
+		{"heic", heic},
+		{"truncated jpeg", jpegData[:len(jpegData)/2]},
+	}
+
+	for _, testCase := range testCases {
+		_, err := Process(testCase.data)
+		var rejected *RejectedImageError
+		if !errors.As(err, &rejected) {
+			t.Errorf("%s: expected the image to be rejected, got %v", testCase.name, err)
+			continue
+		}
+		if rejected.Reason == "" {
+			t.Errorf("%s: the reason must be set", testCase.name)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+//go:build heic
+
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/jdeng/goheif"
+)
+
+// HEIC is decoded by libde265 bundled with goheif (cgo), thus it is built with the heic tag only
+
+const heicSupported = true
+
+func init() {
+	// copying the decoded pixels out of libde265, otherwise they point to the memory freed with the decoder
+	goheif.SafeEncoding = true
+}
+
+func decodeHEIC(reader io.Reader) (img image.Image, err error) {
+	// the decoder is not hardened against malformed files
+	defer func() {
+		if a := recover(); a != nil {
+			err = fmt.Errorf("heic decoder panicked: %v", a)
+		}
+	}()
+	return goheif.Decode(reader)
+}
+
+func decodeHEICConfig(reader io.Reader) (config image.Config, err error) {
+	defer func() {
+		if a := recover(); a != nil {
+			err = fmt.Errorf("heic decoder panicked: %v", a)
+		}
+	}()
+	return goheif.DecodeConfig(reader)
+}
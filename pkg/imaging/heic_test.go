@@ -0,0 +1,34 @@
+package imaging
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestProcessHEIC(t *testing.T) {
+	data, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err := Process(data)
+	if !heicSupported {
+		var rejected *RejectedImageError
+		if !errors.As(err, &rejected) {
+			t.Fatalf("expected HEIC to be rejected without the heic build tag, got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed.OriginalFormat != HEIC || processed.Format != JPEG {
+		t.Errorf("expected heic transcoded to jpg, got %s to %s", processed.OriginalFormat, processed.Format)
+	}
+	if sniffed, _ := Sniff(processed.Data); sniffed != JPEG {
+		t.Errorf("transcoded data is %s", sniffed)
+	}
+	if processed.Width == 0 || processed.Height == 0 {
+		t.Errorf("expected the dimensions to be set, got %dx%d", processed.Width, processed.Height)
+	}
+}
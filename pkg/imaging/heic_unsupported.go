@@ -0,0 +1,18 @@
+//go:build !heic
+
+package imaging
+
+import (
+	"image"
+	"io"
+)
+
+const heicSupported = false
+
+func decodeHEIC(reader io.Reader) (image.Image, error) {
+	return nil, reject("%s images are not supported by this build", HEIC)
+}
+
+func decodeHEICConfig(reader io.Reader) (image.Config, error) {
+	return image.Config{}, reject("%s images are not supported by this build", HEIC)
+}
@@ -0,0 +1,79 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// 64 bit difference hash (dHash) of the image.
+// Visually similar images (rescaled, recompressed, slightly recolored) have hashes that differ in few bits
+type PerceptualHash uint64
+
+// Images with the hashes differing in no more than this number of bits are considered near-duplicates
+const NearDuplicateDistance = 6
+
+// Computes dHash: the image is scaled down to 9x8 grayscale,
+// each bit tells whether the cell is brighter than its right neighbour
+func DifferenceHash(img image.Image) PerceptualHash {
+	const cols, rows = 9, 8
+	small := image.NewGray(image.Rect(0, 0, cols, rows))
+	// the kernel is widened when downscaling, so every source pixel contributes
+	draw.CatmullRom.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash PerceptualHash
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols-1; col++ {
+			hash <<= 1
+			if small.GrayAt(col, row).Y > small.GrayAt(col+1, row).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// Hashes with fewer set (or unset) bits carry too little information to tell the images apart.
+// Being over NearDuplicateDistance, an informative hash is never a near-duplicate of the all-zero hash of a flat image
+const minHashBitsOfEachValue = NearDuplicateDistance + 1
+
+// Reports whether the hash is too uniform to compare images by, e.g. of flat or placeholder images,
+// which would otherwise all be near-duplicates of each other
+func (h PerceptualHash) IsUninformative() bool {
+	ones := bits.OnesCount64(uint64(h))
+	return ones < minHashBitsOfEachValue || 64-ones < minHashBitsOfEachValue
+}
+
+// Computes the perceptual hash of the encoded image, e.g. the one stored before the hashes were kept
+func HashImage(data []byte) (PerceptualHash, error) {
+	format, err := Sniff(data)
+	if err != nil {
+		return 0, err
+	}
+	img, err := decode(bytes.NewReader(data), format)
+	if err != nil {
+		return 0, err
+	}
+	return DifferenceHash(img), nil
+}
+
+// Number of differing bits
+func (h PerceptualHash) Distance(other PerceptualHash) int {
+	return bits.OnesCount64(uint64(h ^ other))
+}
+
+func (h PerceptualHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+func ParsePerceptualHash(s string) (PerceptualHash, error) {
+	v, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid perceptual hash %q: %w", s, err)
+	}
+	return PerceptualHash(v), nil
+}
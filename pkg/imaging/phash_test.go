@@ -0,0 +1,106 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+func TestDifferenceHashOfRecompressedImage(t *testing.T) {
+	data, err := os.ReadFile("testdata/blue-purple-pink.lossy.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := Process(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same photo, downscaled and saved with poor quality, as it is often reposted
+	decoded, _, err := image.Decode(bytes.NewReader(original.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	smaller := image.NewRGBA(image.Rect(0, 0, 75, 50))
+	draw.BiLinear.Scale(smaller, smaller.Bounds(), decoded, decoded.Bounds(), draw.Src, nil)
+	var reposted bytes.Buffer
+	if err := jpeg.Encode(&reposted, smaller, &jpeg.Options{Quality: 40}); err != nil {
+		t.Fatal(err)
+	}
+	repost, err := Process(reposted.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := original.Hash.Distance(repost.Hash); d > NearDuplicateDistance {
+		t.Errorf("expected the repost to be a near-duplicate, distance is %d", d)
+	}
+}
+
+func TestDifferenceHashOfDifferentImages(t *testing.T) {
+	gradient := func(reversed bool) image.Image {
+		img := image.NewGray(image.Rect(0, 0, 90, 80))
+		for x := 0; x < 90; x++ {
+			for y := 0; y < 80; y++ {
+				v := uint8(x * 2)
+				if reversed {
+					v = 255 - v
+				}
+				img.SetGray(x, y, color.Gray{v})
+			}
+		}
+		return img
+	}
+
+	d := DifferenceHash(gradient(false)).Distance(DifferenceHash(gradient(true)))
+	if d <= NearDuplicateDistance {
+		t.Errorf("expected different images, distance is %d", d)
+	}
+}
+
+func TestFlatImageHashIsUninformative(t *testing.T) {
+	// e.g. a "no photo" placeholder
+	flat := &image.Gray{Pix: bytes.Repeat([]byte{200}, 640*480), Stride: 640, Rect: image.Rect(0, 0, 640, 480)}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, flat, &jpeg.Options{Quality: 50}); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashImage(encoded.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hash.IsUninformative() || !DifferenceHash(flat).IsUninformative() {
+		t.Errorf("expected the hashes of flat images to be uninformative, got %s", hash)
+	}
+
+	data, err := os.ReadFile("testdata/blue-purple-pink.lossy.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo, err := HashImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if photo.IsUninformative() {
+		t.Errorf("expected the photo hash to be informative, got %s", photo)
+	}
+}
+
+func TestPerceptualHashStringRoundTrip(t *testing.T) {
+	hash := PerceptualHash(0x00ff00ff12345678)
+	if hash.String() != "00ff00ff12345678" {
+		t.Errorf("unexpected string %s", hash)
+	}
+	parsed, err := ParsePerceptualHash(hash.String())
+	if err != nil || parsed != hash {
+		t.Errorf("expected %s, got %s (%v)", hash, parsed, err)
+	}
+	if _, err := ParsePerceptualHash("not a hash"); err == nil {
+		t.Error("expected parse error")
+	}
+}
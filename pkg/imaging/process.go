@@ -0,0 +1,210 @@
+package imaging
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+
+	"golang.org/x/image/draw"
+)
+
+// Thumbnails are squares of this size (pixels)
+const ThumbnailSize = 256
+
+// Images with more pixels are rejected, as decoding them would take too much memory:
+// up to 64MB of RGBA for each of the concurrently processed cards
+const MaxPixels = 16_000_000
+
+// the leading part of the file the format and the EXIF orientation are determined from
+const headerSize = 128 << 10
+
+// Image ready to be stored and forwarded: metadata is stripped and the orientation is normalized
+type Image struct {
+	// encoded in Format. Nil if the image is kept in the file at Path and is not loaded
+	Data []byte
+	// the downloaded file the image is kept in as is, since it needed no re-encoding. Empty if the image was re-encoded
+	Path string
+	// SHA-256 hex digest of the encoded image
+	Sha256 string
+	// of the encoded image (bytes)
+	Size   int64
+	Format Format
+	// the format the image was downloaded in
+	OriginalFormat Format
+	Width          int
+	Height         int
+	// JPEG encoded ThumbnailSize x ThumbnailSize center crop of the image
+	Thumbnail []byte
+	// to find the same photo in other cards
+	Hash PerceptualHash
+}
+
+func (i *Image) MimeType() string {
+	return i.Format.MimeType()
+}
+
+// Reads the image kept in the file into Data, e.g. to embed it into the card
+func (i *Image) Load() error {
+	if i.Data != nil || i.Path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(i.Path)
+	if err != nil {
+		return err
+	}
+	i.Data = data
+	return nil
+}
+
+// Scales the central square of the image to size x size
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	cropOrigin := image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2)
+	crop := image.Rectangle{Min: cropOrigin, Max: cropOrigin.Add(image.Pt(side, side))}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	// thumbnails are always JPEG, so transparent areas become white
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Over, nil)
+	return dst
+}
+
+// Prepares the downloaded image to be stored and forwarded.
+// The image is decoded and encoded again, which drops all of the metadata (EXIF, including GPS coordinates, comments, etc.).
+// EXIF orientation is applied to the pixels. The result is JPEG, or PNG if the image has transparency (HEIC becomes JPEG).
+// JPEG without metadata (no APP1-APP15 or comment segments) is kept byte for byte, as re-encoding it would only lose quality.
+// Returns *RejectedImageError if the content is not an image, is corrupted, is too large or its format is not supported
+// (e.g. AVIF, or HEIC if built without the heic tag)
+func Process(data []byte) (*Image, error) {
+	img, err := process(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if img.Data == nil {
+		img.Data = data
+		img.Size = int64(len(data))
+		sum := sha256.Sum256(data)
+		img.Sha256 = hex.EncodeToString(sum[:])
+	}
+	return img, nil
+}
+
+// Same as Process, but decodes the image straight from the file without reading all of it into memory.
+// digest is the SHA-256 hex digest of the file computed while downloading it, it is computed here if empty.
+// If the image is kept as is, it is not loaded: Path refers to the file, which must outlive the image
+func ProcessFile(filePath string, digest string) (*Image, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := process(f)
+	if err != nil {
+		return nil, err
+	}
+	if img.Data == nil {
+		img.Path = filePath
+		img.Size, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if digest == "" {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			hash := sha256.New()
+			if _, err := io.Copy(hash, f); err != nil {
+				return nil, err
+			}
+			digest = hex.EncodeToString(hash.Sum(nil))
+		}
+		img.Sha256 = digest
+	}
+	return img, nil
+}
+
+// Leaves Data nil if the image is to be kept as is
+func process(reader io.ReadSeeker) (*Image, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	header = header[:n]
+	format, err := Sniff(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// checking the dimensions before allocating the pixels
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	config, err := decodeConfig(reader, format)
+	if err != nil {
+		if _, isRejected := err.(*RejectedImageError); isRejected {
+			return nil, err
+		}
+		return nil, reject("corrupted %s image: %v", format, err)
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, reject("too large %s image (%dx%d)", format, config.Width, config.Height)
+	}
+
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, err := decode(reader, format)
+	if err != nil {
+		if _, isRejected := err.(*RejectedImageError); isRejected {
+			return nil, err
+		}
+		return nil, reject("corrupted %s image: %v", format, err)
+	}
+
+	// no metadata also means no EXIF orientation to apply
+	keepAsIs := format == JPEG && !jpegHasMetadata(header)
+	if format == JPEG {
+		img = applyOrientation(img, jpegExifOrientation(header))
+	}
+
+	var encoded []byte
+	var encodedFormat Format = JPEG
+	var digest string
+	if !keepAsIs {
+		encoded, encodedFormat, err = encode(img)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s image: %w", format, err)
+		}
+		sum := sha256.Sum256(encoded)
+		digest = hex.EncodeToString(sum[:])
+	}
+
+	var thumbBuf bytes.Buffer
+	err = jpeg.Encode(&thumbBuf, thumbnail(img, ThumbnailSize), &jpeg.Options{Quality: 85})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	bounds := img.Bounds()
+	return &Image{
+		Data:           encoded,
+		Sha256:         digest,
+		Size:           int64(len(encoded)),
+		Format:         encodedFormat,
+		OriginalFormat: format,
+		Width:          bounds.Dx(),
+		Height:         bounds.Dy(),
+		Thumbnail:      thumbBuf.Bytes(),
+		Hash:           DifferenceHash(img),
+	}, nil
+}
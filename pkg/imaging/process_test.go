@@ -0,0 +1,214 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Builds JPEG with EXIF APP1 segment carrying the orientation and GPS IFD pointer
+func jpegWithExif(t *testing.T, img image.Image, orientation uint16) []byte {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	// little endian TIFF with single IFD of 2 entries: orientation and GPS info pointer
+	tiff := []byte("II*\x00")
+	tiff = binary.LittleEndian.AppendUint32(tiff, 8)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 2)
+	tiff = binary.LittleEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x8825) // GPS IFD
+	tiff = binary.LittleEndian.AppendUint16(tiff, 4)      // LONG
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 0)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 0) // no next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	data := encoded.Bytes()
+	result := append([]byte{}, data[:2]...)
+	result = append(result, segment...)
+	return append(result, data[2:]...)
+}
+
+// 40x20 image: left half red, right half blue
+func halvesImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			if x < 20 {
+				img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.NRGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	return img
+}
+
+func isReddish(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xA000 && b < 0x6000
+}
+
+func TestExifOrientationIsExtracted(t *testing.T) {
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		data := jpegWithExif(t, halvesImage(), orientation)
+		if actual := jpegExifOrientation(data); actual != int(orientation) {
+			t.Errorf("expected orientation %d, got %d", orientation, actual)
+		}
+	}
+	if jpegExifOrientation([]byte("not a jpeg")) != 1 {
+		t.Error("non JPEG data must have normal orientation")
+	}
+}
+
+func TestProcessAppliesOrientationAndStripsExif(t *testing.T) {
+	// 6 means the camera was rotated, the image is to be rotated 90 clockwise for display
+	data := jpegWithExif(t, halvesImage(), 6)
+
+	processed, err := Process(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed.Width != 20 || processed.Height != 40 {
+		t.Errorf("expected rotated 20x40 image, got %dx%d", processed.Width, processed.Height)
+	}
+	if bytes.Contains(processed.Data, []byte("Exif")) {
+		t.Error("EXIF must be stripped")
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(processed.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after clockwise rotation the red left half becomes the top half
+	if !isReddish(decoded.At(10, 5)) {
+		t.Errorf("expected red at the top, got %v", decoded.At(10, 5))
+	}
+	if isReddish(decoded.At(10, 35)) {
+		t.Errorf("expected blue at the bottom, got %v", decoded.At(10, 35))
+	}
+}
+
+func TestProcessMakesThumbnail(t *testing.T) {
+	processed, err := Process(jpegWithExif(t, halvesImage(), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(processed.Thumbnail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || config.Width != ThumbnailSize || config.Height != ThumbnailSize {
+		t.Errorf("expected %dx%d jpeg thumbnail, got %dx%d %s", ThumbnailSize, ThumbnailSize, config.Width, config.Height, format)
+	}
+}
+
+func TestProcessFileAppliesOrientation(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "image")
+	if err := os.WriteFile(filePath, jpegWithExif(t, halvesImage(), 6), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := ProcessFile(filePath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromMemory, err := Process(jpegWithExif(t, halvesImage(), 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromFile.Width != fromMemory.Width || fromFile.Height != fromMemory.Height || !bytes.Equal(fromFile.Data, fromMemory.Data) {
+		t.Errorf("expected the same result as from memory, got %dx%d", fromFile.Width, fromFile.Height)
+	}
+	if fromFile.Path != "" || fromFile.Sha256 != fromMemory.Sha256 {
+		t.Errorf("expected the image with EXIF to be re-encoded, got path %q", fromFile.Path)
+	}
+}
+
+func TestProcessKeepsJpegWithoutMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, halvesImage(), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	processed, err := Process(encoded.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(processed.Data, encoded.Bytes()) || processed.Format != JPEG {
+		t.Error("expected JPEG without metadata to be kept byte for byte")
+	}
+	if processed.Width != 40 || processed.Height != 20 || len(processed.Thumbnail) == 0 {
+		t.Errorf("expected 40x20 image with thumbnail, got %dx%d", processed.Width, processed.Height)
+	}
+
+	withExif := jpegWithExif(t, halvesImage(), 1)
+	processed, err = Process(withExif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(processed.Data, withExif) {
+		t.Error("expected JPEG with EXIF to be re-encoded")
+	}
+}
+
+func TestProcessFileKeepsJpegWithoutMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, halvesImage(), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	filePath := path.Join(t.TempDir(), "image")
+	if err := os.WriteFile(filePath, encoded.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const digest = "0000000000000000000000000000000000000000000000000000000000000000"
+	processed, err := ProcessFile(filePath, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed.Path != filePath || processed.Data != nil {
+		t.Fatalf("expected the file to be kept as is, got path %q", processed.Path)
+	}
+	if processed.Sha256 != digest || processed.Size != int64(encoded.Len()) {
+		t.Errorf("expected the digest and the size of the file, got %s %d", processed.Sha256, processed.Size)
+	}
+	if processed.Width != 40 || processed.Height != 20 || len(processed.Thumbnail) == 0 {
+		t.Errorf("expected 40x20 image with thumbnail, got %dx%d", processed.Width, processed.Height)
+	}
+	if err := processed.Load(); err != nil || !bytes.Equal(processed.Data, encoded.Bytes()) {
+		t.Errorf("expected the loaded data to be the file content (%v)", err)
+	}
+}
+
+func TestProcessRejectsTooManyPixels(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := gif.Encode(&encoded, testImage(4, 4, 255), nil); err != nil {
+		t.Fatal(err)
+	}
+	// claiming 10000x10000 logical screen, the pixels are never allocated
+	data := encoded.Bytes()
+	binary.LittleEndian.PutUint16(data[6:8], 10000)
+	binary.LittleEndian.PutUint16(data[8:10], 10000)
+
+	_, err := Process(data)
+	var rejected *RejectedImageError
+	if !errors.As(err, &rejected) || !strings.Contains(rejected.Reason, "too large") {
+		t.Errorf("expected the image to be rejected as too large, got %v", err)
+	}
+}
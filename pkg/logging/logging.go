@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Attribute keys shared by all of the crawler components, so the logs can be queried by them
+const (
+	ComponentKey = "component"
+	CardIDKey    = "card_id"
+	PageKey      = "page"
+	CycleIDKey   = "cycle_id"
+	ErrorKey     = "error"
+)
+
+// Parses debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	if err != nil {
+		return slog.LevelInfo, fmt.Errorf("unsupported log level %q. Expected \"debug\", \"info\", \"warn\" or \"error\"", name)
+	}
+	return level, nil
+}
+
+// format is "json" (for log aggregation) or "text" (human-readable key=value lines)
+func NewHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	case "text":
+		return slog.NewTextHandler(w, options), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format %q. Expected \"json\" or \"text\"", format)
+	}
+}
+
+// Makes the logger writing to stderr the default one. The output of the standard "log" package goes through it as well
+func Setup(format string, levelName string) error {
+	level, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	handler, err := NewHandler(os.Stderr, format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+type loggerKey struct{}
+
+// Attaches the logger (usually carrying cycle_id, card_id or page attributes) to the context
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Returns the logger attached to the context, or the default one
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+// Logger of the component scoped with the attributes attached to the context
+func Component(ctx context.Context, component string) *slog.Logger {
+	return FromContext(ctx).With(ComponentKey, component)
+}
+
+// Adds the attributes to the logger attached to the context
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+// Logs the error and panics with the same message. Structured replacement of log.Panicf
+func Panic(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	r := slog.NewRecord(time.Time{}, slog.LevelError, msg, 0)
+	r.Add(args...)
+	var b strings.Builder
+	b.WriteString(msg)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	})
+	panic(b.String())
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestComponentLoggerCarriesContextAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := NewHandler(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithLogger(context.Background(), slog.New(handler).With(CycleIDKey, 7))
+	ctx = With(ctx, CardIDKey, 164971)
+
+	Component(ctx, "crawler").Info("Downloaded card")
+	Component(ctx, "crawler").Debug("not to be written")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "Downloaded card" || record[ComponentKey] != "crawler" || record[CardIDKey] != 164971.0 || record[CycleIDKey] != 7.0 {
+		t.Errorf("unexpected record %v", record)
+	}
+}
+
+func TestTextFormatAndLevels(t *testing.T) {
+	var buf bytes.Buffer
+	level, err := ParseLevel("debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewHandler(&buf, "text", level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(handler).Debug("Cache hit", PageKey, 2)
+	if !strings.Contains(buf.String(), "level=DEBUG msg=\"Cache hit\" page=2") {
+		t.Errorf("unexpected text output %q", buf.String())
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected unsupported level to be reported")
+	}
+	if _, err := NewHandler(&buf, "xml", level); err == nil {
+		t.Error("expected unsupported format to be reported")
+	}
+}
+
+func TestPanicCarriesAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	handler, _ := NewHandler(&buf, "json", slog.LevelInfo)
+	defer func() {
+		r := recover()
+		if r != "Failed to download card card_id=1 error=timeout" {
+			t.Errorf("unexpected panic value %v", r)
+		}
+		if !strings.Contains(buf.String(), `"level":"ERROR"`) {
+			t.Errorf("expected the error to be logged, got %q", buf.String())
+		}
+	}()
+	Panic(slog.New(handler), "Failed to download card", CardIDKey, 1, ErrorKey, errors.New("timeout"))
+}
@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "poiskzoo_crawler"
+
+// All of the crawler metrics are registered here. Served by Handler
+var Registry *prometheus.Registry = prometheus.NewRegistry()
+
+var CatalogPagesFetched prometheus.Counter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "catalog_pages_fetched_total",
+	Help:      "Number of the catalog pages fetched from poiskzoo.ru.",
+})
+
+var NewCardsFound prometheus.Counter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "new_cards_found_total",
+	Help:      "Number of the cards found in the catalog that were not downloaded before.",
+})
+
+var CardsSucceeded prometheus.Counter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "cards_succeeded_total",
+	Help:      "Number of the cards downloaded and stored successfully.",
+})
+
+// reason is the stage of the card job that failed, e.g. "card_download" or "storage"
+var CardsFailed *prometheus.CounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "cards_failed_total",
+	Help:      "Number of the card jobs failed, by the stage of the failure.",
+}, []string{"reason"})
+
+var ImageBytesDownloaded prometheus.Counter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "image_bytes_downloaded_total",
+	Help:      "Total size of the downloaded card images.",
+})
+
+// format_index is the index of the address format tried (the most specific one is 0)
+var GeocodingAttempts *prometheus.CounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "geocoding_attempts_total",
+	Help:      "Number of the geocoding attempts, by the index of the address format, the provider and the result.",
+}, []string{"format_index", "provider", "result"})
+
+// status is the HTTP status code, "error" if there is no response, or "ok" for non-HTTP notifiers
+var NotificationDuration *prometheus.HistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "notification_duration_seconds",
+	Help:      "Latency of the pipeline notification requests, by the notifier and the response status.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"notifier", "status"})
+
+var CycleDuration prometheus.Histogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "cycle_duration_seconds",
+	Help:      "Duration of the crawl cycles (catalog scan and download of the new cards).",
+	Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 3600},
+})
+
+var PollInterval prometheus.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "poll_interval_seconds",
+	Help:      "The interval the crawl cycles are started with. Cycles longer than this delay the next ones.",
+})
+
+var CyclesOverrun prometheus.Counter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "cycles_overrun_total",
+	Help:      "Number of the crawl cycles that took longer than the poll interval.",
+})
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "build_info",
+			Help:        "Always 1. The labels carry the crawler version.",
+			ConstLabels: prometheus.Labels{"version": version.AppVersion, "git_commit": version.GitCommit},
+		}, func() float64 { return 1 }),
+		CatalogPagesFetched,
+		NewCardsFound,
+		CardsSucceeded,
+		CardsFailed,
+		ImageBytesDownloaded,
+		GeocodingAttempts,
+		NotificationDuration,
+		CycleDuration,
+		PollInterval,
+		CyclesOverrun,
+	)
+}
+
+// Exposes the hit ratio and the counters of the cache
+func RegisterCache(name string, stats func() utils.CacheStats) {
+	labels := prometheus.Labels{"cache": name}
+	Registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "cache_hit_ratio",
+			Help:        "Share of the cache lookups that were hits.",
+			ConstLabels: labels,
+		}, func() float64 { return stats().HitRatio() }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "cache_hits_total",
+			Help:        "Number of the cache hits.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "cache_misses_total",
+			Help:        "Number of the cache misses.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "cache_evictions_total",
+			Help:        "Number of the entries evicted from the cache.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Evictions) }),
+	)
+}
+
+// Exposes the number of the URLs not fetched because robots.txt disallows them
+func RegisterRobotsSkips(skipped func() uint64) {
+	Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "robots_skipped_total",
+		Help:      "Number of the URLs skipped as disallowed by robots.txt.",
+	}, func() float64 { return float64(skipped()) }))
+}
+
+var proxyRequestsDesc *prometheus.Desc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "proxy_requests_total"),
+	"Number of the HTTP requests sent via the proxy (\"direct\" for the ones sent without proxy).", []string{"proxy"}, nil)
+var proxyFailuresDesc *prometheus.Desc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "proxy_failures_total"),
+	"Number of the HTTP requests failed because of the proxy.", []string{"proxy"}, nil)
+var proxyHealthyDesc *prometheus.Desc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "proxy_healthy"),
+	"1 if the proxy is in the rotation, 0 if it is excluded after failures.", []string{"proxy"}, nil)
+
+// the set of the proxies is known only at runtime, so they are collected on scrape
+type proxyCollector struct {
+	stats func() []utils.ProxyStats
+}
+
+func (c *proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- proxyRequestsDesc
+	ch <- proxyFailuresDesc
+	ch <- proxyHealthyDesc
+}
+
+func (c *proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range c.stats() {
+		var healthy float64 = 0
+		if stats.Healthy {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(proxyRequestsDesc, prometheus.CounterValue, float64(stats.Requests), stats.Proxy)
+		ch <- prometheus.MustNewConstMetric(proxyFailuresDesc, prometheus.CounterValue, float64(stats.Failures), stats.Proxy)
+		ch <- prometheus.MustNewConstMetric(proxyHealthyDesc, prometheus.GaugeValue, healthy, stats.Proxy)
+	}
+}
+
+// Exposes the usage and the health of the proxies
+func RegisterProxies(stats func() []utils.ProxyStats) {
+	Registry.MustRegister(&proxyCollector{stats: stats})
+}
+
+// Serves the metrics in Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
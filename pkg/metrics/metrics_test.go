@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+)
+
+func TestHandlerExposesCrawlerMetrics(t *testing.T) {
+	RegisterCache("test", func() utils.CacheStats { return utils.CacheStats{Hits: 3, Misses: 1} })
+	RegisterProxies(func() []utils.ProxyStats {
+		return []utils.ProxyStats{{Proxy: "socks5://proxy:1080", Requests: 5, Failures: 2, Healthy: false}}
+	})
+	CardsFailed.WithLabelValues("storage").Inc()
+	GeocodingAttempts.WithLabelValues("0", "nominatim", "ok").Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	exposed := string(body)
+
+	for _, expected := range []string{
+		`poiskzoo_crawler_cache_hit_ratio{cache="test"} 0.75`,
+		`poiskzoo_crawler_cards_failed_total{reason="storage"} 1`,
+		`poiskzoo_crawler_geocoding_attempts_total{format_index="0",provider="nominatim",result="ok"} 1`,
+		`poiskzoo_crawler_proxy_requests_total{proxy="socks5://proxy:1080"} 5`,
+		`poiskzoo_crawler_proxy_healthy{proxy="socks5://proxy:1080"} 0`,
+		`poiskzoo_crawler_catalog_pages_fetched_total 0`,
+		`poiskzoo_crawler_build_info{`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(exposed, expected) {
+			t.Errorf("expected %q in the exposed metrics", expected)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// see https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/spec.md
+
+type CloudEventsMode int
+
+const (
+	// the bare CardJSON is sent
+	NoCloudEvents CloudEventsMode = iota
+	// the CardJSON is wrapped into the CloudEvents JSON envelope
+	StructuredCloudEvents
+	// the CardJSON is sent as is, CloudEvents attributes are sent as ce-* HTTP headers
+	BinaryCloudEvents
+)
+
+func ParseCloudEventsMode(mode string) (CloudEventsMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "none":
+		return NoCloudEvents, nil
+	case "structured":
+		return StructuredCloudEvents, nil
+	case "binary":
+		return BinaryCloudEvents, nil
+	default:
+		return NoCloudEvents, fmt.Errorf("unsupported CloudEvents mode %q. Expected \"none\", \"structured\" or \"binary\"", mode)
+	}
+}
+
+const CloudEventsSpecVersion = "1.0"
+const CloudEventsSource = "https://github.com/LostPetInitiative/poiskzoo-ru-crawler"
+const CloudEventsTypePrefix = "pet.kashtanka.card."
+const CloudEventsJsonMimeType = "application/cloudevents+json"
+
+type CloudEventJSON struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Time            string          `json:"time"`
+	Subject         string          `json:"subject"`
+	DataContentType string          `json:"datacontenttype"`
+	SchemaVersion   string          `json:"schemaversion,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// Builds the CloudEvents context attributes of the notification.
+// The id is derived from the notification key and creation time, so retries of the same notification share the id
+func NewCloudEvent(n *Notification, schemaVersion string) *CloudEventJSON {
+	eventType := n.EventType
+	if eventType == "" {
+		eventType = EventNew
+	}
+	return &CloudEventJSON{
+		SpecVersion:     CloudEventsSpecVersion,
+		Type:            CloudEventsTypePrefix + eventType,
+		Source:          CloudEventsSource,
+		ID:              fmt.Sprintf("%s-%d", n.Key, n.CreatedAt.UnixNano()),
+		Time:            n.CreatedAt.UTC().Format(time.RFC3339Nano),
+		Subject:         n.Key,
+		DataContentType: "application/json",
+		SchemaVersion:   schemaVersion,
+		Data:            json.RawMessage(n.Payload),
+	}
+}
+
+// Returns the structured mode body
+func (e *CloudEventJSON) Structured() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Returns the binary mode ce-* headers
+func (e *CloudEventJSON) BinaryHeaders() map[string]string {
+	headers := map[string]string{
+		"ce-specversion": e.SpecVersion,
+		"ce-type":        e.Type,
+		"ce-source":      e.Source,
+		"ce-id":          e.ID,
+		"ce-time":        e.Time,
+		"ce-subject":     e.Subject,
+	}
+	if e.SchemaVersion != "" {
+		headers["ce-schemaversion"] = e.SchemaVersion
+	}
+	return headers
+}
@@ -0,0 +1,164 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+)
+
+// Selects the notifications a target is interested in. Empty list means "any"
+type Filter struct {
+	EventTypes []string `json:"event_types,omitempty"`
+	// "dog", "cat", "bird"
+	Species []string `json:"species,omitempty"`
+	// "lost", "found"
+	CardTypes []string `json:"card_types,omitempty"`
+}
+
+// the subset of CardJSON fields the filters look at
+type filteredFieldsJSON struct {
+	Species  string `json:"animal"`
+	CardType string `json:"card_type"`
+}
+
+func matchesAny(value string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) matches(n *Notification, fields *filteredFieldsJSON) bool {
+	eventType := n.EventType
+	if eventType == "" {
+		eventType = EventNew
+	}
+	return matchesAny(eventType, f.EventTypes) &&
+		matchesAny(fields.Species, f.Species) &&
+		matchesAny(fields.CardType, f.CardTypes)
+}
+
+type Target struct {
+	Name     string
+	Notifier Notifier
+	Filter   Filter
+}
+
+// Returned when the notification is delivered to some of the targets only.
+// Delivered lists the targets to put into Notification.DeliveredTo on retry, so only the failed targets get it again
+type PartialDeliveryError struct {
+	Delivered []string
+	Err       error
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialDeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Delivers each notification to all of the targets whose filter matches it, except the ones in Notification.DeliveredTo.
+// If some of the targets fail, PartialDeliveryError tells which of them succeeded
+type FanOutNotifier struct {
+	targets []*Target
+}
+
+func NewFanOutNotifier(targets []*Target) *FanOutNotifier {
+	return &FanOutNotifier{targets: targets}
+}
+
+func (f *FanOutNotifier) Notify(ctx context.Context, n *Notification) error {
+	var fields filteredFieldsJSON
+	err := json.Unmarshal(n.Payload, &fields)
+	if err != nil {
+		return fmt.Errorf("can't extract filtering fields from the notification payload: %w", err)
+	}
+
+	var errs []error
+	var delivered []string
+	for _, target := range f.targets {
+		if !target.Filter.matches(n, &fields) || slices.Contains(n.DeliveredTo, target.Name) {
+			continue
+		}
+		err := target.Notifier.Notify(ctx, n)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("target %s: %w", target.Name, err))
+		} else {
+			delivered = append(delivered, target.Name)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &PartialDeliveryError{Delivered: delivered, Err: errors.Join(errs...)}
+}
+
+type WebhookConfigJSON struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// "none" (default), "structured" or "binary"
+	CloudEvents string `json:"cloudevents,omitempty"`
+	// shared secret for HMAC signing
+	Secret string `json:"secret,omitempty"`
+	// name of the env var holding the shared secret. Takes precedence over Secret
+	SecretEnv string `json:"secret_env,omitempty"`
+	Filter    Filter `json:"filter"`
+}
+
+// Parses the JSON array of WebhookConfigJSON into fan-out targets
+func ParseWebhookTargets(configJSON []byte, schemaVersion string, lookupEnv func(string) (string, bool)) ([]*Target, error) {
+	var configs []WebhookConfigJSON
+	err := json.Unmarshal(configJSON, &configs)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no webhook targets are configured")
+	}
+
+	targets := make([]*Target, 0, len(configs))
+	for i, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		targetUrl, err := url.Parse(config.URL)
+		if err != nil || targetUrl.Host == "" {
+			return nil, fmt.Errorf("webhook %s: invalid url %q", name, config.URL)
+		}
+		mode, err := ParseCloudEventsMode(config.CloudEvents)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", name, err)
+		}
+		secret := config.Secret
+		if config.SecretEnv != "" {
+			envSecret, ok := lookupEnv(config.SecretEnv)
+			if !ok {
+				return nil, fmt.Errorf("webhook %s: secret env var %s is not set", name, config.SecretEnv)
+			}
+			secret = envSecret
+		}
+
+		notifier := NewHttpNotifier(targetUrl)
+		notifier.CloudEvents = mode
+		notifier.SchemaVersion = schemaVersion
+		notifier.Secret = []byte(secret)
+
+		targets = append(targets, &Target{
+			Name:     name,
+			Notifier: notifier,
+			Filter:   config.Filter,
+		})
+	}
+	return targets, nil
+}
@@ -0,0 +1,53 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+type countingNotifier struct {
+	calls int
+	err   error
+}
+
+func (n *countingNotifier) Notify(ctx context.Context, notification *Notification) error {
+	n.calls++
+	return n.err
+}
+
+func TestFanOutRetriesOnlyFailedTargets(t *testing.T) {
+	healthy := &countingNotifier{}
+	failing := &countingNotifier{err: errors.New("webhook is down")}
+	filteredOut := &countingNotifier{}
+	fanOut := NewFanOutNotifier([]*Target{
+		{Name: "healthy", Notifier: healthy},
+		{Name: "failing", Notifier: failing},
+		{Name: "cats", Notifier: filteredOut, Filter: Filter{Species: []string{"cat"}}},
+	})
+	n := &Notification{
+		Key:     "poiskzooru_1",
+		CardID:  types.CardID(1),
+		Payload: []byte(`{"animal":"dog","card_type":"lost"}`),
+	}
+
+	err := fanOut.Notify(context.Background(), n)
+	var partialErr *PartialDeliveryError
+	if !errors.As(err, &partialErr) {
+		t.Fatalf("expected PartialDeliveryError, got %v", err)
+	}
+	if len(partialErr.Delivered) != 1 || partialErr.Delivered[0] != "healthy" {
+		t.Errorf("expected the delivery to the healthy target only, got %v", partialErr.Delivered)
+	}
+
+	failing.err = nil
+	n.DeliveredTo = partialErr.Delivered
+	if err := fanOut.Notify(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	if healthy.calls != 1 || failing.calls != 2 || filteredOut.calls != 0 {
+		t.Errorf("expected 1, 2 and 0 deliveries, got %d, %d and %d", healthy.calls, failing.calls, filteredOut.calls)
+	}
+}
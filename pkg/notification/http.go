@@ -0,0 +1,63 @@
+package notification
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/metrics"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+)
+
+// POSTs the card JSON to the specified URL (e.g. kafka REST proxy or a webhook)
+type HttpNotifier struct {
+	targetUrl *url.URL
+
+	// whether and how the card JSON is wrapped into CloudEvents envelope
+	CloudEvents CloudEventsMode
+	// the version of CardJSON format, reported in CloudEvents attributes
+	SchemaVersion string
+	// if not empty, the requests are signed with HMAC-SHA256 using this shared secret
+	Secret []byte
+}
+
+func NewHttpNotifier(targetUrl *url.URL) *HttpNotifier {
+	return &HttpNotifier{targetUrl: targetUrl}
+}
+
+func (h *HttpNotifier) Notify(ctx context.Context, n *Notification) error {
+	headers := map[string]string{"Idempotency-Key": n.Key}
+	contentType := types.JsonMimeType
+	body := n.Payload
+
+	switch h.CloudEvents {
+	case StructuredCloudEvents:
+		structured, err := NewCloudEvent(n, h.SchemaVersion).Structured()
+		if err != nil {
+			return err
+		}
+		body = structured
+		contentType = CloudEventsJsonMimeType
+	case BinaryCloudEvents:
+		for k, v := range NewCloudEvent(n, h.SchemaVersion).BinaryHeaders() {
+			headers[k] = v
+		}
+	}
+
+	if len(h.Secret) > 0 {
+		now := time.Now().UTC()
+		headers[SignatureTimestampHeader] = strconv.FormatInt(now.Unix(), 10)
+		headers[SignatureHeader] = Sign(h.Secret, now, body)
+	}
+
+	start := time.Now()
+	statusCode, err := utils.HttpPostWithHeaders(ctx, h.targetUrl, contentType, body, headers)
+	var status string = "error"
+	if statusCode != nil {
+		status = strconv.Itoa(*statusCode)
+	}
+	metrics.NotificationDuration.WithLabelValues("http", status).Observe(time.Since(start).Seconds())
+	return err
+}
@@ -0,0 +1,232 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type capturedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newCapturingServer(t *testing.T) (*httptest.Server, *[]capturedRequest) {
+	captured := make([]capturedRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		captured = append(captured, capturedRequest{r.Header.Clone(), body})
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+	return server, &captured
+}
+
+var testNotification = &Notification{
+	Key:       "poiskzooru_164971",
+	CardID:    types.CardID(164971),
+	EventType: EventNew,
+	CreatedAt: time.Date(2022, 10, 18, 10, 0, 0, 0, time.UTC),
+	Payload:   []byte(`{"uid":"poiskzooru_164971","animal":"dog","card_type":"lost"}`),
+}
+
+func TestHttpNotifierPlain(t *testing.T) {
+	server, captured := newCapturingServer(t)
+	serverUrl, _ := url.Parse(server.URL)
+
+	err := NewHttpNotifier(serverUrl).Notify(context.Background(), testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := (*captured)[0]
+	if string(req.body) != string(testNotification.Payload) {
+		t.Errorf("unexpected body %s", req.body)
+	}
+	if req.header.Get("Content-Type") != types.JsonMimeType {
+		t.Errorf("unexpected content type %s", req.header.Get("Content-Type"))
+	}
+	if req.header.Get("Idempotency-Key") != "poiskzooru_164971" {
+		t.Errorf("unexpected idempotency key %s", req.header.Get("Idempotency-Key"))
+	}
+	if req.header.Get(SignatureHeader) != "" {
+		t.Error("unsigned notifier must not send the signature")
+	}
+}
+
+func TestHttpNotifierPropagatesTraceContext(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	server, captured := newCapturingServer(t)
+	serverUrl, _ := url.Parse(server.URL)
+
+	ctx, span := tracing.Start(context.Background(), "notify")
+	defer span.End()
+	err := NewHttpNotifier(serverUrl).Notify(ctx, testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traceparent := (*captured)[0].header.Get("traceparent")
+	if !strings.Contains(traceparent, span.SpanContext().TraceID().String()) {
+		t.Errorf("expected traceparent of the trace %s, got %q", span.SpanContext().TraceID(), traceparent)
+	}
+}
+
+func TestHttpNotifierStructuredCloudEventIsSigned(t *testing.T) {
+	server, captured := newCapturingServer(t)
+	serverUrl, _ := url.Parse(server.URL)
+
+	notifier := NewHttpNotifier(serverUrl)
+	notifier.CloudEvents = StructuredCloudEvents
+	notifier.SchemaVersion = "1"
+	notifier.Secret = []byte("s3cr3t")
+
+	err := notifier.Notify(context.Background(), testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := (*captured)[0]
+	if req.header.Get("Content-Type") != CloudEventsJsonMimeType {
+		t.Errorf("unexpected content type %s", req.header.Get("Content-Type"))
+	}
+
+	var event CloudEventJSON
+	err = json.Unmarshal(req.body, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.SpecVersion != "1.0" || event.Type != "pet.kashtanka.card.new" || event.Subject != "poiskzooru_164971" || event.SchemaVersion != "1" {
+		t.Errorf("unexpected event attributes %+v", event)
+	}
+	if event.Time != "2022-10-18T10:00:00Z" {
+		t.Errorf("unexpected event time %s", event.Time)
+	}
+	if string(event.Data) != string(testNotification.Payload) {
+		t.Errorf("unexpected event data %s", event.Data)
+	}
+
+	if !VerifySignature([]byte("s3cr3t"), req.header.Get(SignatureTimestampHeader), req.body, req.header.Get(SignatureHeader)) {
+		t.Error("signature must be valid")
+	}
+	if VerifySignature([]byte("wrong"), req.header.Get(SignatureTimestampHeader), req.body, req.header.Get(SignatureHeader)) {
+		t.Error("signature must not be valid with the wrong secret")
+	}
+}
+
+func TestHttpNotifierBinaryCloudEvent(t *testing.T) {
+	server, captured := newCapturingServer(t)
+	serverUrl, _ := url.Parse(server.URL)
+
+	notifier := NewHttpNotifier(serverUrl)
+	notifier.CloudEvents = BinaryCloudEvents
+
+	err := notifier.Notify(context.Background(), testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := (*captured)[0]
+	if string(req.body) != string(testNotification.Payload) {
+		t.Errorf("binary mode must send the bare payload, got %s", req.body)
+	}
+	if req.header.Get("ce-specversion") != "1.0" || req.header.Get("ce-type") != "pet.kashtanka.card.new" {
+		t.Errorf("unexpected ce headers %v", req.header)
+	}
+	expectedID := NewCloudEvent(testNotification, "").ID
+	if req.header.Get("ce-id") != expectedID {
+		t.Errorf("expected ce-id %s, got %s", expectedID, req.header.Get("ce-id"))
+	}
+}
+
+type recordingNotifier struct {
+	keys []string
+	err  error
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, n *Notification) error {
+	r.keys = append(r.keys, n.Key)
+	return r.err
+}
+
+func TestFanOutFilters(t *testing.T) {
+	all := &recordingNotifier{}
+	catsOnly := &recordingNotifier{}
+	foundDogs := &recordingNotifier{}
+	closedOnly := &recordingNotifier{}
+
+	fanOut := NewFanOutNotifier([]*Target{
+		{Name: "all", Notifier: all},
+		{Name: "cats", Notifier: catsOnly, Filter: Filter{Species: []string{"cat"}}},
+		{Name: "found dogs", Notifier: foundDogs, Filter: Filter{Species: []string{"dog"}, CardTypes: []string{"found"}}},
+		{Name: "closed", Notifier: closedOnly, Filter: Filter{EventTypes: []string{EventClosed}}},
+	})
+
+	err := fanOut.Notify(context.Background(), testNotification) // lost dog, new
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.keys) != 1 || len(catsOnly.keys) != 0 || len(foundDogs.keys) != 0 || len(closedOnly.keys) != 0 {
+		t.Errorf("unexpected deliveries: all %v, cats %v, found dogs %v, closed %v", all.keys, catsOnly.keys, foundDogs.keys, closedOnly.keys)
+	}
+}
+
+func TestFanOutReportsFailedTargets(t *testing.T) {
+	failing := &recordingNotifier{err: errors.New("down")}
+	ok := &recordingNotifier{}
+	fanOut := NewFanOutNotifier([]*Target{
+		{Name: "failing", Notifier: failing},
+		{Name: "ok", Notifier: ok},
+	})
+
+	err := fanOut.Notify(context.Background(), testNotification)
+	if err == nil {
+		t.Fatal("expected the failure to be reported")
+	}
+	if len(ok.keys) != 1 {
+		t.Error("healthy target must still be notified")
+	}
+}
+
+func TestParseWebhookTargets(t *testing.T) {
+	config := []byte(`[
+		{"name": "pipeline", "url": "https://pipeline.example/cards", "cloudevents": "binary", "secret_env": "PIPELINE_SECRET"},
+		{"url": "https://cats.example/hook", "filter": {"species": ["cat"]}}
+	]`)
+	lookupEnv := func(name string) (string, bool) {
+		if name == "PIPELINE_SECRET" {
+			return "abc", true
+		}
+		return "", false
+	}
+
+	targets, err := ParseWebhookTargets(config, "1", lookupEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(targets))
+	}
+	pipeline := targets[0].Notifier.(*HttpNotifier)
+	if pipeline.CloudEvents != BinaryCloudEvents || string(pipeline.Secret) != "abc" {
+		t.Errorf("unexpected pipeline notifier config %+v", pipeline)
+	}
+	if targets[1].Name != "#1" || targets[1].Filter.Species[0] != "cat" {
+		t.Errorf("unexpected second target %+v", targets[1])
+	}
+
+	_, err = ParseWebhookTargets([]byte(`[{"url": "https://x.example", "secret_env": "MISSING"}]`), "1", lookupEnv)
+	if err == nil {
+		t.Error("missing secret env var must be reported")
+	}
+}
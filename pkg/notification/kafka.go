@@ -0,0 +1,89 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/metrics"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/version"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const SchemaVersionKafkaHeader = "schema-version"
+const CrawlerVersionKafkaHeader = "crawler-version"
+
+// Produces the card JSON directly to the kafka topic. The record key is the card uid
+type KafkaNotifier struct {
+	client        *kgo.Client
+	topic         string
+	schemaVersion string
+}
+
+// Parses compression codec name: none, gzip, snappy, lz4 or zstd
+func ParseKafkaCompression(name string) (kgo.CompressionCodec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return kgo.NoCompression(), nil
+	case "gzip":
+		return kgo.GzipCompression(), nil
+	case "snappy":
+		return kgo.SnappyCompression(), nil
+	case "lz4":
+		return kgo.Lz4Compression(), nil
+	case "zstd":
+		return kgo.ZstdCompression(), nil
+	default:
+		return kgo.NoCompression(), fmt.Errorf("unsupported kafka compression codec: %q", name)
+	}
+}
+
+// schemaVersion is the version of the CardJSON format carried in the record payload
+func NewKafkaNotifier(brokers []string, topic string, compression kgo.CompressionCodec, schemaVersion string) (*KafkaNotifier, error) {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.DefaultProduceTopic(topic),
+		kgo.ProducerBatchCompression(compression),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaNotifier{
+		client:        client,
+		topic:         topic,
+		schemaVersion: schemaVersion,
+	}, nil
+}
+
+func (k *KafkaNotifier) Notify(ctx context.Context, n *Notification) error {
+	record := &kgo.Record{
+		Topic: k.topic,
+		Key:   []byte(n.Key),
+		Value: n.Payload,
+		Headers: []kgo.RecordHeader{
+			{Key: SchemaVersionKafkaHeader, Value: []byte(k.schemaVersion)},
+			{Key: CrawlerVersionKafkaHeader, Value: []byte(version.AppVersion)},
+		},
+	}
+	// the trace context goes in the record headers, the same way as in the HTTP notifications
+	traceContext := make(map[string]string)
+	tracing.Inject(ctx, traceContext)
+	for k, v := range traceContext {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+	}
+	start := time.Now()
+	err := k.client.ProduceSync(ctx, record).FirstErr()
+	var status string = "ok"
+	if err != nil {
+		status = "error"
+	}
+	metrics.NotificationDuration.WithLabelValues("kafka", status).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (k *KafkaNotifier) Close() {
+	k.client.Close()
+}
@@ -0,0 +1,87 @@
+package notification
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/version"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestKafkaNotifierProducesToFakeBroker(t *testing.T) {
+	const topic = "cards"
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+
+	notifier, err := NewKafkaNotifier(cluster.ListenAddrs(), topic, kgo.ZstdCompression(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifier.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = notifier.Notify(ctx, &Notification{
+		Key:     "poiskzooru_164971",
+		CardID:  types.CardID(164971),
+		Payload: []byte(`{"uid":"poiskzooru_164971"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+
+	fetches := consumer.PollFetches(ctx)
+	if errs := fetches.Errors(); len(errs) > 0 {
+		t.Fatalf("consuming failed: %v", errs)
+	}
+	records := fetches.Records()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	record := records[0]
+	if string(record.Key) != "poiskzooru_164971" {
+		t.Errorf("unexpected key %q", record.Key)
+	}
+	if string(record.Value) != `{"uid":"poiskzooru_164971"}` {
+		t.Errorf("unexpected value %q", record.Value)
+	}
+
+	headers := make(map[string]string)
+	for _, h := range record.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	if headers[SchemaVersionKafkaHeader] != "1" {
+		t.Errorf("unexpected schema version header %q", headers[SchemaVersionKafkaHeader])
+	}
+	if headers[CrawlerVersionKafkaHeader] != version.AppVersion {
+		t.Errorf("unexpected crawler version header %q", headers[CrawlerVersionKafkaHeader])
+	}
+}
+
+func TestParseKafkaCompression(t *testing.T) {
+	for _, name := range []string{"", "none", "gzip", "snappy", "lz4", "ZSTD"} {
+		if _, err := ParseKafkaCompression(name); err != nil {
+			t.Errorf("%q must be supported: %v", name, err)
+		}
+	}
+	if _, err := ParseKafkaCompression("brotli"); err == nil {
+		t.Error("brotli must not be supported")
+	}
+}
@@ -0,0 +1,35 @@
+package notification
+
+import (
+	"context"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+// What happened to the card
+const (
+	EventNew     = "new"
+	EventUpdated = "updated"
+	EventClosed  = "closed"
+)
+
+type Notification struct {
+	// Idempotency key. The card uid
+	Key    string
+	CardID types.CardID
+	// one of EventNew, EventUpdated, EventClosed
+	EventType string
+	// when the notification was enqueued. Stays the same across delivery retries
+	CreatedAt time.Time
+	// serialized CardJSON
+	Payload []byte
+	// names of the FanOutNotifier targets the notification is already delivered to, they are skipped
+	DeliveredTo []string
+}
+
+// Delivers the card notifications to the pipeline
+type Notifier interface {
+	// Must be idempotent regarding the notification Key
+	Notify(ctx context.Context, n *Notification) error
+}
@@ -0,0 +1,34 @@
+package notification
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const SignatureHeader = "X-Kashtanka-Signature"
+const SignatureTimestampHeader = "X-Kashtanka-Timestamp"
+
+// Computes HMAC-SHA256 over "<timestamp>.<body>" with the shared secret.
+// Including the timestamp lets the receivers reject replayed requests.
+// Returns the value for the SignatureHeader in the form "sha256=<hex>"
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Checks the signature produced by Sign. To be used by the receivers (and tests)
+func VerifySignature(secret []byte, timestampHeader string, body []byte, signatureHeader string) bool {
+	unix, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return false
+	}
+	expected := Sign(secret, time.Unix(unix, 0), body)
+	return hmac.Equal([]byte(expected), []byte(signatureHeader))
+}
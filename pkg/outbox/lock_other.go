@@ -0,0 +1,16 @@
+//go:build !unix
+
+package outbox
+
+import "os"
+
+const fileLocksSupported = false
+
+// No advisory locks here, the replay command must not run alongside the crawler
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
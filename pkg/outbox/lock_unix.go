@@ -0,0 +1,19 @@
+//go:build unix
+
+package outbox
+
+import (
+	"os"
+	"syscall"
+)
+
+const fileLocksSupported = true
+
+// Blocks until the exclusive advisory lock of the file is acquired
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
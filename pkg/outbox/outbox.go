@@ -0,0 +1,368 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+// Transactional outbox for pipeline notifications.
+// The notification of the card is durably enqueued here before the card is saved to the storage,
+// so a crash in between may cause a repeated notification (with the same key) but never a lost one.
+// The Sender delivers the enqueued notifications in background, retrying the failed ones.
+//
+// Directory layout:
+//   pending/<key>.json   - metadata of not yet delivered notifications
+//   delivered/<key>.json - metadata of delivered notifications (kept for replays until pruned)
+//   payloads/<key>.json  - the notification bodies
+//   lock                 - locked during the state transitions, as the replay command changes the entries from another process
+
+const pendingDir = "pending"
+const deliveredDir = "delivered"
+const payloadsDir = "payloads"
+const lockFileName = "lock"
+
+type Entry struct {
+	// Idempotency key of the notification. The card uid
+	Key    string       `json:"key"`
+	CardID types.CardID `json:"card_id"`
+	// what happened to the card, e.g. "new"
+	EventType     string     `json:"event_type"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	// the targets that already got the notification, when it is delivered to several of them. Retries skip them
+	DeliveredTo []string `json:"delivered_to,omitempty"`
+	// W3C trace context of the span that enqueued the notification, so the delivery joins its trace
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+type Outbox struct {
+	dir string
+	// serializes state transitions of the entries within the process
+	mutex sync.Mutex
+	// serializes them across the processes sharing the dir
+	lockFile *os.File
+	// signals the sender that there is something new to deliver
+	wakeUp chan struct{}
+}
+
+// Opens (creating if needed) the outbox stored in the specified directory
+func NewDirectoryOutbox(dir string) (*Outbox, error) {
+	for _, sub := range []string{pendingDir, deliveredDir, payloadsDir} {
+		err := os.MkdirAll(path.Join(dir, sub), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lockFile, err := os.OpenFile(path.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Outbox{
+		dir:      dir,
+		lockFile: lockFile,
+		wakeUp:   make(chan struct{}, 1),
+	}, nil
+}
+
+func (o *Outbox) lock() error {
+	o.mutex.Lock()
+	err := lockFile(o.lockFile)
+	if err != nil {
+		o.mutex.Unlock()
+		return fmt.Errorf("failed to lock the outbox: %w", err)
+	}
+	return nil
+}
+
+func (o *Outbox) unlock() {
+	unlockFile(o.lockFile)
+	o.mutex.Unlock()
+}
+
+func (o *Outbox) entryPath(state string, key string) string {
+	return path.Join(o.dir, state, fmt.Sprintf("%s.json", key))
+}
+
+// writes the file atomically, so a crash never leaves a partially written file
+func writeFileAtomically(filePath string, data []byte) error {
+	tmpPath := filePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+func (o *Outbox) writeEntry(state string, entry *Entry) error {
+	serialized, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(o.entryPath(state, entry.Key), serialized)
+}
+
+func (o *Outbox) readEntry(filePath string) (*Entry, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var entry Entry
+	err = json.Unmarshal(content, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted outbox entry %s: %w", filePath, err)
+	}
+	return &entry, nil
+}
+
+func (o *Outbox) listEntries(state string) ([]*Entry, error) {
+	dirEntries, err := os.ReadDir(path.Join(o.dir, state))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Entry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+		entry, err := o.readEntry(path.Join(o.dir, state, dirEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return res, nil
+}
+
+// Durably stores the notification. Enqueueing the same key again overwrites the previous notification and makes it pending
+func (o *Outbox) Enqueue(ctx context.Context, key string, card types.CardID, eventType string, payload []byte) error {
+	if err := o.lock(); err != nil {
+		return err
+	}
+	defer o.unlock()
+
+	// payload goes first, so a pending entry never points to the missing payload
+	err := writeFileAtomically(path.Join(o.dir, payloadsDir, fmt.Sprintf("%s.json", key)), payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	traceContext := make(map[string]string)
+	tracing.Inject(ctx, traceContext)
+	err = o.writeEntry(pendingDir, &Entry{
+		Key:           key,
+		CardID:        card,
+		EventType:     eventType,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		TraceContext:  traceContext,
+	})
+	if err != nil {
+		return err
+	}
+	err = os.Remove(o.entryPath(deliveredDir, key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	o.signal()
+	return nil
+}
+
+func (o *Outbox) signal() {
+	select {
+	case o.wakeUp <- struct{}{}:
+	default:
+		// the sender is already signaled
+	}
+}
+
+// Returns the notification body
+func (o *Outbox) Payload(entry *Entry) ([]byte, error) {
+	return os.ReadFile(path.Join(o.dir, payloadsDir, fmt.Sprintf("%s.json", entry.Key)))
+}
+
+// Returns all of the not yet delivered entries, the oldest first
+func (o *Outbox) Pending() ([]*Entry, error) {
+	if err := o.lock(); err != nil {
+		return nil, err
+	}
+	defer o.unlock()
+	return o.listEntries(pendingDir)
+}
+
+// Returns all of the delivered entries, the oldest first
+func (o *Outbox) Delivered() ([]*Entry, error) {
+	if err := o.lock(); err != nil {
+		return nil, err
+	}
+	defer o.unlock()
+	return o.listEntries(deliveredDir)
+}
+
+func (o *Outbox) MarkDelivered(entry *Entry) error {
+	if err := o.lock(); err != nil {
+		return err
+	}
+	defer o.unlock()
+
+	now := time.Now().UTC()
+	entry.Attempts++
+	entry.DeliveredAt = &now
+	entry.LastError = ""
+	err := o.writeEntry(deliveredDir, entry)
+	if err != nil {
+		return err
+	}
+	current, err := o.readEntry(o.entryPath(pendingDir, entry.Key))
+	if err == nil && !current.CreatedAt.Equal(entry.CreatedAt) {
+		// the same key was enqueued again during the delivery. The newer notification is still to be delivered
+		return nil
+	}
+	return os.Remove(o.entryPath(pendingDir, entry.Key))
+}
+
+func (o *Outbox) MarkFailed(entry *Entry, deliveryErr error, nextAttemptAt time.Time) error {
+	if err := o.lock(); err != nil {
+		return err
+	}
+	defer o.unlock()
+
+	current, err := o.readEntry(o.entryPath(pendingDir, entry.Key))
+	if err == nil && current.CreatedAt.After(entry.CreatedAt) {
+		// the same key was enqueued again during the delivery. The newer notification is not to be overwritten
+		return nil
+	}
+	entry.Attempts++
+	entry.LastError = deliveryErr.Error()
+	entry.NextAttemptAt = nextAttemptAt
+	return o.writeEntry(pendingDir, entry)
+}
+
+// Makes the entries created within [from, to) pending again, so they are delivered once more.
+// If includeDelivered is false only the undelivered entries are rescheduled for immediate delivery.
+// Returns the number of rescheduled entries
+func (o *Outbox) Replay(from, to time.Time, includeDelivered bool) (int, error) {
+	if err := o.lock(); err != nil {
+		return 0, err
+	}
+	defer o.unlock()
+
+	inRange := func(e *Entry) bool {
+		return !e.CreatedAt.Before(from) && e.CreatedAt.Before(to)
+	}
+
+	now := time.Now().UTC()
+	count := 0
+
+	pending, err := o.listEntries(pendingDir)
+	if err != nil {
+		return count, err
+	}
+	for _, entry := range pending {
+		if !inRange(entry) {
+			continue
+		}
+		entry.NextAttemptAt = now
+		err = o.writeEntry(pendingDir, entry)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if includeDelivered {
+		delivered, err := o.listEntries(deliveredDir)
+		if err != nil {
+			return count, err
+		}
+		for _, entry := range delivered {
+			if !inRange(entry) {
+				continue
+			}
+			entry.NextAttemptAt = now
+			entry.DeliveredAt = nil
+			// replaying to all of the targets
+			entry.DeliveredTo = nil
+			err = o.writeEntry(pendingDir, entry)
+			if err != nil {
+				return count, err
+			}
+			err = os.Remove(o.entryPath(deliveredDir, entry.Key))
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	if count > 0 {
+		o.signal()
+	}
+	return count, nil
+}
+
+// Removes the entries delivered before the specified time along with their payloads, so they can't be replayed any more.
+// Returns the number of removed entries
+func (o *Outbox) Prune(deliveredBefore time.Time) (int, error) {
+	if err := o.lock(); err != nil {
+		return 0, err
+	}
+	defer o.unlock()
+
+	delivered, err := o.listEntries(deliveredDir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range delivered {
+		if entry.DeliveredAt == nil || !entry.DeliveredAt.Before(deliveredBefore) {
+			continue
+		}
+		_, err = os.Stat(o.entryPath(pendingDir, entry.Key))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			err = os.Remove(path.Join(o.dir, payloadsDir, fmt.Sprintf("%s.json", entry.Key)))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return count, err
+			}
+		case err != nil:
+			return count, err
+		default:
+			// the same key is enqueued again, the payload is still to be delivered
+		}
+		err = os.Remove(o.entryPath(deliveredDir, entry.Key))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
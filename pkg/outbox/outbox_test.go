@@ -0,0 +1,302 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+func newTestSender(t *testing.T, deliver DeliverFunc) (*Outbox, *Sender) {
+	o, err := NewDirectoryOutbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSender(o, deliver)
+	s.MinBackoff = time.Millisecond
+	s.MaxBackoff = time.Millisecond
+	return o, s
+}
+
+func TestEnqueuedNotificationIsDelivered(t *testing.T) {
+	var deliveredKeys []string
+	var deliveredPayloads []string
+	o, s := newTestSender(t, func(ctx context.Context, entry *Entry, payload []byte) error {
+		deliveredKeys = append(deliveredKeys, entry.Key)
+		deliveredPayloads = append(deliveredPayloads, string(payload))
+		return nil
+	})
+
+	err := o.Enqueue(context.Background(), "poiskzooru_1", types.CardID(1), "new", []byte(`{"uid":"poiskzooru_1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := s.DeliverDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(deliveredKeys) != 1 || deliveredKeys[0] != "poiskzooru_1" {
+		t.Fatalf("expected poiskzooru_1 to be delivered once, got %v", deliveredKeys)
+	}
+	if deliveredPayloads[0] != `{"uid":"poiskzooru_1"}` {
+		t.Errorf("unexpected payload %s", deliveredPayloads[0])
+	}
+
+	pending, _ := o.Pending()
+	if len(pending) != 0 {
+		t.Errorf("expected no pending entries, got %d", len(pending))
+	}
+	delivered, _ := o.Delivered()
+	if len(delivered) != 1 || delivered[0].DeliveredAt == nil {
+		t.Errorf("expected the delivered entry to be recorded")
+	}
+}
+
+func TestFailedDeliveryIsRetried(t *testing.T) {
+	attempts := 0
+	o, s := newTestSender(t, func(ctx context.Context, entry *Entry, payload []byte) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("pipeline is down")
+		}
+		return nil
+	})
+
+	err := o.Enqueue(context.Background(), "poiskzooru_2", types.CardID(2), "new", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(5 * time.Millisecond) // letting the backoff pass
+		if _, err := s.DeliverDue(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			pending, _ := o.Pending()
+			if len(pending) != 1 || pending[0].Attempts != i+1 || pending[0].LastError != "pipeline is down" {
+				t.Fatalf("expected the entry to stay pending after failed attempt %d, got %+v", i+1, pending)
+			}
+		}
+	}
+
+	pending, _ := o.Pending()
+	if len(pending) != 0 {
+		t.Errorf("expected the entry to be delivered on the third attempt")
+	}
+	delivered, _ := o.Delivered()
+	if len(delivered) != 1 || delivered[0].Attempts != 3 {
+		t.Errorf("expected the delivered entry with 3 attempts, got %+v", delivered)
+	}
+}
+
+func TestFailedDeliveryKeepsReenqueuedNotification(t *testing.T) {
+	var o *Outbox
+	o, s := newTestSender(t, func(ctx context.Context, entry *Entry, payload []byte) error {
+		// the card is enqueued again while the previous notification of it is being delivered
+		time.Sleep(time.Millisecond)
+		if err := o.Enqueue(ctx, "poiskzooru_4", types.CardID(4), "new", []byte(`{"v":2}`)); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("pipeline is down")
+	})
+
+	err := o.Enqueue(context.Background(), "poiskzooru_4", types.CardID(4), "new", []byte(`{"v":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueued, _ := o.Pending()
+	if _, err := s.DeliverDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, _ := o.Pending()
+	if len(pending) != 1 || !pending[0].CreatedAt.After(enqueued[0].CreatedAt) || pending[0].Attempts != 0 || pending[0].LastError != "" {
+		t.Fatalf("expected the newer notification to stay pending untouched, got %+v", pending)
+	}
+	payload, _ := o.Payload(pending[0])
+	if string(payload) != `{"v":2}` {
+		t.Errorf("expected the newer payload, got %s", payload)
+	}
+}
+
+func TestOutboxIsLockedAcrossInstances(t *testing.T) {
+	if !fileLocksSupported {
+		t.Skip("no file locks on this platform")
+	}
+	dir := t.TempDir()
+	first, err := NewDirectoryOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// e.g. the replay command
+	second, err := NewDirectoryOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.lock(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		second.Pending()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the second instance to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second instance to proceed after the unlock")
+	}
+}
+
+func TestDeliveredTargetsAreKeptForRetry(t *testing.T) {
+	var deliveredTo [][]string
+	o, s := newTestSender(t, func(ctx context.Context, entry *Entry, payload []byte) error {
+		deliveredTo = append(deliveredTo, append([]string{}, entry.DeliveredTo...))
+		if len(entry.DeliveredTo) == 0 {
+			entry.DeliveredTo = append(entry.DeliveredTo, "healthy")
+			return errors.New("target failing: webhook is down")
+		}
+		return nil
+	})
+
+	before := time.Now().UTC()
+	if err := o.Enqueue(context.Background(), "poiskzooru_1", types.CardID(1), "new", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		time.Sleep(5 * time.Millisecond) // letting the backoff pass
+		if _, err := s.DeliverDue(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deliveredTo) != 2 || len(deliveredTo[1]) != 1 || deliveredTo[1][0] != "healthy" {
+		t.Fatalf("expected the retry to know about the delivered target, got %v", deliveredTo)
+	}
+
+	// replaying the delivered notification goes to all of the targets again
+	if _, err := o.Replay(before, time.Now().UTC().Add(time.Second), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeliverDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveredTo) != 3 || len(deliveredTo[2]) != 0 {
+		t.Errorf("expected the replay to go to all of the targets, got %v", deliveredTo)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	deliveries := 0
+	o, s := newTestSender(t, func(ctx context.Context, entry *Entry, payload []byte) error {
+		deliveries++
+		return nil
+	})
+
+	before := time.Now().UTC()
+	for _, id := range []types.CardID{1, 2} {
+		if err := o.Enqueue(context.Background(), fmt.Sprintf("poiskzooru_%d", id), id, "new", []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.DeliverDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// only undelivered: nothing to replay
+	count, err := o.Replay(before, time.Now().UTC().Add(time.Second), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected nothing to replay, got %d", count)
+	}
+
+	// out of range
+	count, _ = o.Replay(before.Add(-time.Hour), before, true)
+	if count != 0 {
+		t.Errorf("expected nothing to replay out of the range, got %d", count)
+	}
+
+	count, err = o.Replay(before, time.Now().UTC().Add(time.Second), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 replayed notifications, got %d", count)
+	}
+	if _, err := s.DeliverDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if deliveries != 4 {
+		t.Errorf("expected 4 deliveries in total, got %d", deliveries)
+	}
+}
+
+func TestPruneRemovesExpiredDeliveredEntries(t *testing.T) {
+	o, s := newTestSender(t, func(ctx context.Context, entry *Entry, payload []byte) error {
+		return nil
+	})
+	for _, id := range []types.CardID{1, 2} {
+		if err := o.Enqueue(context.Background(), fmt.Sprintf("poiskzooru_%d", id), id, "new", []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.DeliverDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Enqueue(context.Background(), "poiskzooru_3", types.CardID(3), "new", []byte(`{"uid":"poiskzooru_3"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := o.Prune(time.Now().UTC().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected the recently delivered entries to be kept, got %d pruned", count)
+	}
+
+	count, err = o.Prune(time.Now().UTC().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 pruned entries, got %d", count)
+	}
+	delivered, _ := o.Delivered()
+	if len(delivered) != 0 {
+		t.Errorf("expected no delivered entries after pruning, got %d", len(delivered))
+	}
+	if _, err := o.Payload(&Entry{Key: "poiskzooru_1"}); err == nil {
+		t.Error("expected the payload of the pruned entry to be removed")
+	}
+	pending, _ := o.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("expected the pending entry to be kept, got %d", len(pending))
+	}
+	if payload, err := o.Payload(pending[0]); err != nil || string(payload) != `{"uid":"poiskzooru_3"}` {
+		t.Errorf("expected the payload of the pending entry to be kept, got %q, %v", payload, err)
+	}
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	s := NewSender(nil, nil)
+	for attempts := 1; attempts < 100; attempts++ {
+		d := s.backoff(attempts)
+		if d > s.MaxBackoff || d < s.MinBackoff/2 {
+			t.Fatalf("backoff %v for %d attempts is out of [%v, %v]", d, attempts, s.MinBackoff/2, s.MaxBackoff)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package outbox
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Delivers the notification somewhere. Must be idempotent regarding entry.Key.
+// On partial failure it may record the targets that got the notification in entry.DeliveredTo, it is stored for the retry
+type DeliverFunc func(ctx context.Context, entry *Entry, payload []byte) error
+
+// Delivers pending outbox entries in background, retrying failed deliveries with exponential backoff
+type Sender struct {
+	outbox  *Outbox
+	deliver DeliverFunc
+
+	// how often the outbox is checked for the entries due to delivery
+	PollInterval time.Duration
+	// the delay before the first retry
+	MinBackoff time.Duration
+	// the upper bound of the delay between retries
+	MaxBackoff time.Duration
+	// how long the delivered entries are kept for replays. 0 means forever
+	Retention time.Duration
+
+	lastPruneAt time.Time
+}
+
+// how often Run prunes the delivered entries
+const pruneInterval = time.Hour
+
+func NewSender(outbox *Outbox, deliver DeliverFunc) *Sender {
+	return &Sender{
+		outbox:       outbox,
+		deliver:      deliver,
+		PollInterval: 10 * time.Second,
+		MinBackoff:   5 * time.Second,
+		MaxBackoff:   10 * time.Minute,
+	}
+}
+
+// Returns the delay before the next attempt after the specified number of failed attempts.
+// The delay is doubled with each attempt and jittered within [50%, 100%] of its value
+func (s *Sender) backoff(failedAttempts int) time.Duration {
+	delay := s.MinBackoff
+	for i := 1; i < failedAttempts && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxBackoff {
+		delay = s.MaxBackoff
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Delivers all of the entries that are due. Returns the number of delivered entries
+func (s *Sender) DeliverDue(ctx context.Context) (int, error) {
+	pending, err := s.outbox.Pending()
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, entry := range pending {
+		if ctx.Err() != nil {
+			return delivered, ctx.Err()
+		}
+		now := time.Now().UTC()
+		if entry.NextAttemptAt.After(now) {
+			continue
+		}
+		payload, err := s.outbox.Payload(entry)
+		if err != nil {
+			return delivered, err
+		}
+		entryCtx := logging.With(ctx, logging.CardIDKey, entry.CardID)
+		// the delivery is traced as a part of the card job that enqueued the notification
+		entryCtx, span := tracing.Start(tracing.Extract(entryCtx, entry.TraceContext), "notify",
+			attribute.Int(logging.CardIDKey, int(entry.CardID)),
+			attribute.Int("attempt", entry.Attempts+1))
+		logger := logging.Component(entryCtx, "outbox")
+		deliveryErr := s.deliver(entryCtx, entry, payload)
+		tracing.End(span, deliveryErr)
+		if deliveryErr != nil {
+			nextAttemptAt := now.Add(s.backoff(entry.Attempts + 1))
+			logger.Warn("Failed to deliver notification", "attempt", entry.Attempts+1, "next_attempt_at", nextAttemptAt, logging.ErrorKey, deliveryErr)
+			err = s.outbox.MarkFailed(entry, deliveryErr, nextAttemptAt)
+		} else {
+			logger.Info("Successfully notified the pipeline", "attempt", entry.Attempts+1)
+			err = s.outbox.MarkDelivered(entry)
+			delivered++
+		}
+		if err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// Removes the entries delivered longer than Retention ago. Returns the number of removed entries
+func (s *Sender) PruneExpired(ctx context.Context) (int, error) {
+	if s.Retention <= 0 {
+		return 0, nil
+	}
+	s.lastPruneAt = time.Now().UTC()
+	pruned, err := s.outbox.Prune(s.lastPruneAt.Add(-s.Retention))
+	if pruned > 0 {
+		logging.Component(ctx, "outbox").Info("Pruned delivered notifications", "count", pruned, "retention", s.Retention)
+	}
+	return pruned, err
+}
+
+// Delivers the entries until the context is cancelled, pruning the expired ones hourly
+func (s *Sender) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		_, err := s.DeliverDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			logging.Component(ctx, "outbox").Error("Outbox sender failure", logging.ErrorKey, err)
+		}
+		if time.Since(s.lastPruneAt) >= pruneInterval {
+			_, err = s.PruneExpired(ctx)
+			if err != nil {
+				logging.Component(ctx, "outbox").Error("Failed to prune delivered notifications", logging.ErrorKey, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.outbox.wakeUp:
+		}
+	}
+}
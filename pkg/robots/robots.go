@@ -0,0 +1,156 @@
+package robots
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// robots.txt parser (see RFC 9309) with the widely supported Crawl-delay extension
+
+type rule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// The rules of robots.txt group applicable to the crawler
+type Rules struct {
+	rules      []rule
+	crawlDelay time.Duration
+}
+
+// Rules allowing everything, e.g. when robots.txt does not exist
+func AllowAll() *Rules {
+	return &Rules{}
+}
+
+// Rules disallowing everything, e.g. when robots.txt is unreachable
+func DisallowAll() *Rules {
+	return &Rules{rules: []rule{{allow: false, pattern: "/", re: compilePattern("/")}}}
+}
+
+type group struct {
+	userAgents []string
+	rules      []rule
+	crawlDelay time.Duration
+}
+
+// Parses robots.txt and returns the rules of the group matching the userAgent.
+// The group matches if its user-agent is a case insensitive substring of userAgent. "*" group is used otherwise
+func Parse(body []byte, userAgent string) *Rules {
+	var groups []*group
+	var current *group
+	// consecutive user-agent lines start the same group
+	var collectingAgents bool = false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !collectingAgents {
+				current = &group{}
+				groups = append(groups, current)
+				collectingAgents = true
+			}
+			current.userAgents = append(current.userAgents, strings.ToLower(value))
+		case "allow", "disallow":
+			collectingAgents = false
+			// empty disallow allows everything
+			if current == nil || value == "" {
+				continue
+			}
+			current.rules = append(current.rules, rule{allow: key == "allow", pattern: value, re: compilePattern(value)})
+		case "crawl-delay":
+			collectingAgents = false
+			if current == nil {
+				continue
+			}
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				current.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		default:
+			// e.g. sitemap, does not end the user-agent list
+		}
+	}
+
+	userAgent = strings.ToLower(userAgent)
+	var specific, wildcard []*group
+	for _, g := range groups {
+		for _, agent := range g.userAgents {
+			if agent == "*" {
+				wildcard = append(wildcard, g)
+				break
+			}
+			if agent != "" && strings.Contains(userAgent, agent) {
+				specific = append(specific, g)
+				break
+			}
+		}
+	}
+	matched := wildcard
+	if len(specific) > 0 {
+		matched = specific
+	}
+	res := &Rules{}
+	// the matching groups are combined
+	for _, g := range matched {
+		res.rules = append(res.rules, g.rules...)
+		if g.crawlDelay > res.crawlDelay {
+			res.crawlDelay = g.crawlDelay
+		}
+	}
+	return res
+}
+
+// Compiles the pattern with "*" wildcards and "$" end anchor into the regexp matching the path prefix
+func compilePattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// Whether the path (with the query) may be fetched. The longest matching rule wins, allow wins the ties
+func (r *Rules) Allowed(path string) bool {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if path == "/robots.txt" {
+		return true
+	}
+	var allowed bool = true
+	var longest int = -1
+	for _, rule := range r.rules {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			longest = len(rule.pattern)
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+// Crawl-delay of the matched group, 0 if not specified
+func (r *Rules) CrawlDelay() time.Duration {
+	return r.crawlDelay
+}
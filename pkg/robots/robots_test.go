@@ -0,0 +1,75 @@
+package robots
+
+import (
+	"testing"
+	"time"
+)
+
+const userAgent = "LostPetInitiative:poiskzoo-crawler / 1.0:abcdef (https://kashtanka.pet/)"
+
+const robotsTxt = `# comment
+User-agent: Yandex
+Disallow: /
+
+User-agent: *
+Disallow: /admin/
+Disallow: /*.php$
+Allow: /admin/public
+Crawl-delay: 2.5
+Sitemap: https://poiskzoo.ru/sitemap.xml
+
+User-agent: poiskzoo-crawler
+User-agent: other-bot
+Disallow: /search
+Allow: /search/help
+Crawl-delay: 1
+`
+
+func TestSpecificGroupWins(t *testing.T) {
+	rules := Parse([]byte(robotsTxt), userAgent)
+	if rules.CrawlDelay() != time.Second {
+		t.Errorf("expected the crawl delay of the specific group, got %v", rules.CrawlDelay())
+	}
+	for path, expected := range map[string]bool{
+		"/164971":         true,
+		"/admin/":         true,
+		"/search?q=dog":   false,
+		"/search/help":    true,
+		"/robots.txt":     true,
+		"/poteryashka/p1": true,
+	} {
+		if actual := rules.Allowed(path); actual != expected {
+			t.Errorf("%s: expected allowed=%v", path, expected)
+		}
+	}
+}
+
+func TestWildcardGroup(t *testing.T) {
+	rules := Parse([]byte(robotsTxt), "SomeOtherBot/1.0")
+	if rules.CrawlDelay() != 2500*time.Millisecond {
+		t.Errorf("expected the crawl delay of * group, got %v", rules.CrawlDelay())
+	}
+	for path, expected := range map[string]bool{
+		"/164971":            true,
+		"/admin/users":       false,
+		"/admin/public/x":    true,
+		"/index.php":         false,
+		"/index.php?page=2":  true,
+		"/search?q=dog":      true,
+		"/a.php/b.php":       false,
+		"/upload/photo.jpeg": true,
+	} {
+		if actual := rules.Allowed(path); actual != expected {
+			t.Errorf("%s: expected allowed=%v", path, expected)
+		}
+	}
+}
+
+func TestAllowAllAndDisallowAll(t *testing.T) {
+	if !AllowAll().Allowed("/anything") || !Parse([]byte("User-agent: *\nDisallow:\n"), userAgent).Allowed("/anything") {
+		t.Error("expected everything to be allowed")
+	}
+	if DisallowAll().Allowed("/anything") || DisallowAll().Allowed("/") {
+		t.Error("expected everything to be disallowed")
+	}
+}
@@ -1,15 +1,20 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
-	"log"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/crawler"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
 )
@@ -31,30 +36,125 @@ func (d *DirectoryCardStorage) IsCardExist(card types.CardID) bool {
 	return err == nil || !errors.Is(err, fs.ErrNotExist)
 }
 
-func (d *DirectoryCardStorage) SaveCard(petCard *crawler.PetCard, jsonCard *crawler.CardJSON, fetchedImage *utils.HttpFetchResult) {
+const pageFileName string = "page.html"
+
+// not a card ID, so it is not listed by StoredCards
+const downloadsDirName string = ".downloads"
+
+// The dir (created if needed) to download the images to, it is on the same file system as the cards
+func (d *DirectoryCardStorage) DownloadsDir() (string, error) {
+	dir := path.Join(d.cardsDir, downloadsDirName)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// The IDs of the stored cards, in no particular order
+func (d *DirectoryCardStorage) StoredCards() ([]types.CardID, error) {
+	entries, err := os.ReadDir(d.cardsDir)
+	if err != nil {
+		return nil, err
+	}
+	cards := make([]types.CardID, 0, len(entries))
+	for _, entry := range entries {
+		parsedID, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		cards = append(cards, types.CardID(parsedID))
+	}
+	return cards, nil
+}
+
+// Reads the stored page of the card along with the time it was fetched.
+// Returns fs.ErrNotExist for the cards stored before the pages were kept
+func (d *DirectoryCardStorage) LoadCardPage(card types.CardID) ([]byte, time.Time, error) {
+	pagePath := path.Join(d.getCardDir(card), pageFileName)
+	info, err := os.Stat(pagePath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	page, err := os.ReadFile(pagePath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// the page is never rewritten, so its modification time is the fetch time
+	return page, info.ModTime(), nil
+}
+
+// Replaces the stored card.json of the card, e.g. after reparsing it
+func (d *DirectoryCardStorage) SaveCardJSON(card types.CardID, jsonCard *crawler.CardJSON) error {
+	return os.WriteFile(path.Join(d.getCardDir(card), "card.json"), []byte(jsonCard.JsonSerialize()), 0644)
+}
+
+// Opens the file stored in the card dir (e.g. the image), for serving it
+func (d *DirectoryCardStorage) OpenCardFile(card types.CardID, fileName string) (*os.File, error) {
+	if fileName != path.Base(fileName) || strings.HasPrefix(fileName, ".") {
+		return nil, fmt.Errorf("invalid card file name %q: %w", fileName, fs.ErrNotExist)
+	}
+	return os.Open(path.Join(d.getCardDir(card), fileName))
+}
+
+// Reads the stored card.json of the card
+func (d *DirectoryCardStorage) LoadCardJSON(card types.CardID) (*crawler.CardJSON, error) {
+	content, err := os.ReadFile(path.Join(d.getCardDir(card), "card.json"))
+	if err != nil {
+		return nil, err
+	}
+	var jsonCard crawler.CardJSON
+	err = json.Unmarshal(content, &jsonCard)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse card.json of %d: %w", card, err)
+	}
+	return &jsonCard, nil
+}
+
+func referencesBlobs(jsonCard *crawler.CardJSON) bool {
+	for _, image := range jsonCard.Images {
+		if image.Type == "ref" {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DirectoryCardStorage) SaveCard(ctx context.Context, petCard *crawler.PetCard, jsonCard *crawler.CardJSON, image *imaging.Image) {
 	card := petCard.ID
-	log.Printf("%d:\tDumping card to disk...\n", card)
+	logger := logging.Component(ctx, "storage")
+	logger.Debug("Dumping card to disk...")
 	cardDir := d.getCardDir(card)
 
 	err := os.Mkdir(cardDir, 0644)
 	if err != nil && !errors.Is(err, fs.ErrExist) {
-		log.Panicf("%d:\tFailed to create card dir: %v", card, d.cardsDir)
+		logging.Panic(logger, "Failed to create card dir", "dir", cardDir, logging.ErrorKey, err)
+	}
+
+	if image != nil && referencesBlobs(jsonCard) {
+		// the image is in the blob store, the card keeps referencing it just as the pipeline got it
+		image = nil
 	}
 
 	// replacing embedded base64 image with file reference
 	var imageFileName string
+	const thumbnailFileName string = "thumbnail.jpg"
 
-	if fetchedImage != nil {
-		var imageFileExt string
-		switch strings.ToLower(fetchedImage.ContentType) {
-		case "image/jpeg":
-			imageFileExt = "jpg"
-		default:
-			imageFileExt = strings.TrimPrefix(fetchedImage.ContentType, "image/")
-		}
-		imageFileName = fmt.Sprintf("image.%s", imageFileExt)
+	if image != nil {
+		imageFileName = fmt.Sprintf("image.%s", image.Format)
 
-		jsonCard.Images = []crawler.EncodedImageJSON{{Type: "file", Data: imageFileName}}
+		jsonCard.Images = []crawler.EncodedImageJSON{{
+			Type:   "file",
+			Data:   imageFileName,
+			Width:  image.Width,
+			Height: image.Height,
+			Thumbnail: &crawler.EncodedImageJSON{
+				Type:   "file",
+				Data:   thumbnailFileName,
+				Width:  imaging.ThumbnailSize,
+				Height: imaging.ThumbnailSize,
+			},
+		}}
 
 	}
 	var serialized string = jsonCard.JsonSerialize()
@@ -62,17 +162,31 @@ func (d *DirectoryCardStorage) SaveCard(petCard *crawler.PetCard, jsonCard *craw
 	cardFilePath := path.Join(cardDir, "card.json")
 	err = os.WriteFile(cardFilePath, []byte(serialized), 0644)
 	if err != nil {
-		log.Panicf("%d:\t%v\n", card, err)
+		logging.Panic(logger, "Failed to save JSON card", logging.ErrorKey, err)
 	} else {
-		log.Printf("%d:\tJSON card saved to disk\n", card)
+		logger.Info("JSON card saved to disk", "path", cardFilePath)
 	}
-	if fetchedImage != nil {
-		imageFilePath := path.Join(cardDir, imageFileName)
-		err = os.WriteFile(imageFilePath, fetchedImage.Body, 0644)
+	if len(petCard.PageHTML) > 0 {
+		err = os.WriteFile(path.Join(cardDir, pageFileName), petCard.PageHTML, 0644)
 		if err != nil {
-			log.Panicf("%d:\t%v\n", card, err)
+			logging.Panic(logger, "Failed to save card page", logging.ErrorKey, err)
+		}
+	}
+	if image != nil {
+		imageFilePath := path.Join(cardDir, imageFileName)
+		if image.Path != "" {
+			// the image kept as downloaded is linked, not read into the memory
+			err = utils.LinkOrCopyFile(image.Path, imageFilePath)
 		} else {
-			log.Printf("%d:\timage file saved to disk\n", card)
+			err = os.WriteFile(imageFilePath, image.Data, 0644)
+		}
+		if err != nil {
+			logging.Panic(logger, "Failed to save image", logging.ErrorKey, err)
+		}
+		err = os.WriteFile(path.Join(cardDir, thumbnailFileName), image.Thumbnail, 0644)
+		if err != nil {
+			logging.Panic(logger, "Failed to save thumbnail", logging.ErrorKey, err)
 		}
+		logger.Info("Image and thumbnail files saved to disk", "image", imageFileName)
 	}
 }
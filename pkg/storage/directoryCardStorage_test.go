@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/crawler"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+func TestStoredCardPageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewDirectoryCardStorage(dir)
+	petCard := &crawler.PetCard{ID: 165457, Species: types.Dog, EventType: types.Lost, City: "Москва", Address: "Тверская", PageHTML: []byte("<html>page</html>")}
+	jsonCard := crawler.NewCardJSON(petCard, nil, nil, "", nil)
+	storage.SaveCard(context.Background(), petCard, jsonCard, nil)
+	// neither a card nor a card dir
+	if err := os.Mkdir(path.Join(dir, "blobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "123"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cards, err := storage.StoredCards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 1 || cards[0] != 165457 {
+		t.Errorf("expected only the card 165457 to be stored, got %v", cards)
+	}
+
+	page, fetchedAt, err := storage.LoadCardPage(165457)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(page) != "<html>page</html>" {
+		t.Errorf("unexpected stored page %q", page)
+	}
+	if time.Since(fetchedAt) > time.Minute {
+		t.Errorf("expected the page to be fetched just now, got %v", fetchedAt)
+	}
+	if _, _, err := storage.LoadCardPage(types.CardID(1)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for the card without the page, got %v", err)
+	}
+
+	jsonCard.Location.Address = "reparsed"
+	if err := storage.SaveCardJSON(165457, jsonCard); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := storage.LoadCardJSON(165457)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Location.Address != "reparsed" {
+		t.Errorf("expected the saved card.json to be loaded, got address %q", loaded.Location.Address)
+	}
+
+	f, err := storage.OpenCardFile(165457, "page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(f)
+	f.Close()
+	if string(content) != "<html>page</html>" {
+		t.Errorf("unexpected card file content %q", content)
+	}
+	for _, fileName := range []string{"../165457/card.json", ".hidden", ""} {
+		if _, err := storage.OpenCardFile(165457, fileName); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected %q to be rejected with fs.ErrNotExist, got %v", fileName, err)
+		}
+	}
+}
+
+func TestSaveCardKeepsBlobReferences(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewDirectoryCardStorage(dir)
+	petCard := &crawler.PetCard{ID: 165457, Species: types.Dog, EventType: types.Lost, City: "Москва", Address: "Тверская"}
+	jsonCard := crawler.NewCardJSON(petCard, nil, nil, "", nil)
+	ref := crawler.EncodedImageJSON{Type: "ref", Format: "jpg", URL: "https://blobs.example/abc", Sha256: "abc", Size: 3, Width: 40, Height: 20}
+	jsonCard.Images = []crawler.EncodedImageJSON{ref}
+	image := &imaging.Image{Data: []byte("jpg"), Format: imaging.JPEG, Width: 40, Height: 20, Thumbnail: []byte("thumb")}
+	storage.SaveCard(context.Background(), petCard, jsonCard, image)
+
+	loaded, err := storage.LoadCardJSON(165457)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Images) != 1 || loaded.Images[0].Type != "ref" || loaded.Images[0].URL != ref.URL {
+		t.Errorf("expected the blob reference to be kept, got %+v", loaded.Images)
+	}
+	if _, err := os.Stat(path.Join(dir, "165457", "image.jpg")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no local copy of the referenced image, got %v", err)
+	}
+}
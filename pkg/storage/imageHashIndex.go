@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+type imageHashEntry struct {
+	card types.CardID
+	hash imaging.PerceptualHash
+}
+
+// Perceptual hashes of the card images, persisted as an append-only text file of "<card id> <hash>" lines.
+// The whole index is kept in memory, lookups are linear scans which is fast enough for the hashes of 64 bits
+type FileImageHashIndex struct {
+	mu      sync.Mutex
+	path    string
+	entries []imageHashEntry
+}
+
+// Loads (creating if needed) the index from the file
+func NewFileImageHashIndex(path string) (*FileImageHashIndex, error) {
+	index := &FileImageHashIndex{path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<card id> <hash>\", got %q", path, lineNum, line)
+		}
+		card, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid card id: %w", path, lineNum, err)
+		}
+		hash, err := imaging.ParsePerceptualHash(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		index.entries = append(index.entries, imageHashEntry{types.CardID(card), hash})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (i *FileImageHashIndex) Add(card types.CardID, hash imaging.PerceptualHash) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	f, err := os.OpenFile(i.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %s\n", card, hash)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	i.entries = append(i.entries, imageHashEntry{card, hash})
+	return nil
+}
+
+// Number of the indexed images
+func (i *FileImageHashIndex) Size() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.entries)
+}
+
+// Returns the cards (ascending, without repetitions) having an image with the hash within maxDistance bits of the specified one
+func (i *FileImageHashIndex) FindSimilar(hash imaging.PerceptualHash, maxDistance int) []types.CardID {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	found := make(map[types.CardID]bool)
+	for _, entry := range i.entries {
+		if entry.hash.Distance(hash) <= maxDistance {
+			found[entry.card] = true
+		}
+	}
+	result := make([]types.CardID, 0, len(found))
+	for card := range found {
+		result = append(result, card)
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a] < result[b] })
+	return result
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"path"
+	"testing"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/imaging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+func TestImageHashIndexFindsSimilarAfterReload(t *testing.T) {
+	indexPath := path.Join(t.TempDir(), "image-hashes.txt")
+	index, err := NewFileImageHashIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const hash imaging.PerceptualHash = 0xf0f0f0f0f0f0f0f0
+	for card, h := range map[types.CardID]imaging.PerceptualHash{
+		3: hash,
+		1: hash ^ 0b101,        // 2 bits away
+		2: ^hash,               // completely different
+		4: hash ^ 0xff00ff00ff, // 24 bits away
+	} {
+		if err := index.Add(card, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err := NewFileImageHashIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	similar := reloaded.FindSimilar(hash, imaging.NearDuplicateDistance)
+	if len(similar) != 2 || similar[0] != 1 || similar[1] != 3 {
+		t.Errorf("expected cards 1 and 3, got %v", similar)
+	}
+}
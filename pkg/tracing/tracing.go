@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const ServiceName = "poiskzoo-crawler"
+
+const tracerName = "github.com/LostPetInitiative/poiskzoo-ru-crawler"
+
+// Trace context is propagated in W3C format (traceparent and tracestate headers)
+var propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+func init() {
+	otel.SetTextMapPropagator(propagator)
+}
+
+func newExporter(ctx context.Context, exporterKind string) (sdktrace.SpanExporter, error) {
+	switch strings.ToLower(exporterKind) {
+	case "otlp":
+		// the endpoint and the headers are configured with the standard OTEL_EXPORTER_OTLP_* env vars
+		return otlptracehttp.New(ctx)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %q. Expected \"none\", \"otlp\" or \"stdout\"", exporterKind)
+	}
+}
+
+// Installs the global tracer provider exporting the spans with the exporter of the specified kind.
+// "none" leaves the spans unrecorded. The returned function flushes the buffered spans
+func Setup(ctx context.Context, exporterKind string) (func(context.Context) error, error) {
+	if exporterKind == "" || strings.ToLower(exporterKind) == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := newExporter(ctx, exporterKind)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", ServiceName),
+		attribute.String("service.version", version.AppVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Starts the span as a child of the span in the context
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Starts the span of the separate trace, linked to the span in the context.
+// Used for the card jobs, so each card gets its own trace instead of growing the trace of the cycle
+func StartLinkedRoot(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(attrs...))
+}
+
+// Marks the span as failed if err is not nil
+func RecordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Ends the span, marking it as failed if err is not nil
+func End(span trace.Span, err error) {
+	RecordError(span, err)
+	span.End()
+}
+
+// Puts the trace context of the span in the context into the headers
+func Inject(ctx context.Context, headers map[string]string) {
+	propagator.Inject(ctx, propagation.MapCarrier(headers))
+}
+
+// Puts the trace context of the span in the context into the HTTP request headers
+func InjectHeader(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Returns the context carrying the remote span context found in the headers
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(headers))
+}
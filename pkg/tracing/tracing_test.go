@@ -0,0 +1,80 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestCardJobIsSeparateTraceLinkedToCycle(t *testing.T) {
+	recorder := newRecorder(t)
+
+	cycleCtx, cycleSpan := Start(context.Background(), "cycle")
+	jobCtx, jobSpan := StartLinkedRoot(cycleCtx, "card_job")
+	_, downloadSpan := Start(jobCtx, "card_download")
+	End(downloadSpan, errors.New("503"))
+	jobSpan.End()
+	cycleSpan.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	download, job, cycle := spans[0], spans[1], spans[2]
+	if job.SpanContext().TraceID() == cycle.SpanContext().TraceID() {
+		t.Error("the card job must start a new trace")
+	}
+	if len(job.Links()) != 1 || job.Links()[0].SpanContext.SpanID() != cycle.SpanContext().SpanID() {
+		t.Errorf("the card job must be linked to the cycle, got %v", job.Links())
+	}
+	if download.Parent().SpanID() != job.SpanContext().SpanID() {
+		t.Error("the download must be the child of the card job")
+	}
+	if download.Status().Code != codes.Error {
+		t.Errorf("the failed span must have error status, got %v", download.Status())
+	}
+}
+
+func TestInjectExtractRoundTrip(t *testing.T) {
+	newRecorder(t)
+
+	ctx, span := Start(context.Background(), "card_job")
+	defer span.End()
+	headers := make(map[string]string)
+	Inject(ctx, headers)
+	if headers["traceparent"] == "" {
+		t.Fatalf("expected traceparent header, got %v", headers)
+	}
+
+	extracted := trace.SpanContextFromContext(Extract(context.Background(), headers))
+	if extracted.TraceID() != span.SpanContext().TraceID() || extracted.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("extracted span context %v differs from the injected one %v", extracted, span.SpanContext())
+	}
+}
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), "zipkin"); err == nil {
+		t.Error("expected an error for the unsupported exporter")
+	}
+	shutdown, err := Setup(context.Background(), "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
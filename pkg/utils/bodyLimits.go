@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The kind of the expected response, each kind has its own body size limit
+type ContentClass string
+
+const (
+	ContentClassHTML  ContentClass = "html"
+	ContentClassJSON  ContentClass = "json"
+	ContentClassImage ContentClass = "image"
+	ContentClassOther ContentClass = "other"
+)
+
+// Returned when the response body is larger than the limit of its content class
+type BodyTooLargeError struct {
+	URL   string
+	Class ContentClass
+	Limit int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("response body of %s exceeds the limit of %d bytes for %s content", e.URL, e.Limit, e.Class)
+}
+
+// Determines the content class of the request by its Accept header
+func contentClassOf(accept string) ContentClass {
+	switch {
+	case strings.Contains(accept, "text/html"):
+		return ContentClassHTML
+	case strings.Contains(accept, "json"):
+		return ContentClassJSON
+	case strings.HasPrefix(accept, "image/"):
+		return ContentClassImage
+	default:
+		return ContentClassOther
+	}
+}
+
+func DefaultBodyLimits() map[ContentClass]int64 {
+	return map[ContentClass]int64{
+		ContentClassHTML:  5 << 20,
+		ContentClassJSON:  2 << 20,
+		ContentClassImage: 20 << 20,
+		ContentClassOther: 10 << 20,
+	}
+}
+
+// Parses comma separated "class=megabytes" limits, e.g. "html=5,image=20". 0 disables the limit of the class
+func ParseBodyLimits(spec string) (map[ContentClass]int64, error) {
+	res := make(map[ContentClass]int64)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		class, megabytes, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid body limit %q. Expected class=megabytes", entry)
+		}
+		switch ContentClass(class) {
+		case ContentClassHTML, ContentClassJSON, ContentClassImage, ContentClassOther:
+		default:
+			return nil, fmt.Errorf("unknown content class in body limit %q. Expected html, json, image or other", entry)
+		}
+		limit, err := strconv.ParseFloat(megabytes, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid size in body limit %q", entry)
+		}
+		res[ContentClass(class)] = int64(limit * (1 << 20))
+	}
+	return res, nil
+}
+
+// The response body streamed to the file. The file is owned by the caller, who removes it
+type DownloadedFile struct {
+	Path        string
+	Size        int64
+	Sha256      string
+	ContentType string
+}
+
+func (f *DownloadedFile) Remove() error {
+	return os.Remove(f.Path)
+}
+
+// how the response body is read
+type bodyOptions struct {
+	class ContentClass
+	// the body is streamed to a temp file in dir (the default temp dir if empty) instead of the memory
+	toFile bool
+	dir    string
+}
+
+// Reads the body into memory, failing if it exceeds the limit (0 means no limit)
+func readLimited(body io.Reader, limit int64, targetUrl string, class ContentClass) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &BodyTooLargeError{URL: targetUrl, Class: class, Limit: limit}
+	}
+	return data, nil
+}
+
+// Streams the body to a temp file in dir, hashing it on the way. The file is removed on failure
+func spoolToFile(body io.Reader, dir string, limit int64, targetUrl string, class ContentClass) (*DownloadedFile, error) {
+	f, err := os.CreateTemp(dir, "download-*")
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit > 0 && size > limit {
+		err = &BodyTooLargeError{URL: targetUrl, Class: class, Limit: limit}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &DownloadedFile{Path: f.Name(), Size: size, Sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func newSizedServer(t *testing.T, size int, declareLength bool) (*url.URL, *int32) {
+	var calls int32
+	body := strings.Repeat("x", size)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if !declareLength {
+			// chunked, the size is known only while reading
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL + "/164971")
+	return serverUrl, &calls
+}
+
+func TestBodyOverLimitIsNotRetried(t *testing.T) {
+	for _, declareLength := range []bool{true, false} {
+		serverUrl, calls := newSizedServer(t, 4096, declareLength)
+		c, _ := newTestClient()
+		c.MaxBodyBytes = map[ContentClass]int64{ContentClassHTML: 1024}
+
+		header := make(http.Header)
+		header.Set("Accept", "text/html")
+		_, err := c.do(context.Background(), "GET", serverUrl, nil, header)
+		var tooLarge *BodyTooLargeError
+		if !errors.As(err, &tooLarge) || tooLarge.Class != ContentClassHTML || tooLarge.Limit != 1024 {
+			t.Errorf("declared length %v: expected BodyTooLargeError, got %v", declareLength, err)
+		}
+		if *calls != 1 {
+			t.Errorf("declared length %v: expected no retries, got %d calls", declareLength, *calls)
+		}
+
+		// other classes have their own limits
+		header.Set("Accept", "application/json")
+		if _, err := c.do(context.Background(), "GET", serverUrl, nil, header); err != nil {
+			t.Errorf("declared length %v: expected JSON to be unlimited, got %v", declareLength, err)
+		}
+	}
+}
+
+func TestDownloadStreamsToFile(t *testing.T) {
+	serverUrl, _ := newSizedServer(t, 4096, false)
+	c, _ := newTestClient()
+	c.MaxBodyBytes = map[ContentClass]int64{ContentClassImage: 4096}
+	dir := t.TempDir()
+
+	file, err := c.download(context.Background(), serverUrl, make(http.Header), ContentClassImage, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(strings.Repeat("x", 4096)))
+	if len(data) != 4096 || file.Size != 4096 || file.Sha256 != hex.EncodeToString(hash[:]) {
+		t.Errorf("unexpected download %d bytes, %+v", len(data), file)
+	}
+	if err := file.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the partially written file is removed
+	c.MaxBodyBytes[ContentClassImage] = 1024
+	_, err = c.download(context.Background(), serverUrl, make(http.Header), ContentClassImage, dir)
+	var tooLarge *BodyTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Errorf("expected BodyTooLargeError, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected no files left, got %d", len(entries))
+	}
+}
+
+func TestParseBodyLimits(t *testing.T) {
+	limits, err := ParseBodyLimits("html=5, image=0.5,json=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[ContentClassHTML] != 5<<20 || limits[ContentClassImage] != 512<<10 || limits[ContentClassJSON] != 0 {
+		t.Errorf("unexpected limits %v", limits)
+	}
+	for _, spec := range []string{"video=5", "html", "html=-1", "html=big"} {
+		if _, err := ParseBodyLimits(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// Returns the share of hits among all of the lookups. 0 if there were no lookups
+func (s CacheStats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+type ttlEntry[TKey comparable, TData any] struct {
+	key   TKey
+	value TData
+	// zero value means that the entry never expires
+	expiresAt time.Time
+}
+
+type inflightLoad[TData any] struct {
+	done  sync.WaitGroup
+	value TData
+	// set if the loader did not return, the waiters re-panic with panicValue then
+	failed     bool
+	panicValue any
+}
+
+// Raised in the callers that waited for the load that did not complete without panicking, e.g. the loader called runtime.Goexit
+type LoadAbortedError struct {
+	Key any
+}
+
+func (e *LoadAbortedError) Error() string {
+	return fmt.Sprintf("load of the cache key %v did not complete", e.Key)
+}
+
+// LRU cache that is safe for concurrent use.
+// Entries may have the individual time to live.
+// Concurrent misses of the same key done via GetOrLoad are de-duplicated: only one of the callers runs the loader, others wait for its result
+type ConcurrentLRUCache[TKey comparable, TData any] struct {
+	Capacity int
+
+	mutex    sync.Mutex
+	list     *LinkedList[ttlEntry[TKey, TData]]
+	dict     map[TKey]*ListNode[ttlEntry[TKey, TData]]
+	inflight map[TKey]*inflightLoad[TData]
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+
+	// overridable in tests
+	now func() time.Time
+}
+
+func NewConcurrentLRUCache[TKey comparable, TData any](capacity int) *ConcurrentLRUCache[TKey, TData] {
+	return &ConcurrentLRUCache[TKey, TData]{
+		Capacity: capacity,
+		list:     NewLinkedList[ttlEntry[TKey, TData]](),
+		dict:     make(map[TKey]*ListNode[ttlEntry[TKey, TData]]),
+		inflight: make(map[TKey]*inflightLoad[TData]),
+		now:      time.Now,
+	}
+}
+
+// Stores the value that never expires
+func (c *ConcurrentLRUCache[TKey, TData]) Set(key TKey, val TData) {
+	c.SetWithTTL(key, val, 0)
+}
+
+// Stores the value that expires after ttl. ttl <= 0 means that the value never expires
+func (c *ConcurrentLRUCache[TKey, TData]) SetWithTTL(key TKey, val TData, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setLocked(key, val, ttl)
+}
+
+// bool - whether the extraction is successful, thus first value of tuple is properly set
+func (c *ConcurrentLRUCache[TKey, TData]) Get(key TKey) (TData, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	val, exists := c.getLocked(key)
+	if exists {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return val, exists
+}
+
+// Returns the cached value for the key. If it is absent, calls load and caches its result for the returned ttl (<= 0 means forever).
+// If several goroutines miss the same key simultaneously, load is called only once and all of them get its result.
+// If load panics, the callers that waited for it panic with the same value and nothing is cached.
+// The callers that waited for someone else's load are accounted as hits
+func (c *ConcurrentLRUCache[TKey, TData]) GetOrLoad(key TKey, load func() (TData, time.Duration)) TData {
+	c.mutex.Lock()
+	val, exists := c.getLocked(key)
+	if exists {
+		c.mutex.Unlock()
+		c.hits.Add(1)
+		return val
+	}
+	if call, loading := c.inflight[key]; loading {
+		c.mutex.Unlock()
+		call.done.Wait()
+		c.hits.Add(1)
+		if call.failed {
+			panic(call.panicValue)
+		}
+		return call.value
+	}
+	call := &inflightLoad[TData]{}
+	call.done.Add(1)
+	c.inflight[key] = call
+	c.mutex.Unlock()
+	c.misses.Add(1)
+
+	var ttl time.Duration
+	completed := false
+	defer func() {
+		// releasing the waiters even if load panics. In that case they panic too
+		var panicValue any
+		if !completed {
+			panicValue = recover()
+			call.failed = true
+			call.panicValue = panicValue
+			if panicValue == nil {
+				call.panicValue = &LoadAbortedError{Key: key}
+			}
+		}
+		c.mutex.Lock()
+		delete(c.inflight, key)
+		if completed {
+			c.setLocked(key, call.value, ttl)
+		}
+		c.mutex.Unlock()
+		call.done.Done()
+		if panicValue != nil {
+			panic(panicValue)
+		}
+	}()
+
+	call.value, ttl = load()
+	completed = true
+	return call.value
+}
+
+func (c *ConcurrentLRUCache[TKey, TData]) Size() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.list.Size()
+}
+
+func (c *ConcurrentLRUCache[TKey, TData]) Stats() CacheStats {
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// must be called with the mutex held
+func (c *ConcurrentLRUCache[TKey, TData]) getLocked(key TKey) (TData, bool) {
+	node, exists := c.dict[key]
+	if !exists {
+		var zero TData
+		return zero, false
+	}
+	if !node.Data.expiresAt.IsZero() && !c.now().Before(node.Data.expiresAt) {
+		c.list.Remove(node)
+		delete(c.dict, key)
+		c.evictions.Add(1)
+		var zero TData
+		return zero, false
+	}
+	// moving to head
+	c.list.Remove(node)
+	c.list.PushAsFirst(node)
+	return node.Data.value, true
+}
+
+// must be called with the mutex held
+func (c *ConcurrentLRUCache[TKey, TData]) setLocked(key TKey, val TData, ttl time.Duration) {
+	old, exists := c.dict[key]
+	if exists {
+		c.list.Remove(old)
+	}
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = c.now().Add(ttl)
+	}
+	node := NewLinkedListNode(ttlEntry[TKey, TData]{key, val, expiresAt})
+	c.list.PushAsFirst(node)
+	c.dict[key] = node
+	for c.list.Size() > c.Capacity {
+		toRemove := c.list.Last
+		c.list.RemoveLast()
+		delete(c.dict, toRemove.Data.key)
+		c.evictions.Add(1)
+	}
+}
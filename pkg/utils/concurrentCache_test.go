@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentCacheCapacityIsRespected(t *testing.T) {
+	cache := NewConcurrentLRUCache[string, int](2)
+	cache.Set("a", 1)
+	cache.Set("b", 2)
+	cache.Get("a") // now "b" is the least recently used
+	cache.Set("c", 3)
+
+	if _, exist := cache.Get("b"); exist {
+		t.Error("b must be evicted")
+	}
+	if v, exist := cache.Get("a"); !exist || v != 1 {
+		t.Errorf("expected a=1 to be present, got %d (%v)", v, exist)
+	}
+
+	stats := cache.Stats()
+	if stats.Evictions != 1 {
+		t.Errorf("expected 1 eviction, got %d", stats.Evictions)
+	}
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("expected 2 hits and 1 miss, got %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+}
+
+func TestConcurrentCacheTTL(t *testing.T) {
+	now := time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC)
+	cache := NewConcurrentLRUCache[string, int](10)
+	cache.now = func() time.Time { return now }
+
+	cache.SetWithTTL("short", 1, time.Minute)
+	cache.Set("forever", 2)
+
+	now = now.Add(59 * time.Second)
+	if _, exist := cache.Get("short"); !exist {
+		t.Error("short must not be expired yet")
+	}
+
+	now = now.Add(time.Second)
+	if _, exist := cache.Get("short"); exist {
+		t.Error("short must be expired")
+	}
+	if _, exist := cache.Get("forever"); !exist {
+		t.Error("forever must never expire")
+	}
+	if cache.Size() != 1 {
+		t.Errorf("expired entry must be removed, but size is %d", cache.Size())
+	}
+}
+
+func TestConcurrentCacheLoadIsDeduplicated(t *testing.T) {
+	cache := NewConcurrentLRUCache[string, int](10)
+
+	var loadCount atomic.Int32
+	release := make(chan struct{})
+	load := func() (int, time.Duration) {
+		loadCount.Add(1)
+		<-release
+		return 42, 0
+	}
+
+	const callers = 16
+	var wg sync.WaitGroup
+	results := make([]int, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cache.GetOrLoad("key", load)
+		}(i)
+	}
+
+	// giving the goroutines a chance to pile up on the same key
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loadCount.Load() != 1 {
+		t.Errorf("expected the loader to be called once, but it was called %d times", loadCount.Load())
+	}
+	for i, r := range results {
+		if r != 42 {
+			t.Errorf("caller %d got %d instead of 42", i, r)
+		}
+	}
+	stats := cache.Stats()
+	if stats.Misses != 1 || stats.Hits != callers-1 {
+		t.Errorf("expected 1 miss and %d hits, got %d misses and %d hits", callers-1, stats.Misses, stats.Hits)
+	}
+}
+
+func TestConcurrentCacheLoadPanicReleasesWaiters(t *testing.T) {
+	cache := NewConcurrentLRUCache[string, int](10)
+
+	func() {
+		defer func() { recover() }()
+		cache.GetOrLoad("key", func() (int, time.Duration) { panic("boom") })
+	}()
+
+	v := cache.GetOrLoad("key", func() (int, time.Duration) { return 7, 0 })
+	if v != 7 {
+		t.Errorf("expected the value to be loaded again after panic, got %d", v)
+	}
+}
+
+func TestConcurrentCacheLoadPanicIsPropagatedToWaiters(t *testing.T) {
+	cache := NewConcurrentLRUCache[string, *int](10)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	load := func() (*int, time.Duration) {
+		close(started)
+		<-release
+		panic("boom")
+	}
+
+	var wg sync.WaitGroup
+	recovered := make([]any, 2)
+	results := make([]*int, 2)
+	call := func(i int) {
+		defer wg.Done()
+		defer func() { recovered[i] = recover() }()
+		results[i] = cache.GetOrLoad("key", load)
+	}
+	wg.Add(2)
+	go call(0)
+	<-started
+	go call(1)
+	// giving the waiter a chance to block on the in-flight load
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i := range recovered {
+		if recovered[i] != "boom" {
+			t.Errorf("caller %d: expected the loader panic to be re-raised, got %v (result %v)", i, recovered[i], results[i])
+		}
+	}
+	if cache.Size() != 0 {
+		t.Errorf("expected nothing to be cached after the panic, got %d entries", cache.Size())
+	}
+}
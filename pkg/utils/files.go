@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"path"
+)
+
+// Places the content of the src file at dst, replacing it. The file is hard linked if both are on the same file system,
+// so the data is not copied, and is copied otherwise. dst never appears partially written
+func LinkOrCopyFile(src, dst string) error {
+	tmp, err := os.CreateTemp(path.Dir(dst), path.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	// the link may not overwrite, so only the name of the temp file is used
+	os.Remove(tmpName)
+	err = os.Link(src, tmpName)
+	if err != nil {
+		err = copyFile(src, tmpName)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, dst)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Politeness limits of the requests to a host
+type HostLimit struct {
+	// requests per second on average, 0 means no rate limit
+	Rate float64
+	// how many requests can be made at once after the host was idle
+	Burst int
+	// the minimal interval between the requests (e.g. Crawl-delay of robots.txt), 0 for none
+	CrawlDelay time.Duration
+}
+
+type hostBucket struct {
+	limit  HostLimit
+	tokens float64
+	// when the tokens were last refilled
+	refilledAt time.Time
+	// when the latest reserved request is allowed to start
+	lastGrant time.Time
+	// the rate is divided and the crawl delay is multiplied by it. 1 when the host is healthy
+	slowdown float64
+	// exponentially weighted moving averages of the recent responses
+	latency   time.Duration
+	errorRate float64
+}
+
+// Per-host token bucket limiter. Slows down the requests to the host when its responses become slow or fail
+type HostLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*hostBucket
+	limits  map[string]HostLimit
+
+	// applied to the hosts without their own limit
+	DefaultLimit HostLimit
+	// the host is slowed down while the average response latency is above this. 0 disables
+	SlowLatency time.Duration
+	// the host is slowed down while the share of failed responses is above this
+	MaxErrorRate float64
+	// the upper bound of the slowdown factor
+	MaxSlowdown float64
+
+	// to be replaced in tests
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// weight of the latest response in the moving averages
+const limiterSmoothing = 0.2
+
+func NewHostLimiter() *HostLimiter {
+	return &HostLimiter{
+		buckets:      make(map[string]*hostBucket),
+		limits:       make(map[string]HostLimit),
+		DefaultLimit: HostLimit{Rate: 2, Burst: 2},
+		SlowLatency:  5 * time.Second,
+		MaxErrorRate: 0.3,
+		MaxSlowdown:  16,
+		now:          time.Now,
+		sleep:        sleepCtx,
+	}
+}
+
+// Overrides the limit of the host. Resets the state of the host
+func (l *HostLimiter) SetLimit(host string, limit HostLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	host = strings.ToLower(host)
+	l.limits[host] = limit
+	delete(l.buckets, host)
+}
+
+// Applies the limits parsed by ParseHostLimits. The "*" host replaces DefaultLimit
+func (l *HostLimiter) SetLimits(limits map[string]HostLimit) {
+	for host, limit := range limits {
+		if host == "*" {
+			l.mu.Lock()
+			l.DefaultLimit = limit
+			l.mu.Unlock()
+		} else {
+			l.SetLimit(host, limit)
+		}
+	}
+}
+
+// Sets the crawl delay of the host keeping its rate and burst
+func (l *HostLimiter) SetCrawlDelay(host string, crawlDelay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	host = strings.ToLower(host)
+	limit, ok := l.limits[host]
+	if !ok {
+		limit = l.DefaultLimit
+	}
+	limit.CrawlDelay = crawlDelay
+	l.limits[host] = limit
+	if b, ok := l.buckets[host]; ok {
+		b.limit = limit
+	}
+}
+
+// Must be called with the mutex held
+func (l *HostLimiter) bucket(host string) *hostBucket {
+	b, ok := l.buckets[host]
+	if !ok {
+		limit, ok := l.limits[host]
+		if !ok {
+			limit = l.DefaultLimit
+		}
+		b = &hostBucket{
+			limit:      limit,
+			tokens:     float64(limit.Burst),
+			refilledAt: l.now(),
+			slowdown:   1,
+		}
+		l.buckets[host] = b
+	}
+	return b
+}
+
+// Reserves the request to the host, returns how long to wait before making it
+func (l *HostLimiter) reserve(host string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b := l.bucket(strings.ToLower(host))
+	grant := now
+	if b.limit.Rate > 0 {
+		rate := b.limit.Rate / b.slowdown
+		b.tokens += now.Sub(b.refilledAt).Seconds() * rate
+		if burst := float64(max(b.limit.Burst, 1)); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.refilledAt = now
+		// the tokens may go negative, so the concurrent requests queue up one after another
+		b.tokens--
+		if b.tokens < 0 {
+			grant = now.Add(time.Duration(-b.tokens / rate * float64(time.Second)))
+		}
+	}
+	if b.limit.CrawlDelay > 0 && !b.lastGrant.IsZero() {
+		earliest := b.lastGrant.Add(time.Duration(float64(b.limit.CrawlDelay) * b.slowdown))
+		if earliest.After(grant) {
+			grant = earliest
+		}
+	}
+	if grant.After(b.lastGrant) {
+		b.lastGrant = grant
+	}
+	return grant.Sub(now)
+}
+
+// Blocks until the request to the host is allowed
+func (l *HostLimiter) Wait(ctx context.Context, host string) error {
+	delay := l.reserve(host)
+	if delay <= 0 {
+		return nil
+	}
+	return l.sleep(ctx, delay)
+}
+
+// Accounts the response (or the failure to get one) of the host, adapting its slowdown
+func (l *HostLimiter) Observe(host string, latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	host = strings.ToLower(host)
+	b := l.bucket(host)
+	var failure float64 = 0
+	if failed {
+		failure = 1
+	}
+	if b.latency == 0 {
+		b.latency = latency
+	} else {
+		b.latency = time.Duration((1-limiterSmoothing)*float64(b.latency) + limiterSmoothing*float64(latency))
+	}
+	b.errorRate = (1-limiterSmoothing)*b.errorRate + limiterSmoothing*failure
+
+	previous := b.slowdown
+	overloaded := (l.SlowLatency > 0 && b.latency > l.SlowLatency) || b.errorRate > l.MaxErrorRate
+	if overloaded {
+		b.slowdown = min(b.slowdown*2, l.MaxSlowdown)
+	} else {
+		// recovering gradually
+		b.slowdown = max(b.slowdown*0.9, 1)
+	}
+	if b.slowdown != previous && (overloaded || b.slowdown == 1) {
+		slog.Info("Adjusted request rate of the host", "host", host, "slowdown", b.slowdown, "latency", b.latency, "error_rate", b.errorRate)
+	}
+}
+
+// Returns the current slowdown factor of the host, 1 if it is not slowed down
+func (l *HostLimiter) Slowdown(host string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[strings.ToLower(host)]; ok {
+		return b.slowdown
+	}
+	return 1
+}
+
+// Parses comma separated "host=rate[:burst[:crawl_delay]]" limits, e.g. "poiskzoo.ru=1:2:500ms,*=4".
+// The "*" host sets the default limit
+func ParseHostLimits(spec string) (map[string]HostLimit, error) {
+	res := make(map[string]HostLimit)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, limitSpec, found := strings.Cut(entry, "=")
+		if !found || host == "" {
+			return nil, fmt.Errorf("invalid host limit %q. Expected host=rate[:burst[:crawl_delay]]", entry)
+		}
+		parts := strings.Split(limitSpec, ":")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid host limit %q. Expected host=rate[:burst[:crawl_delay]]", entry)
+		}
+		rate, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid rate in host limit %q", entry)
+		}
+		limit := HostLimit{Rate: rate, Burst: 1}
+		if len(parts) > 1 {
+			limit.Burst, err = strconv.Atoi(parts[1])
+			if err != nil || limit.Burst < 1 {
+				return nil, fmt.Errorf("invalid burst in host limit %q", entry)
+			}
+		}
+		if len(parts) > 2 {
+			limit.CrawlDelay, err = time.ParseDuration(parts[2])
+			if err != nil || limit.CrawlDelay < 0 {
+				return nil, fmt.Errorf("invalid crawl delay in host limit %q", entry)
+			}
+		}
+		res[strings.ToLower(host)] = limit
+	}
+	return res, nil
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter() (*HostLimiter, *time.Time) {
+	now := time.Date(2022, 10, 18, 10, 0, 0, 0, time.UTC)
+	l := NewHostLimiter()
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestHostLimiterTokenBucket(t *testing.T) {
+	l, now := newTestLimiter()
+	l.SetLimit("poiskzoo.ru", HostLimit{Rate: 2, Burst: 2})
+
+	// the burst is available at once, then the requests queue up at the rate
+	expected := []time.Duration{0, 0, 500 * time.Millisecond, time.Second}
+	for i, e := range expected {
+		if delay := l.reserve("poiskzoo.ru"); delay != e {
+			t.Errorf("request %d: expected delay %v, got %v", i, e, delay)
+		}
+	}
+	// other hosts are not affected
+	if delay := l.reserve("nominatim.openstreetmap.org"); delay != 0 {
+		t.Errorf("expected no delay for other host, got %v", delay)
+	}
+
+	*now = now.Add(10 * time.Second)
+	if delay := l.reserve("POISKZOO.RU"); delay != 0 {
+		t.Errorf("expected the bucket to refill, got %v", delay)
+	}
+}
+
+func TestHostLimiterCrawlDelay(t *testing.T) {
+	l, now := newTestLimiter()
+	l.SetLimit("poiskzoo.ru", HostLimit{Rate: 0, CrawlDelay: 3 * time.Second})
+
+	l.reserve("poiskzoo.ru")
+	if delay := l.reserve("poiskzoo.ru"); delay != 3*time.Second {
+		t.Errorf("expected the crawl delay, got %v", delay)
+	}
+	*now = now.Add(10 * time.Second)
+	if delay := l.reserve("poiskzoo.ru"); delay != 0 {
+		t.Errorf("expected no delay after the crawl delay passed, got %v", delay)
+	}
+}
+
+func TestHostLimiterSlowsDownOverloadedHost(t *testing.T) {
+	l, _ := newTestLimiter()
+	l.SetLimit("poiskzoo.ru", HostLimit{Rate: 1, Burst: 1})
+
+	for i := 0; i < 3; i++ {
+		l.Observe("poiskzoo.ru", 10*time.Second, false)
+	}
+	if slowdown := l.Slowdown("poiskzoo.ru"); slowdown != 8 {
+		t.Errorf("expected slowdown 8 after slow responses, got %v", slowdown)
+	}
+	l.reserve("poiskzoo.ru")
+	if delay := l.reserve("poiskzoo.ru"); delay != 8*time.Second {
+		t.Errorf("expected the rate to be divided by the slowdown, got delay %v", delay)
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Observe("poiskzoo.ru", 100*time.Millisecond, false)
+	}
+	if slowdown := l.Slowdown("poiskzoo.ru"); slowdown != 1 {
+		t.Errorf("expected the host to recover, got slowdown %v", slowdown)
+	}
+
+	for i := 0; i < 2; i++ {
+		l.Observe("poiskzoo.ru", 100*time.Millisecond, true)
+	}
+	if slowdown := l.Slowdown("poiskzoo.ru"); slowdown <= 1 {
+		t.Errorf("expected slowdown after the errors, got %v", slowdown)
+	}
+}
+
+func TestParseHostLimits(t *testing.T) {
+	limits, err := ParseHostLimits("poiskzoo.ru=1:2:500ms, *=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["poiskzoo.ru"] != (HostLimit{Rate: 1, Burst: 2, CrawlDelay: 500 * time.Millisecond}) {
+		t.Errorf("unexpected limit %+v", limits["poiskzoo.ru"])
+	}
+	if limits["*"] != (HostLimit{Rate: 4, Burst: 1}) {
+		t.Errorf("unexpected default limit %+v", limits["*"])
+	}
+	for _, invalid := range []string{"poiskzoo.ru", "poiskzoo.ru=fast", "poiskzoo.ru=1:0", "poiskzoo.ru=1:1:soon", "poiskzoo.ru=1:1:1s:1"} {
+		if _, err := ParseHostLimits(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
@@ -2,15 +2,21 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
 	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/version"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/html"
 	"golang.org/x/net/html/charset"
 )
 
@@ -18,97 +24,190 @@ func SetUserAgentHeader(header http.Header) {
 	header.Set("User-Agent", fmt.Sprintf("LostPetInitiative:poiskzoo-crawler / %s:%.6s (https://kashtanka.pet/)", version.AppVersion, version.GitCommit))
 }
 
-var httpClient http.Client = http.Client{}
-
 type HttpFetchResult struct {
 	Body        []byte
 	ContentType string
+	// the encoding the HTML body was recoded to UTF-8 from, empty for other content
+	Encoding string
 }
 
-// Performs the HTTP GET request over the specified targetURL and returns the response body as a string
-func HttpGet(targetUrl *url.URL, acceptHeader string) (*HttpFetchResult, error) {
-	req, err := http.NewRequest("GET", targetUrl.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Add("Accept", acceptHeader)
-	SetUserAgentHeader(req.Header)
+// Performs the HTTP GET request over the specified targetURL and returns the response body.
+// Not successful status is reported as HTTPStatusError
+func HttpGet(ctx context.Context, targetUrl *url.URL, acceptHeader string) (*HttpFetchResult, error) {
+	logger := logging.Component(ctx, "http")
+	header := make(http.Header)
+	header.Add("Accept", acceptHeader)
+	SetUserAgentHeader(header)
 
-	resp, err := httpClient.Do(req)
+	start := time.Now()
+	resp, err := DefaultClient.do(ctx, "GET", targetUrl, nil, header)
 	if err != nil {
+		logger.Debug("HTTP GET failed", "url", targetUrl.String(), "duration", time.Since(start), logging.ErrorKey, err)
 		return nil, err
 	}
 
-	defer resp.Body.Close()
-
 	var contentType string = resp.Header.Get(http.CanonicalHeaderKey("content-type"))
+	logger.Debug("HTTP GET", "url", targetUrl.String(), "status", resp.StatusCode, "bytes", len(resp.Body), "duration", time.Since(start))
+
+	return &HttpFetchResult{Body: resp.Body, ContentType: contentType}, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// Performs the HTTP GET request over the specified targetURL streaming the response body into a temp file in dir
+// (the default temp dir if empty), hashing it on the way. The body is limited by the limit of the class.
+// The caller removes the file. Not successful status is reported as HTTPStatusError
+func HttpDownload(ctx context.Context, targetUrl *url.URL, acceptHeader string, class ContentClass, dir string) (*DownloadedFile, error) {
+	logger := logging.Component(ctx, "http")
+	header := make(http.Header)
+	header.Add("Accept", acceptHeader)
+	SetUserAgentHeader(header)
+
+	start := time.Now()
+	file, err := DefaultClient.download(ctx, targetUrl, header, class, dir)
 	if err != nil {
+		logger.Debug("HTTP download failed", "url", targetUrl.String(), "duration", time.Since(start), logging.ErrorKey, err)
 		return nil, err
 	}
+	logger.Debug("HTTP download", "url", targetUrl.String(), "bytes", file.Size, "sha256", file.Sha256, "duration", time.Since(start))
+	return file, nil
+}
 
-	return &HttpFetchResult{body, contentType}, nil
+// Performs the HTTP POST request to the specified targetUrl. Returns the HTTP code if the response is received,
+// err is HTTPStatusError if the code is not successful (2xx). The request may be repeated, so it must be idempotent
+func HttpPost(ctx context.Context, targetUrl *url.URL, contentTypeHeader string, body []byte) (*int, error) {
+	return HttpPostWithHeaders(ctx, targetUrl, contentTypeHeader, body, nil)
 }
 
-// Performs the HTTP POST request to the specified targetUrl. Returns successful HTTP code, if returned err is nil
-func HttpPost(targetUrl *url.URL, contentTypeHeader string, body []byte) (*int, error) {
-	req, err := http.NewRequest("POST", targetUrl.String(), bytes.NewReader(body))
-	if err != nil {
-		return nil, err
+// Same as HttpPost, but sets the additional request headers
+// The trace context is passed to the server in the traceparent header
+func HttpPostWithHeaders(ctx context.Context, targetUrl *url.URL, contentTypeHeader string, body []byte, headers map[string]string) (*int, error) {
+	ctx, span := tracing.Start(ctx, "http.post",
+		attribute.String("http.url", targetUrl.String()),
+		attribute.Int("http.request_content_length", len(body)))
+	statusCode, err := httpPost(ctx, targetUrl, contentTypeHeader, body, headers)
+	if statusCode != nil {
+		span.SetAttributes(attribute.Int("http.status_code", *statusCode))
 	}
+	tracing.End(span, err)
+	return statusCode, err
+}
 
-	req.Header.Add("Content-Type", contentTypeHeader)
-	SetUserAgentHeader(req.Header)
+func httpPost(ctx context.Context, targetUrl *url.URL, contentTypeHeader string, body []byte, headers map[string]string) (*int, error) {
+	logger := logging.Component(ctx, "http")
+	header := make(http.Header)
+	header.Add("Content-Type", contentTypeHeader)
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+	SetUserAgentHeader(header)
+	tracing.InjectHeader(ctx, header)
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
+	start := time.Now()
+	resp, err := DefaultClient.do(ctx, "POST", targetUrl, body, header)
+	if resp == nil {
+		logger.Debug("HTTP POST failed", "url", targetUrl.String(), "duration", time.Since(start), logging.ErrorKey, err)
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 == 2 {
-		// successful
-		return &resp.StatusCode, nil
-	} else {
-		return nil, fmt.Errorf("not successful HTTP status: %s", resp.Status)
-	}
+	logger.Debug("HTTP POST", "url", targetUrl.String(), "status", resp.StatusCode, "bytes", len(body), "duration", time.Since(start))
+	return &resp.StatusCode, err
 }
 
-// Performs the HTTP GET request over the specified targetURL, recodes the response to UTF-8
-func HttpGetHtml(targetUrl *url.URL) (*HttpFetchResult, error) {
-	resp, err := HttpGet(targetUrl, types.HtmlMimeType)
+// Performs the HTTP GET request over the specified targetURL, recodes the response to UTF-8.
+// The encoding the page was decoded from is set in the result
+func HttpGetHtml(ctx context.Context, targetUrl *url.URL) (*HttpFetchResult, error) {
+	resp, err := HttpGet(ctx, targetUrl, types.HtmlMimeType)
 	if err != nil {
 		return nil, err
 	}
 
-	var declaredEncoding string
-	if strings.HasPrefix(resp.ContentType, "text/html; charset=") {
-		declaredEncoding = strings.TrimPrefix(resp.ContentType, "text/html; charset=")
+	encodingName, source := determineHtmlEncoding(ctx, resp.Body, resp.ContentType)
+	logging.Component(ctx, "http").Debug("Decoding HTML", "url", targetUrl.String(), "encoding", encodingName, "encoding_source", source)
+	decoded, err := decodeHtml(resp.Body, encodingName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode HTML of %s as %s: %w", targetUrl.String(), encodingName, err)
 	}
-	// log.Printf("HTML fetch: declared HTML page encoding: %s\n", declaredEncoding)
 
-	// determinedEnc, encName, certain := charset.DetermineEncoding(resp.Body, declaredEncoding)
-	_, encName, _ := charset.DetermineEncoding(resp.Body, declaredEncoding)
-	// log.Printf("HTML fetch: detected enc %v (%v); certain: %v\n", determinedEnc, encName, certain)
+	return &HttpFetchResult{
+		ContentType: resp.ContentType,
+		Body:        decoded,
+		Encoding:    encodingName,
+	}, nil
+}
 
-	bodyReader := bytes.NewReader(resp.Body)
-	if declaredEncoding == "" {
-		declaredEncoding = encName
+// Determines the encoding of the HTML page as browsers do: byte order mark first, then the charset of Content-Type header,
+// then meta tags, then the content itself. Returns the canonical encoding name and where it is taken from
+func determineHtmlEncoding(ctx context.Context, body []byte, contentType string) (string, string) {
+	// without the content type only BOM makes the result certain
+	_, name, certain := charset.DetermineEncoding(body, "")
+	if certain {
+		return name, "bom"
 	}
-	// log.Printf("HTML fetch: treating encoding as %v. ReEncoding body from it into UTF-8\n", declaredEncoding)
-	reEncodedBodyReader, err := charset.NewReaderLabel(declaredEncoding, bodyReader)
-	if err != nil {
-		log.Panicln(err)
+	if contentType != "" {
+		_, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			logging.Component(ctx, "http").Warn("Malformed Content-Type, detecting the encoding from the content", "content_type", contentType, logging.ErrorKey, err)
+		} else if label, ok := params["charset"]; ok {
+			if enc, headerName := charset.Lookup(label); enc != nil {
+				return headerName, "header"
+			}
+			logging.Component(ctx, "http").Warn("Unknown charset in Content-Type, detecting the encoding from the content", "charset", label)
+		}
 	}
-	reEncodedBody, err := io.ReadAll(reEncodedBodyReader)
-	if err != nil {
-		log.Panicln(err)
+	if metaName := metaCharset(body); metaName != "" {
+		return metaName, "meta"
 	}
+	return name, "content"
+}
 
-	return &HttpFetchResult{
-		ContentType: resp.ContentType,
-		Body:        reEncodedBody,
-	}, nil
+// Looks for the charset in meta tags within the first 1024 bytes, as the browsers do.
+// Returns the canonical encoding name, empty if there is no known one
+func metaCharset(body []byte) string {
+	if len(body) > 1024 {
+		body = body[:1024]
+	}
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return ""
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+		tagName, hasAttr := tokenizer.TagName()
+		if string(tagName) != "meta" {
+			continue
+		}
+		var label, httpEquiv, content string
+		for hasAttr {
+			var key, val []byte
+			key, val, hasAttr = tokenizer.TagAttr()
+			switch string(key) {
+			case "charset":
+				label = string(val)
+			case "http-equiv":
+				httpEquiv = string(val)
+			case "content":
+				content = string(val)
+			}
+		}
+		if label == "" && strings.EqualFold(httpEquiv, "content-type") {
+			if _, params, err := mime.ParseMediaType(content); err == nil {
+				label = params["charset"]
+			}
+		}
+		if label == "" {
+			continue
+		}
+		if enc, name := charset.Lookup(label); enc != nil {
+			return name
+		}
+	}
+}
 
+func decodeHtml(body []byte, encodingName string) ([]byte, error) {
+	reader, err := charset.NewReaderLabel(encodingName, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
 }
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned in cache only mode for the requests that are not cached
+type NotCachedError struct {
+	URL string
+}
+
+func (e *NotCachedError) Error() string {
+	return fmt.Sprintf("%s is not cached (cache only mode)", e.URL)
+}
+
+// Stored as <key>.json next to the <key>.body
+type httpCacheEntryJSON struct {
+	URL          string    `json:"url"`
+	Accept       string    `json:"accept"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	StoredAt     time.Time `json:"stored_at"`
+	Size         int64     `json:"size"`
+}
+
+type httpCacheEntry struct {
+	key        string
+	meta       httpCacheEntryJSON
+	accessedAt time.Time
+}
+
+// On-disk cache of GET responses. The cached responses are revalidated with conditional requests
+// (If-None-Match / If-Modified-Since) and served from the cache on 304 Not Modified.
+// Least recently used entries are evicted when the total size of the bodies exceeds MaxSizeBytes
+type HttpCache struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[string]*httpCacheEntry
+	size    int64
+	stats   CacheStats
+
+	// 0 means no limit
+	MaxSizeBytes int64
+	// the responses are served only from the cache, without network requests. For offline reparse runs
+	CacheOnly bool
+}
+
+// Opens (creating if needed) the cache stored in the specified directory
+func NewDiskHttpCache(dir string) (*HttpCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	c := &HttpCache{
+		dir:          dir,
+		entries:      make(map[string]*httpCacheEntry),
+		MaxSizeBytes: 1 << 30,
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		key := strings.TrimSuffix(name, ".json")
+		metaBytes, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+		entry := &httpCacheEntry{key: key, accessedAt: info.ModTime()}
+		if err := json.Unmarshal(metaBytes, &entry.meta); err != nil {
+			// partially written entry, the body is refetched
+			continue
+		}
+		c.entries[key] = entry
+		c.size += entry.meta.Size
+	}
+	return c, nil
+}
+
+func httpCacheKey(targetUrl *url.URL, accept string) string {
+	hash := sha256.Sum256([]byte(accept + "\n" + targetUrl.String()))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *HttpCache) metaPath(key string) string {
+	return path.Join(c.dir, key+".json")
+}
+
+func (c *HttpCache) bodyPath(key string) string {
+	return path.Join(c.dir, key+".body")
+}
+
+func (c *HttpCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Total size of the cached bodies
+func (c *HttpCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *HttpCache) lookup(targetUrl *url.URL, accept string) *httpCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[httpCacheKey(targetUrl, accept)]
+}
+
+// Reads the cached response, marking the entry as recently used
+func (c *HttpCache) load(entry *httpCacheEntry) (*httpResponse, error) {
+	body, err := os.ReadFile(c.bodyPath(entry.key))
+	if err != nil {
+		c.remove(entry)
+		return nil, err
+	}
+	now := time.Now()
+	c.mu.Lock()
+	entry.accessedAt = now
+	c.stats.Hits++
+	c.mu.Unlock()
+	// the access time survives restarts as the modification time of the metadata
+	os.Chtimes(c.metaPath(entry.key), now, now)
+
+	header := make(http.Header)
+	header.Set("Content-Type", entry.meta.ContentType)
+	if entry.meta.ETag != "" {
+		header.Set("ETag", entry.meta.ETag)
+	}
+	if entry.meta.LastModified != "" {
+		header.Set("Last-Modified", entry.meta.LastModified)
+	}
+	return &httpResponse{StatusCode: http.StatusOK, Header: header, Body: body}, nil
+}
+
+// Adds the validators of the cached entry to the request headers
+func (entry *httpCacheEntry) setConditionalHeaders(header http.Header) {
+	if entry.meta.ETag != "" {
+		header.Set("If-None-Match", entry.meta.ETag)
+	}
+	if entry.meta.LastModified != "" {
+		header.Set("If-Modified-Since", entry.meta.LastModified)
+	}
+}
+
+func writeFileViaTemp(dir string, filePath string, data []byte) error {
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filePath)
+}
+
+// Caches the fetched response (counted as a miss), evicting the least recently used entries if the cache is too large
+func (c *HttpCache) store(targetUrl *url.URL, accept string, resp *httpResponse) error {
+	key := httpCacheKey(targetUrl, accept)
+	meta := httpCacheEntryJSON{
+		URL:          targetUrl.String(),
+		Accept:       accept,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		StoredAt:     time.Now().UTC(),
+		Size:         int64(len(resp.Body)),
+	}
+	metaBytes, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Misses++
+	if c.MaxSizeBytes > 0 && meta.Size > c.MaxSizeBytes {
+		return nil
+	}
+	// body goes first, so the metadata never points to the missing body
+	if err := writeFileViaTemp(c.dir, c.bodyPath(key), resp.Body); err != nil {
+		return err
+	}
+	if err := writeFileViaTemp(c.dir, c.metaPath(key), metaBytes); err != nil {
+		return err
+	}
+	if previous, ok := c.entries[key]; ok {
+		c.size -= previous.meta.Size
+	}
+	c.entries[key] = &httpCacheEntry{key: key, meta: meta, accessedAt: time.Now()}
+	c.size += meta.Size
+	return c.evict()
+}
+
+// Must be called with the mutex held
+func (c *HttpCache) evict() error {
+	if c.MaxSizeBytes <= 0 || c.size <= c.MaxSizeBytes {
+		return nil
+	}
+	entries := make([]*httpCacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].accessedAt.Before(entries[j].accessedAt) })
+	for _, entry := range entries {
+		if c.size <= c.MaxSizeBytes {
+			break
+		}
+		if err := c.removeLocked(entry); err != nil {
+			return err
+		}
+		c.stats.Evictions++
+	}
+	return nil
+}
+
+func (c *HttpCache) remove(entry *httpCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(entry)
+}
+
+// Must be called with the mutex held
+func (c *HttpCache) removeLocked(entry *httpCacheEntry) error {
+	current, ok := c.entries[entry.key]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, entry.key)
+	c.size -= current.meta.Size
+	for _, filePath := range []string{c.metaPath(entry.key), c.bodyPath(entry.key)} {
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newCachedTestClient(t *testing.T, dir string) *Client {
+	c, _ := newTestClient()
+	cache, err := NewDiskHttpCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Cache = cache
+	return c
+}
+
+func get(c *Client, targetUrl *url.URL) (*httpResponse, error) {
+	header := make(http.Header)
+	header.Set("Accept", "text/html")
+	return c.do(context.Background(), "GET", targetUrl, nil, header)
+}
+
+func TestHttpCacheRevalidatesWithETag(t *testing.T) {
+	var conditional []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html>card</html>"))
+	}))
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL + "/164971")
+	dir := t.TempDir()
+	c := newCachedTestClient(t, dir)
+
+	for i := 0; i < 2; i++ {
+		resp, err := get(c, serverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != "<html>card</html>" || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("request %d: unexpected response %q %v", i, resp.Body, resp.Header)
+		}
+	}
+	if len(conditional) != 2 || conditional[0] != "" || conditional[1] != `"v1"` {
+		t.Errorf("expected the second request to be conditional, got %v", conditional)
+	}
+	if stats := c.Cache.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// the cache survives restarts, cache only mode does not go to the network
+	server.Close()
+	c = newCachedTestClient(t, dir)
+	c.Cache.CacheOnly = true
+	resp, err := get(c, serverUrl)
+	if err != nil || string(resp.Body) != "<html>card</html>" {
+		t.Errorf("expected the cached response, got %v %v", resp, err)
+	}
+	other, _ := url.Parse(server.URL + "/164972")
+	_, err = get(c, other)
+	var notCached *NotCachedError
+	if !errors.As(err, &notCached) {
+		t.Errorf("expected NotCachedError, got %v", err)
+	}
+}
+
+func TestHttpCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	t.Cleanup(server.Close)
+	c := newCachedTestClient(t, t.TempDir())
+	c.Cache.MaxSizeBytes = 250
+
+	urls := make([]*url.URL, 0)
+	for _, p := range []string{"/1", "/2", "/1", "/3"} {
+		u, _ := url.Parse(server.URL + p)
+		urls = append(urls, u)
+		if _, err := get(c, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Cache.Size() != 200 || c.Cache.Stats().Evictions != 1 {
+		t.Errorf("expected one eviction down to 200 bytes, got %d bytes, %+v", c.Cache.Size(), c.Cache.Stats())
+	}
+	if c.Cache.lookup(urls[1], "text/html") != nil {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if c.Cache.lookup(urls[0], "text/html") == nil || c.Cache.lookup(urls[3], "text/html") == nil {
+		t.Error("expected the recently used entries to stay")
+	}
+}
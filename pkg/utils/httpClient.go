@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+)
+
+// Returned when the server responds with a not successful (non 2xx) status
+type HTTPStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	// the delay requested by the server with Retry-After header, 0 if not specified
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("not successful HTTP status of %s %s: %s", e.Method, e.URL, e.Status)
+}
+
+// Whether the request may succeed if repeated later: server errors and throttling
+func (e *HTTPStatusError) Temporary() bool {
+	return e.StatusCode/100 == 5 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Returns the HTTP status code if err is (or wraps) HTTPStatusError
+func StatusCodeOf(err error) (int, bool) {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode, true
+	}
+	return 0, false
+}
+
+// HTTP client that limits the duration of each attempt and retries the failed requests
+// (network errors, 5xx and 429 responses) with jittered exponential backoff, honoring Retry-After
+type Client struct {
+	httpClient *http.Client
+
+	// limits each attempt, including reading of the response body
+	Timeout time.Duration
+	// 1 disables retries
+	MaxAttempts int
+	// the delay before the first retry
+	MinBackoff time.Duration
+	// the upper bound of the delay between retries
+	MaxBackoff time.Duration
+	// if the server asks to retry later than this, the error is returned without waiting
+	MaxRetryAfter time.Duration
+	// politeness limits of the hosts, nil disables them
+	Limiter *HostLimiter
+	// if not nil, GET requests disallowed by robots.txt fail with RobotsDisallowedError
+	Robots *RobotsGate
+	// if not nil, GET responses are cached and revalidated with conditional requests
+	Cache *HttpCache
+	// the responses larger than the limit of their content class fail with BodyTooLargeError. 0 or absent means no limit
+	MaxBodyBytes map[ContentClass]int64
+
+	// to be replaced in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewClient() *Client {
+	return &Client{
+		httpClient:    &http.Client{},
+		Timeout:       30 * time.Second,
+		MaxAttempts:   3,
+		MinBackoff:    time.Second,
+		MaxBackoff:    30 * time.Second,
+		MaxRetryAfter: 2 * time.Minute,
+		Limiter:       NewHostLimiter(),
+		MaxBodyBytes:  DefaultBodyLimits(),
+		sleep:         sleepCtx,
+	}
+}
+
+// Replaces the transport the requests are sent with, e.g. to record or replay them
+func (c *Client) SetTransport(transport http.RoundTripper) {
+	c.httpClient.Transport = transport
+}
+
+// The transport the requests are sent with
+func (c *Client) Transport() http.RoundTripper {
+	if c.httpClient.Transport == nil {
+		return http.DefaultTransport
+	}
+	return c.httpClient.Transport
+}
+
+// Used by HttpGet, HttpGetHtml and HttpPost, so all of them share the host limits
+var DefaultClient *Client = NewClient()
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type httpResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// set instead of Body for the successful responses streamed to file
+	File *DownloadedFile
+}
+
+// Parses Retry-After header given either in seconds or as HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// Returns the delay before the next attempt after the specified number of failed attempts.
+// The delay is doubled with each attempt and jittered within [50%, 100%] of its value
+func (c *Client) backoff(failedAttempts int) time.Duration {
+	delay := c.MinBackoff
+	for i := 1; i < failedAttempts && delay < c.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// single attempt limited by Timeout, waits for its turn with the Limiter first
+func (c *Client) attempt(ctx context.Context, method string, targetUrl *url.URL, body []byte, header http.Header, opts bodyOptions) (*httpResponse, error) {
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx, targetUrl.Hostname()); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := c.timedAttempt(ctx, method, targetUrl, body, header, opts)
+		var statusErr *HTTPStatusError
+		var tooLargeErr *BodyTooLargeError
+		failed := (err != nil && ctx.Err() == nil && !errors.As(err, &statusErr) && !errors.As(err, &tooLargeErr)) || (statusErr != nil && statusErr.Temporary())
+		c.Limiter.Observe(targetUrl.Hostname(), time.Since(start), failed)
+		return resp, err
+	}
+	return c.timedAttempt(ctx, method, targetUrl, body, header, opts)
+}
+
+func (c *Client) timedAttempt(ctx context.Context, method string, targetUrl *url.URL, body []byte, header http.Header, opts bodyOptions) (*httpResponse, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, targetUrl.String(), bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// failing early if the server declares the body too large
+	limit := c.MaxBodyBytes[opts.class]
+	if limit > 0 && resp.ContentLength > limit {
+		return nil, &BodyTooLargeError{URL: targetUrl.String(), Class: opts.class, Limit: limit}
+	}
+	result := &httpResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}
+	if opts.toFile && resp.StatusCode/100 == 2 {
+		result.File, err = spoolToFile(resp.Body, opts.dir, limit, targetUrl.String(), opts.class)
+		if err != nil {
+			return nil, err
+		}
+		result.File.ContentType = resp.Header.Get("Content-Type")
+	} else {
+		result.Body, err = readLimited(resp.Body, limit, targetUrl.String(), opts.class)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode/100 != 2 {
+		return result, &HTTPStatusError{
+			Method:     method,
+			URL:        targetUrl.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return result, nil
+}
+
+// Performs the request, serving GET requests from the Cache if it is set.
+// On not successful status the response is returned along with HTTPStatusError
+func (c *Client) do(ctx context.Context, method string, targetUrl *url.URL, body []byte, header http.Header) (*httpResponse, error) {
+	if c.Cache != nil && method == "GET" {
+		return c.cachedGet(ctx, targetUrl, header)
+	}
+	return c.fetch(ctx, method, targetUrl, body, header, bodyOptions{class: contentClassOf(header.Get("Accept"))})
+}
+
+// Performs GET request streaming the response body to a temp file in dir (the default temp dir if empty).
+// The downloads are not cached, as they are not kept in memory
+func (c *Client) download(ctx context.Context, targetUrl *url.URL, header http.Header, class ContentClass, dir string) (*DownloadedFile, error) {
+	resp, err := c.fetch(ctx, "GET", targetUrl, nil, header, bodyOptions{class: class, toFile: true, dir: dir})
+	if err != nil {
+		return nil, err
+	}
+	return resp.File, nil
+}
+
+func (c *Client) cachedGet(ctx context.Context, targetUrl *url.URL, header http.Header) (*httpResponse, error) {
+	logger := logging.Component(ctx, "http")
+	accept := header.Get("Accept")
+	entry := c.Cache.lookup(targetUrl, accept)
+	if c.Cache.CacheOnly {
+		if entry == nil {
+			return nil, &NotCachedError{URL: targetUrl.String()}
+		}
+		return c.Cache.load(entry)
+	}
+
+	conditionalHeader := header
+	if entry != nil {
+		conditionalHeader = header.Clone()
+		entry.setConditionalHeaders(conditionalHeader)
+	}
+	opts := bodyOptions{class: contentClassOf(accept)}
+	resp, err := c.fetch(ctx, "GET", targetUrl, nil, conditionalHeader, opts)
+	if statusCode, ok := StatusCodeOf(err); ok && statusCode == http.StatusNotModified && entry != nil {
+		cached, loadErr := c.Cache.load(entry)
+		if loadErr == nil {
+			logger.Debug("Not modified, served from the cache", "url", targetUrl.String())
+			return cached, nil
+		}
+		// the cached body is lost, fetching it unconditionally
+		logger.Warn("Failed to read the cached response", "url", targetUrl.String(), logging.ErrorKey, loadErr)
+		resp, err = c.fetch(ctx, "GET", targetUrl, nil, header, opts)
+	}
+	if err == nil {
+		if storeErr := c.Cache.store(targetUrl, accept, resp); storeErr != nil {
+			logger.Warn("Failed to cache the response", "url", targetUrl.String(), logging.ErrorKey, storeErr)
+		}
+	}
+	return resp, err
+}
+
+// Performs the request, retrying it on temporary failures. The requests must be idempotent, as they can be repeated
+func (c *Client) fetch(ctx context.Context, method string, targetUrl *url.URL, body []byte, header http.Header, opts bodyOptions) (*httpResponse, error) {
+	if c.Robots != nil && method == "GET" {
+		if err := c.Robots.check(ctx, c, targetUrl); err != nil {
+			return nil, err
+		}
+	}
+	return c.fetchWithRetries(ctx, method, targetUrl, body, header, opts)
+}
+
+// Same as fetch, but without the robots.txt check (e.g. to fetch robots.txt itself)
+func (c *Client) fetchWithRetries(ctx context.Context, method string, targetUrl *url.URL, body []byte, header http.Header, opts bodyOptions) (*httpResponse, error) {
+	logger := logging.Component(ctx, "http")
+	for attempt := 1; ; attempt++ {
+		resp, err := c.attempt(ctx, method, targetUrl, body, header, opts)
+		if err == nil || attempt >= c.MaxAttempts || ctx.Err() != nil {
+			return resp, err
+		}
+		// the same body will come again
+		var tooLargeErr *BodyTooLargeError
+		if errors.As(err, &tooLargeErr) {
+			return resp, err
+		}
+
+		delay := c.backoff(attempt)
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) {
+			if !statusErr.Temporary() {
+				return resp, err
+			}
+			if statusErr.RetryAfter > c.MaxRetryAfter {
+				logger.Warn("The server asks to retry too late, giving up", "url", targetUrl.String(), "retry_after", statusErr.RetryAfter)
+				return resp, err
+			}
+			if statusErr.RetryAfter > delay {
+				delay = statusErr.RetryAfter
+			}
+		}
+		logger.Warn("HTTP request failed, retrying", "method", method, "url", targetUrl.String(), "attempt", attempt, "delay", delay, logging.ErrorKey, err)
+		if sleepErr := c.sleep(ctx, delay); sleepErr != nil {
+			return resp, err
+		}
+	}
+}
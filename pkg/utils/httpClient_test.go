@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the client that records the delays between the attempts instead of sleeping
+func newTestClient() (*Client, *[]time.Duration) {
+	delays := make([]time.Duration, 0)
+	c := NewClient()
+	c.Limiter = nil
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	return c, &delays
+}
+
+func newFlakyServer(t *testing.T, failures int, failure func(w http.ResponseWriter)) (*url.URL, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(atomic.AddInt32(&calls, 1)) <= failures {
+			failure(w)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL)
+	return serverUrl, &calls
+}
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	serverUrl, calls := newFlakyServer(t, 2, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	c, delays := newTestClient()
+
+	resp, err := c.do(context.Background(), "GET", serverUrl, nil, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "ok" || *calls != 3 {
+		t.Errorf("unexpected body %q after %d calls", resp.Body, *calls)
+	}
+	if len(*delays) != 2 || (*delays)[0] < c.MinBackoff/2 || (*delays)[1] > 2*c.MinBackoff {
+		t.Errorf("unexpected backoff delays %v", *delays)
+	}
+}
+
+func TestClientHonorsRetryAfter(t *testing.T) {
+	serverUrl, _ := newFlakyServer(t, 1, func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	c, delays := newTestClient()
+
+	_, err := c.do(context.Background(), "GET", serverUrl, nil, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*delays) != 1 || (*delays)[0] != 7*time.Second {
+		t.Errorf("expected to wait for Retry-After, waited %v", *delays)
+	}
+
+	serverUrl, calls := newFlakyServer(t, 1, func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	_, err = c.do(context.Background(), "GET", serverUrl, nil, http.Header{})
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter != time.Hour || *calls != 1 {
+		t.Errorf("expected to give up on too long Retry-After, got %v after %d calls", err, *calls)
+	}
+}
+
+func TestClientDoesNotRetryClientErrors(t *testing.T) {
+	serverUrl, calls := newFlakyServer(t, 10, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	c, _ := newTestClient()
+
+	_, err := c.do(context.Background(), "GET", serverUrl, nil, http.Header{})
+	if statusCode, ok := StatusCodeOf(err); !ok || statusCode != http.StatusNotFound {
+		t.Errorf("expected HTTPStatusError with 404, got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("expected no retries, got %d calls", *calls)
+	}
+}
+
+func TestClientTimesOutStalledAttempts(t *testing.T) {
+	release := make(chan struct{})
+	serverUrl, calls := newFlakyServer(t, 1, func(w http.ResponseWriter) {
+		<-release
+	})
+	t.Cleanup(func() { close(release) })
+	c, _ := newTestClient()
+	c.Timeout = 50 * time.Millisecond
+
+	resp, err := c.do(context.Background(), "GET", serverUrl, nil, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "ok" || *calls != 2 {
+		t.Errorf("expected the stalled attempt to be retried, got %q after %d calls", resp.Body, *calls)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 10, 18, 10, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"Tue, 18 Oct 2022 10:00:30 GMT": 30 * time.Second,
+		"Tue, 18 Oct 2022 09:00:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if actual := parseRetryAfter(value, now); actual != expected {
+			t.Errorf("Retry-After %q: expected %v, got %v", value, expected, actual)
+		}
+	}
+}
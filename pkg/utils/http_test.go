@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestHtmlEncodingDetection(t *testing.T) {
+	text := "<html><body>Пропала собака</body></html>"
+	cp1251, err := charmap.Windows1251.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	koi8, err := charmap.KOI8R.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp1251Meta := `<html><head><meta http-equiv="Content-Type" content="text/html; charset=windows-1251"></head>` + cp1251[6:]
+
+	testCases := []struct {
+		name        string
+		body        string
+		contentType string
+		encoding    string
+		source      string
+	}{
+		{"header without space", cp1251, "text/html;charset=windows-1251", "windows-1251", "header"},
+		{"quoted upper case header", koi8, `text/html; charset="KOI8-R"`, "koi8-r", "header"},
+		{"unknown header charset falls back to meta", cp1251Meta, "text/html; charset=x-no-such-charset", "windows-1251", "meta"},
+		{"malformed header falls back to meta", cp1251Meta, "text/html; charset", "windows-1251", "meta"},
+		{"meta charset attribute", `<html><head><meta charset="koi8-r"></head>` + koi8[6:], "text/html", "koi8-r", "meta"},
+		{"BOM wins over header", "\xef\xbb\xbf" + text, "text/html; charset=windows-1251", "utf-8", "bom"},
+		{"no charset at all", text, "text/html", "utf-8", "content"},
+	}
+
+	for _, testCase := range testCases {
+		name, source := determineHtmlEncoding(context.Background(), []byte(testCase.body), testCase.contentType)
+		if name != testCase.encoding || source != testCase.source {
+			t.Errorf("%s: expected %s from %s, got %s from %s", testCase.name, testCase.encoding, testCase.source, name, source)
+			continue
+		}
+		decoded, err := decodeHtml([]byte(testCase.body), name)
+		if err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+			continue
+		}
+		if !strings.Contains(string(decoded), "Пропала собака") {
+			t.Errorf("%s: unexpected decoded body %q", testCase.name, decoded)
+		}
+	}
+}
+
+func TestDecodeHtmlRejectsUnknownEncoding(t *testing.T) {
+	if _, err := decodeHtml([]byte("<html></html>"), "x-no-such-charset"); err == nil {
+		t.Error("expected an error for unknown encoding")
+	}
+}
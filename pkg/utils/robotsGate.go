@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/robots"
+)
+
+// Returned instead of fetching the URL disallowed by robots.txt
+type RobotsDisallowedError struct {
+	URL string
+}
+
+func (e *RobotsDisallowedError) Error() string {
+	return fmt.Sprintf("%s is disallowed by robots.txt", e.URL)
+}
+
+// Returned instead of fetching the URL while robots.txt of its host can't be fetched (5xx or network error).
+// Unlike RobotsDisallowedError it is temporary, the URL is to be fetched later
+type RobotsUnavailableError struct {
+	URL string
+	Err error
+}
+
+func (e *RobotsUnavailableError) Error() string {
+	return fmt.Sprintf("%s is not fetched, as robots.txt is unreachable: %v", e.URL, e.Err)
+}
+
+func (e *RobotsUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+type cachedRobots struct {
+	// nil if robots.txt is unreachable
+	rules *robots.Rules
+	// why robots.txt is unreachable
+	err       error
+	expiresAt time.Time
+}
+
+// robots.txt of the host. Its own lock lets the workers wait for the single fetch without blocking the other hosts
+type hostRobots struct {
+	mu     sync.Mutex
+	cached *cachedRobots
+}
+
+// Checks the URLs of the crawled hosts against their robots.txt before fetching them.
+// robots.txt of the host is fetched on the first request to it and refreshed periodically
+type RobotsGate struct {
+	// guards the cache map, not the fetches
+	mu      sync.Mutex
+	hosts   map[string]bool
+	cache   map[string]*hostRobots
+	skipped atomic.Uint64
+
+	// how long the fetched robots.txt is used before fetching it again
+	RefreshInterval time.Duration
+	// how soon unreachable robots.txt is fetched again. Meanwhile the requests to the host fail with RobotsUnavailableError
+	RetryInterval time.Duration
+
+	// to be replaced in tests
+	now func() time.Time
+}
+
+// Only the requests to the specified hosts are checked. The APIs used by the crawler (e.g. Nominatim) are not crawled
+func NewRobotsGate(hosts ...string) *RobotsGate {
+	g := &RobotsGate{
+		hosts:           make(map[string]bool),
+		cache:           make(map[string]*hostRobots),
+		RefreshInterval: 24 * time.Hour,
+		RetryInterval:   10 * time.Minute,
+		now:             time.Now,
+	}
+	for _, host := range hosts {
+		g.hosts[strings.ToLower(host)] = true
+	}
+	return g
+}
+
+// The number of the URLs skipped as disallowed
+func (g *RobotsGate) Skipped() uint64 {
+	return g.skipped.Load()
+}
+
+// Fetches robots.txt of the host, retrying temporary failures. Missing robots.txt (4xx) allows everything.
+// Unreachable one (5xx or network error) disallows everything (RFC 9309) unless the previously fetched one is available,
+// the disallowed requests are to be retried later
+func (g *RobotsGate) fetch(ctx context.Context, c *Client, targetUrl *url.URL, previous *cachedRobots) *cachedRobots {
+	logger := logging.Component(ctx, "robots")
+	robotsUrl := &url.URL{Scheme: targetUrl.Scheme, Host: targetUrl.Host, Path: "/robots.txt"}
+	header := make(http.Header)
+	header.Add("Accept", "text/plain")
+	SetUserAgentHeader(header)
+
+	now := g.now()
+	resp, err := c.fetchWithRetries(ctx, "GET", robotsUrl, nil, header, bodyOptions{class: ContentClassOther})
+	var statusErr *HTTPStatusError
+	switch {
+	case err == nil:
+		rules := robots.Parse(resp.Body, header.Get("User-Agent"))
+		logger.Info("Fetched robots.txt", "url", robotsUrl.String(), "crawl_delay", rules.CrawlDelay())
+		if c.Limiter != nil && rules.CrawlDelay() > 0 {
+			c.Limiter.SetCrawlDelay(targetUrl.Hostname(), rules.CrawlDelay())
+		}
+		return &cachedRobots{rules: rules, expiresAt: now.Add(g.RefreshInterval)}
+	case errors.As(err, &statusErr) && statusErr.StatusCode/100 == 4:
+		logger.Info("No robots.txt, everything is allowed", "url", robotsUrl.String(), "status", statusErr.StatusCode)
+		return &cachedRobots{rules: robots.AllowAll(), expiresAt: now.Add(g.RefreshInterval)}
+	case previous != nil && previous.rules != nil:
+		logger.Warn("Failed to refresh robots.txt, using the previous one", "url", robotsUrl.String(), logging.ErrorKey, err)
+		return &cachedRobots{rules: previous.rules, expiresAt: now.Add(g.RetryInterval)}
+	default:
+		logger.Warn("Failed to fetch robots.txt, the host is not crawled until it is fetched", "url", robotsUrl.String(), logging.ErrorKey, err)
+		return &cachedRobots{err: err, expiresAt: now.Add(g.RetryInterval)}
+	}
+}
+
+// Returns RobotsDisallowedError if the URL must not be fetched,
+// RobotsUnavailableError if it can't be fetched until robots.txt is available
+func (g *RobotsGate) check(ctx context.Context, c *Client, targetUrl *url.URL) error {
+	host := strings.ToLower(targetUrl.Hostname())
+	if !g.hosts[host] {
+		return nil
+	}
+
+	g.mu.Lock()
+	entry, ok := g.cache[host]
+	if !ok {
+		entry = &hostRobots{}
+		g.cache[host] = entry
+	}
+	g.mu.Unlock()
+
+	// fetching under the host lock, so robots.txt is requested once even by the concurrent workers
+	entry.mu.Lock()
+	if entry.cached == nil || !g.now().Before(entry.cached.expiresAt) {
+		entry.cached = g.fetch(ctx, c, targetUrl, entry.cached)
+	}
+	cached := entry.cached
+	entry.mu.Unlock()
+
+	if cached.rules == nil {
+		return &RobotsUnavailableError{URL: targetUrl.String(), Err: cached.err}
+	}
+	if cached.rules.Allowed(targetUrl.RequestURI()) {
+		return nil
+	}
+	g.skipped.Add(1)
+	logging.Component(ctx, "robots").Warn("URL is disallowed by robots.txt, skipping it", "url", targetUrl.String())
+	return &RobotsDisallowedError{URL: targetUrl.String()}
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newRobotsServer(t *testing.T, robotsStatus *int) (*url.URL, *[]string) {
+	requested := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		if r.URL.Path == "/robots.txt" {
+			w.WriteHeader(*robotsStatus)
+			w.Write([]byte("User-agent: *\nDisallow: /private\nCrawl-delay: 3\n"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL)
+	return serverUrl, &requested
+}
+
+func TestRobotsGateSkipsDisallowedUrls(t *testing.T) {
+	robotsStatus := http.StatusOK
+	serverUrl, requested := newRobotsServer(t, &robotsStatus)
+	c, _ := newTestClient()
+	c.Limiter = NewHostLimiter()
+	c.Robots = NewRobotsGate(serverUrl.Hostname())
+	now := time.Date(2022, 10, 18, 10, 0, 0, 0, time.UTC)
+	c.Robots.now = func() time.Time { return now }
+
+	_, err := c.do(context.Background(), "GET", serverUrl.JoinPath("private", "page"), nil, http.Header{})
+	var robotsErr *RobotsDisallowedError
+	if !errors.As(err, &robotsErr) {
+		t.Errorf("expected RobotsDisallowedError, got %v", err)
+	}
+	// the crawl delay is shortened to keep the test fast, but it must be picked up from robots.txt first
+	if c.Limiter.limits[serverUrl.Hostname()].CrawlDelay != 3*time.Second {
+		t.Errorf("expected Crawl-delay to be passed to the limiter, got %+v", c.Limiter.limits[serverUrl.Hostname()])
+	}
+	c.Limiter.SetCrawlDelay(serverUrl.Hostname(), 0)
+
+	_, err = c.do(context.Background(), "GET", serverUrl.JoinPath("public"), nil, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requested) != 2 || (*requested)[0] != "/robots.txt" || (*requested)[1] != "/public" {
+		t.Errorf("expected robots.txt to be fetched once and the disallowed page to be skipped, got %v", *requested)
+	}
+	if c.Robots.Skipped() != 1 {
+		t.Errorf("expected 1 skipped URL, got %d", c.Robots.Skipped())
+	}
+
+	// unreachable robots.txt keeps the previous rules after the refresh (retried, not slowed down by the limiter)
+	c.Limiter = nil
+	robotsStatus = http.StatusServiceUnavailable
+	now = now.Add(25 * time.Hour)
+	_, err = c.do(context.Background(), "GET", serverUrl.JoinPath("private"), nil, http.Header{})
+	if !errors.As(err, &robotsErr) || len(*requested) != 2+c.MaxAttempts {
+		t.Errorf("expected robots.txt to be refreshed and the previous rules used, got %v, %v", err, *requested)
+	}
+}
+
+func TestRobotsGateMissingAndUnreachableRobots(t *testing.T) {
+	robotsStatus := http.StatusNotFound
+	serverUrl, _ := newRobotsServer(t, &robotsStatus)
+	c, _ := newTestClient()
+	c.Robots = NewRobotsGate(serverUrl.Hostname())
+
+	if _, err := c.do(context.Background(), "GET", serverUrl.JoinPath("private"), nil, http.Header{}); err != nil {
+		t.Errorf("missing robots.txt must allow everything, got %v", err)
+	}
+
+	robotsStatus = http.StatusInternalServerError
+	c.Robots = NewRobotsGate(serverUrl.Hostname())
+	now := time.Date(2022, 10, 18, 10, 0, 0, 0, time.UTC)
+	c.Robots.now = func() time.Time { return now }
+	_, err := c.do(context.Background(), "GET", serverUrl.JoinPath("public"), nil, http.Header{})
+	var unavailableErr *RobotsUnavailableError
+	if !errors.As(err, &unavailableErr) {
+		t.Errorf("unreachable robots.txt must postpone everything, got %v", err)
+	}
+	var robotsErr *RobotsDisallowedError
+	if errors.As(err, &robotsErr) {
+		t.Errorf("unreachable robots.txt must not be taken for the disallow rule, got %v", err)
+	}
+
+	// fetched again after the retry interval
+	robotsStatus = http.StatusOK
+	now = now.Add(c.Robots.RetryInterval)
+	if _, err := c.do(context.Background(), "GET", serverUrl.JoinPath("public"), nil, http.Header{}); err != nil {
+		t.Errorf("expected the URL to be fetched once robots.txt is available, got %v", err)
+	}
+
+	// the hosts not listed are not checked
+	c.Robots = NewRobotsGate("poiskzoo.ru")
+	if _, err := c.do(context.Background(), "GET", serverUrl.JoinPath("private"), nil, http.Header{}); err != nil {
+		t.Errorf("expected other hosts not to be checked, got %v", err)
+	}
+}
+
+func TestRobotsFetchIsRetried(t *testing.T) {
+	serverUrl, calls := newFlakyServer(t, 1, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	c, delays := newTestClient()
+	c.Robots = NewRobotsGate(serverUrl.Hostname())
+
+	if _, err := c.do(context.Background(), "GET", serverUrl.JoinPath("page"), nil, http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	// robots.txt twice, then the page
+	if *calls != 3 || len(*delays) != 1 {
+		t.Errorf("expected robots.txt to be retried once, got %d calls and %d retries", *calls, len(*delays))
+	}
+}
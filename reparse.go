@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"log/slog"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/crawler"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+)
+
+// Rebuilds card.json of the stored cards from their stored pages, without fetching anything.
+// The cards stored before the pages were kept are left as is
+func runReparse(args []string) {
+	flags := flag.NewFlagSet("reparse", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the cards that would change")
+	configFlags := addConfigFlags(flags)
+	flags.Parse(args)
+	cfg := configFlags.load()
+
+	cards, err := parseCardIDArgs(flags.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, cardStorage, storedCards, err := openCardStorage(cfg)
+	exitOnSetupError(err)
+	if len(cards) == 0 {
+		cards = storedCards
+	}
+
+	var changed, unchanged, noPage, failed int
+	for _, card := range cards {
+		stored, err := cardStorage.LoadCardJSON(card)
+		if err != nil {
+			slog.Error("Failed to load stored card", logging.CardIDKey, card, logging.ErrorKey, err)
+			failed++
+			continue
+		}
+		page, fetchedAt, err := cardStorage.LoadCardPage(card)
+		if errors.Is(err, fs.ErrNotExist) {
+			noPage++
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to load stored card page", logging.CardIDKey, card, logging.ErrorKey, err)
+			failed++
+			continue
+		}
+
+		rebuilt := crawler.ReparseCardJSON(card, stored, page, fetchedAt)
+		if rebuilt.JsonSerialize() == stored.JsonSerialize() {
+			unchanged++
+			continue
+		}
+		changed++
+		if *dryRun {
+			slog.Info("Card would change", logging.CardIDKey, card)
+			continue
+		}
+		if err := cardStorage.SaveCardJSON(card, rebuilt); err != nil {
+			slog.Error("Failed to save reparsed card", logging.CardIDKey, card, logging.ErrorKey, err)
+			failed++
+			changed--
+			continue
+		}
+		slog.Info("Card is reparsed", logging.CardIDKey, card)
+	}
+	slog.Info("Reparse finished", "changed", changed, "unchanged", unchanged, "no_page", noPage, "failed", failed, "dry_run", *dryRun)
+}
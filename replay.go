@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"log/slog"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/outbox"
+)
+
+// parses either RFC3339 timestamp or a date in YYYY-MM-DD format (UTC)
+func parseTimeArg(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// Reschedules the delivery of the pipeline notifications enqueued within the time range.
+// The running crawler picks them up with its next outbox poll. The outbox dir is locked during the changes, so it is
+// safe to run alongside the crawler (on the platforms without file locks the crawler is to be stopped first)
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	fromStr := flags.String("from", "0001-01-01", "start of the time range (inclusive), RFC3339 or YYYY-MM-DD")
+	toStr := flags.String("to", "9999-12-31", "end of the time range (exclusive), RFC3339 or YYYY-MM-DD")
+	all := flags.Bool("all", false, "replay already delivered notifications as well, not only undelivered ones")
+	configFlags := addConfigFlags(flags)
+	flags.Parse(args)
+	cfg := configFlags.load()
+
+	from, err := parseTimeArg(*fromStr)
+	if err != nil {
+		log.Fatalf("Can't parse -from %q: %v", *fromStr, err)
+	}
+	to, err := parseTimeArg(*toStr)
+	if err != nil {
+		log.Fatalf("Can't parse -to %q: %v", *toStr, err)
+	}
+
+	outboxDir := cfg.Notifier.OutboxDir
+	notificationOutbox, err := outbox.NewDirectoryOutbox(outboxDir)
+	if err != nil {
+		log.Fatalf("Failed to open notification outbox: %v", err)
+	}
+
+	count, err := notificationOutbox.Replay(from, to, *all)
+	if err != nil {
+		log.Fatalf("Replay failed after rescheduling %d notifications: %v", count, err)
+	}
+	slog.Info("Rescheduled notifications", "count", count, "from", from, "to", to)
+}
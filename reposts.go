@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/dedup"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/storage"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+)
+
+// Fingerprints the cards stored before the repost detection was enabled, so the new cards are checked against them too
+func backfillRepostIndex(index *dedup.Index, cardStorage *storage.DirectoryCardStorage, storedCards []types.CardID) {
+	if index.Size() > 0 || len(storedCards) == 0 {
+		return
+	}
+	cards := append([]types.CardID{}, storedCards...)
+	sort.Slice(cards, func(i, j int) bool { return cards[i] < cards[j] })
+
+	logger := logging.Component(context.Background(), "dedup")
+	logger.Info("Repost index is empty, fingerprinting stored cards...", "count", len(cards))
+	added := 0
+	for _, card := range cards {
+		jsonCard, err := cardStorage.LoadCardJSON(card)
+		if err != nil {
+			logger.Warn("Skipping the card in the repost index", logging.CardIDKey, card, logging.ErrorKey, err)
+			continue
+		}
+		// the address is stored as "<city>, <address>"
+		city, _, _ := strings.Cut(jsonCard.Location.Address, ", ")
+		err = index.Add(card, dedup.NewFingerprint(jsonCard.ContactInfo.Comment, city))
+		if err != nil {
+			logging.Panic(logger, "Failed to add the card to the repost index", logging.CardIDKey, card, logging.ErrorKey, err)
+		}
+		added++
+	}
+	logger.Info("Added stored cards to the repost index", "count", added)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/metrics"
+)
+
+// Serves the stored cards over HTTP without crawling, e.g. next to the crawler sharing its card dir
+func runServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listenAddr := flags.String("addr", "", "address to listen on (default http.listen_addr of the config or :8080)")
+	configFlags := addConfigFlags(flags)
+	flags.Parse(args)
+	cfg := configFlags.load()
+	if *listenAddr == "" {
+		*listenAddr = cfg.HTTP.ListenAddr
+	}
+	if *listenAddr == "" {
+		*listenAddr = ":8080"
+	}
+
+	_, cardStorage, _, err := openCardStorage(cfg)
+	exitOnSetupError(err)
+	blobStore, _, err := openBlobStore(cfg)
+	exitOnSetupError(err)
+
+	httpMux := http.NewServeMux()
+	httpMux.Handle("/metrics", metrics.Handler())
+	httpMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mountCardsAPI(httpMux, cardStorage, blobStore)
+
+	slog.Info("Serving HTTP endpoints", "addr", *listenAddr)
+	log.Panic(http.ListenAndServe(*listenAddr, httpMux))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/blobstore"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/config"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/crawler"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/dedup"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/httpfixture"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/logging"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/metrics"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/notification"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/outbox"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/storage"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/tracing"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/types"
+	"github.com/LostPetInitiative/poiskzoo-ru-crawler/pkg/utils"
+)
+
+// The setup shared by the commands, as configured by config.Config
+
+// Reports the error the command can't start with and exits
+func exitOnSetupError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Sets up tracing, returns the function flushing the spans on exit
+func setupTracing(cfg *config.Config) (func(), error) {
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	return func() { shutdownTracing(context.Background()) }, nil
+}
+
+// Configures utils.DefaultClient: timeouts, politeness, robots.txt, cache, proxies and fixtures.
+// The config is validated, so the specs are parsed without errors
+func setupHTTPClient(cfg *config.Config) error {
+	utils.DefaultClient.Timeout = time.Duration(cfg.HTTP.TimeoutSec) * time.Second
+	utils.DefaultClient.MaxAttempts = cfg.HTTP.MaxAttempts
+	hostLimits, _ := utils.ParseHostLimits(cfg.HTTP.HostLimits)
+	utils.DefaultClient.Limiter.SetLimits(hostLimits)
+	bodyLimits, _ := utils.ParseBodyLimits(cfg.HTTP.BodyLimitsMB)
+	for class, limit := range bodyLimits {
+		utils.DefaultClient.MaxBodyBytes[class] = limit
+	}
+	if cfg.HTTP.IgnoreRobots {
+		slog.Warn("robots.txt is ignored, the crawler may fetch disallowed pages")
+	} else {
+		robotsGate := utils.NewRobotsGate(strings.Split(cfg.HTTP.RobotsTxtHosts, ",")...)
+		utils.DefaultClient.Robots = robotsGate
+		metrics.RegisterRobotsSkips(robotsGate.Skipped)
+	}
+	if httpCacheDir := cfg.HTTP.CacheDir; httpCacheDir != "" {
+		httpCache, err := utils.NewDiskHttpCache(httpCacheDir)
+		if err != nil {
+			return fmt.Errorf("failed to open HTTP cache: %w", err)
+		}
+		httpCache.MaxSizeBytes = int64(cfg.HTTP.CacheMaxMB) << 20
+		httpCache.CacheOnly = cfg.HTTP.CacheOnly
+		utils.DefaultClient.Cache = httpCache
+		metrics.RegisterCache("http", httpCache.Stats)
+		slog.Info("Caching HTTP responses", "dir", httpCacheDir, "cached_bytes", httpCache.Size(), "cache_only", httpCache.CacheOnly)
+	} else {
+		slog.Info("HTTP cache dir is not set, HTTP responses are not cached")
+	}
+	if proxies := cfg.HTTP.Proxies; proxies != "" {
+		proxyRouter, _ := utils.NewProxyRouter(strings.Split(proxies, ","))
+		// by default only the site goes via the proxies, the geocoder and the pipeline are reached directly
+		proxyRoutes, _ := utils.ParseProxyRoutes(cfg.HTTP.ProxyRoutes)
+		proxyRouter.SetRoutes(proxyRoutes)
+		utils.DefaultClient.SetTransport(proxyRouter)
+		metrics.RegisterProxies(proxyRouter.Stats)
+		checkInterval := time.Duration(cfg.HTTP.ProxyCheckIntervalSec) * time.Second
+		go proxyRouter.RunHealthChecks(context.Background(), cfg.HTTP.ProxyCheckURL, checkInterval)
+		slog.Info("Routing HTTP requests via proxies", "proxies", len(proxyRouter.Stats())-1, "default_route", proxyRouter.DefaultRoute)
+	} else {
+		slog.Info("No proxies are set, HTTP requests go directly")
+	}
+	if fixturesDir := cfg.HTTP.FixturesDir; fixturesDir != "" {
+		// record a session once to replay it later without network, e.g. for debugging the parser
+		fixturesMode := cfg.HTTP.FixturesMode
+		if err := httpfixture.Install(utils.DefaultClient, fixturesDir, fixturesMode); err != nil {
+			return fmt.Errorf("failed to set up HTTP fixtures: %w", err)
+		}
+		slog.Warn("HTTP exchanges go through the fixtures", "dir", fixturesDir, "mode", fixturesMode)
+	}
+	return nil
+}
+
+// Creates the notifier of the configured kind, nil if the pipeline is not notified.
+// The returned function releases it
+func setupNotifier(cfg *config.Config) (notification.Notifier, func(), error) {
+	switch cfg.Notifier.Kind {
+	case "http":
+		if cfg.Notifier.PipelineURL == "" {
+			slog.Info("Pipeline URL is not set, will not do pipeline notification")
+			return nil, func() {}, nil
+		}
+		slog.Info("Pipeline URL is set, using it to notify pipeline", "value", cfg.Notifier.PipelineURL)
+		pipelineNotificationUrl, _ := url.Parse(cfg.Notifier.PipelineURL)
+		httpNotifier := notification.NewHttpNotifier(pipelineNotificationUrl)
+		httpNotifier.CloudEvents, _ = notification.ParseCloudEventsMode(cfg.Notifier.CloudEventsMode)
+		httpNotifier.SchemaVersion = crawler.CardJSONSchemaVersion
+		if cfg.Notifier.WebhookSecret != "" {
+			slog.Info("Webhook secret is set, signing the notifications")
+			httpNotifier.Secret = []byte(cfg.Notifier.WebhookSecret)
+		}
+		return httpNotifier, func() {}, nil
+	case "webhooks":
+		configPath := cfg.Notifier.WebhooksConfig
+		configJSON, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read webhooks config: %w", err)
+		}
+		targets, err := notification.ParseWebhookTargets(configJSON, crawler.CardJSONSchemaVersion, os.LookupEnv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid webhooks config %s: %w", configPath, err)
+		}
+		slog.Info("Notifying webhook targets", "count", len(targets))
+		return notification.NewFanOutNotifier(targets), func() {}, nil
+	case "kafka":
+		brokers := strings.Split(cfg.Notifier.KafkaBrokers, ",")
+		compression, _ := notification.ParseKafkaCompression(cfg.Notifier.KafkaCompression)
+		kafkaNotifier, err := notification.NewKafkaNotifier(brokers, cfg.Notifier.KafkaTopic, compression, crawler.CardJSONSchemaVersion)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create kafka producer: %w", err)
+		}
+		return kafkaNotifier, func() { kafkaNotifier.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported notifier %q", cfg.Notifier.Kind)
+	}
+}
+
+// Opens (creating if needed) the card storage in the cards dir
+func openCardStorage(cfg *config.Config) (string, *storage.DirectoryCardStorage, []types.CardID, error) {
+	cardsDir := cfg.CardsDir
+	_, err := os.Stat(cardsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("Creating non existing dir", "dir", cardsDir)
+		err = os.Mkdir(cardsDir, os.FileMode(0644))
+	}
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to open cards dir: %w", err)
+	}
+	directoryCardStorage := storage.NewDirectoryCardStorage(cardsDir)
+	storedCards, err := directoryCardStorage.StoredCards()
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to list stored cards: %w", err)
+	}
+	slog.Info("Found stored cards", "count", len(storedCards))
+	return cardsDir, directoryCardStorage, storedCards, nil
+}
+
+// Opens the blob store if the images are stored by reference, nil otherwise
+func openBlobStore(cfg *config.Config) (*blobstore.BlobStore, *url.URL, error) {
+	if cfg.Images.Mode != "reference" {
+		return nil, nil, nil
+	}
+	blobStore, err := blobstore.NewDirectoryBlobStore(cfg.Images.BlobsDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open blob store: %w", err)
+	}
+	blobsBaseUrl, _ := url.Parse(cfg.Images.BlobsBaseURL)
+	return blobStore, blobsBaseUrl, nil
+}
+
+// Everything the commands fetching the cards need
+type crawlerSetup struct {
+	cardsDir    string
+	storage     *storage.DirectoryCardStorage
+	storedCards []types.CardID
+	crawler     *crawler.Crawler
+	// nil if the pipeline is not notified
+	outbox    *outbox.Outbox
+	outboxDir string
+	// delivers the outbox entries, not started
+	sender    *outbox.Sender
+	blobStore *blobstore.BlobStore
+	// releases the notifier and flushes the traces
+	close func()
+}
+
+// Sets up the crawler with its storage, indices and notifications.
+// On error everything set up so far is released
+func setupCrawler(cfg *config.Config) (*crawlerSetup, error) {
+	slog.Info("Starting up...")
+	shutdownTracing, err := setupTracing(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &crawlerSetup{close: shutdownTracing}
+	if err := s.setup(cfg); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *crawlerSetup) setup(cfg *config.Config) error {
+	if err := setupHTTPClient(cfg); err != nil {
+		return err
+	}
+	crawler.ConfigureGeocoding(cfg.Geocoding.NominatimInterval, cfg.Geocoding.CacheSize)
+
+	var err error
+	s.cardsDir, s.storage, s.storedCards, err = openCardStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	notifier, closeNotifier, err := setupNotifier(cfg)
+	if err != nil {
+		return err
+	}
+	shutdownTracing := s.close
+	s.close = func() {
+		closeNotifier()
+		shutdownTracing()
+	}
+	if notifier != nil {
+		s.outboxDir = cfg.Notifier.OutboxDir
+		s.outbox, err = outbox.NewDirectoryOutbox(s.outboxDir)
+		if err != nil {
+			return fmt.Errorf("failed to open notification outbox: %w", err)
+		}
+		s.sender = outbox.NewSender(s.outbox, func(ctx context.Context, entry *outbox.Entry, payload []byte) error {
+			err := notifier.Notify(ctx, &notification.Notification{
+				Key:         entry.Key,
+				CardID:      entry.CardID,
+				EventType:   entry.EventType,
+				CreatedAt:   entry.CreatedAt,
+				Payload:     payload,
+				DeliveredTo: entry.DeliveredTo,
+			})
+			var partialErr *notification.PartialDeliveryError
+			if errors.As(err, &partialErr) {
+				entry.DeliveredTo = append(entry.DeliveredTo, partialErr.Delivered...)
+			}
+			return err
+		})
+		s.sender.Retention = cfg.Notifier.OutboxRetention
+	}
+
+	var localCardStorage crawler.LocalCardStorage = s.storage
+	s.crawler = crawler.NewCrawler(&localCardStorage, s.outbox)
+
+	var blobsBaseUrl *url.URL
+	s.blobStore, blobsBaseUrl, err = openBlobStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	imageHashIndexPath := cfg.ImageHashIndex
+	if imageHashIndexPath == "" {
+		imageHashIndexPath = path.Join(s.cardsDir, "image-hashes.txt")
+	}
+	imageHashIndex, err := storage.NewFileImageHashIndex(imageHashIndexPath)
+	if err != nil {
+		return fmt.Errorf("failed to load image hash index: %w", err)
+	}
+	backfillImageHashIndex(imageHashIndex, s.storage, s.blobStore, s.storedCards)
+	s.crawler.UseImageHashIndex(imageHashIndex)
+
+	repostIndexPath := cfg.RepostIndex
+	if repostIndexPath == "" {
+		repostIndexPath = path.Join(s.cardsDir, "text-fingerprints.jsonl")
+	}
+	repostIndex, err := dedup.NewFileIndex(repostIndexPath)
+	if err != nil {
+		return fmt.Errorf("failed to load repost index: %w", err)
+	}
+	backfillRepostIndex(repostIndex, s.storage, s.storedCards)
+	s.crawler.UseRepostDetection(repostIndex, cfg.SuppressExactReposts)
+
+	if s.blobStore != nil {
+		s.crawler.UseImageReferences(s.blobStore, blobsBaseUrl)
+		s.crawler.UseImageDownloadDir(s.blobStore.TempDir())
+	} else {
+		downloadsDir, err := s.storage.DownloadsDir()
+		if err != nil {
+			return fmt.Errorf("failed to create image downloads dir: %w", err)
+		}
+		s.crawler.UseImageDownloadDir(downloadsDir)
+	}
+	return nil
+}
+
+// Delivers the notifications enqueued so far, for the commands that exit instead of running the sender
+func (s *crawlerSetup) deliverPending(ctx context.Context) {
+	if s.sender == nil {
+		return
+	}
+	delivered, err := s.sender.DeliverDue(ctx)
+	if err != nil {
+		slog.Error("Failed to deliver notifications, they stay in the outbox", "delivered", delivered, logging.ErrorKey, err)
+		return
+	}
+	slog.Info("Delivered notifications", "count", delivered)
+	if _, err := s.sender.PruneExpired(ctx); err != nil {
+		slog.Error("Failed to prune delivered notifications", logging.ErrorKey, err)
+	}
+}
+
+// The endpoints serving the stored cards and their images
+func mountCardsAPI(httpMux *http.ServeMux, cardStorage *storage.DirectoryCardStorage, blobStore *blobstore.BlobStore) {
+	httpMux.Handle("/cards", newCardsAPI(cardStorage))
+	httpMux.Handle("/cards/", newCardsAPI(cardStorage))
+	if blobStore != nil {
+		httpMux.Handle("/blobs/", http.StripPrefix("/blobs/", blobStore))
+	}
+}
+
+// Max-heap of the stored cards, the latest ones are on top
+func newKnownIDsHeap(storedCards []types.CardID) *utils.CardIDHeap {
+	var knownIDsHeap *utils.CardIDHeap = &utils.CardIDHeap{}
+	for _, card := range storedCards {
+		heap.Push(knownIDsHeap, card)
+	}
+	return knownIDsHeap
+}